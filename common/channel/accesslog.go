@@ -0,0 +1,162 @@
+package channel
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yinqiwen/gotoolkit/iotools"
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+type AccessLogConfig struct {
+	//file of the access log with one JSON line per closed connection, disabled if empty
+	Path string
+	//rotate the file once it exceeds the size, default 100M
+	MaxFileSize string
+	//max number of rotated files, default 5
+	MaxBackupIndex int
+}
+
+// AccessLogEntry is a line of the access log, 'Up' is the data sent by the
+// client of the connection.
+type AccessLogEntry struct {
+	Start       time.Time
+	End         time.Time
+	Side        string
+	User        string
+	ClientIP    string
+	Protocol    string
+	Destination string
+	PACRule     string
+	Channel     string
+	Server      string
+	BytesUp     int64
+	BytesDown   int64
+	CloseReason string
+}
+
+var accessLog struct {
+	sync.Mutex
+	w io.WriteCloser
+}
+
+// InitAccessLog opens the access log, the current one is closed if the path
+// is empty.
+func InitAccessLog(conf AccessLogConfig) error {
+	var w io.WriteCloser
+	if len(conf.Path) > 0 {
+		maxFileSize := uint64(100 * 1024 * 1024)
+		if len(conf.MaxFileSize) > 0 {
+			v, err := helper.ToBytes(conf.MaxFileSize)
+			if nil != err {
+				return err
+			}
+			maxFileSize = v
+		}
+		maxBackupIndex := conf.MaxBackupIndex
+		if maxBackupIndex <= 0 {
+			maxBackupIndex = 5
+		}
+		w = &iotools.RotateFile{
+			Path:           conf.Path,
+			MaxBackupIndex: maxBackupIndex,
+			MaxFileSize:    int64(maxFileSize),
+		}
+		logger.Info("Write access log into %s", conf.Path)
+	}
+	accessLog.Lock()
+	prev := accessLog.w
+	accessLog.w = w
+	accessLog.Unlock()
+	if nil != prev {
+		prev.Close()
+	}
+	return nil
+}
+
+func AccessLogEnabled() bool {
+	accessLog.Lock()
+	defer accessLog.Unlock()
+	return nil != accessLog.w
+}
+
+// ClientIP returns the ip of the 'host:port' address.
+func ClientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if nil != err {
+		return addr
+	}
+	return host
+}
+
+func WriteAccessLog(entry *AccessLogEntry) {
+	accessLog.Lock()
+	defer accessLog.Unlock()
+	if nil == accessLog.w {
+		return
+	}
+	if entry.End.IsZero() {
+		entry.End = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if nil != err {
+		logger.Error("[ERROR]Failed to encode access log for reason:%v", err)
+		return
+	}
+	accessLog.w.Write(append(line, '\n'))
+}
+
+// CloseReason keeps the first reason of closing a connection.
+type CloseReason struct {
+	mutex  sync.Mutex
+	reason string
+}
+
+func (r *CloseReason) Set(reason string) {
+	r.mutex.Lock()
+	if len(r.reason) == 0 {
+		r.reason = reason
+	}
+	r.mutex.Unlock()
+}
+
+func (r *CloseReason) String() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.reason
+}
+
+// CopyCloseReason returns the close reason by the error of copying data from
+// the side of a connection.
+func CopyCloseReason(side string, err error) string {
+	if nil == err || err == io.EOF {
+		return side + "-closed"
+	}
+	if isTimeoutErr(err) {
+		return "idle-timeout"
+	}
+	return "error"
+}
+
+func newServerAccessLogEntry(ctx *sessionContext, creq *mux.ConnectRequest, start time.Time) *AccessLogEntry {
+	entry := &AccessLogEntry{
+		Start:       start,
+		Side:        "server",
+		User:        ctx.user(),
+		Protocol:    creq.Network,
+		Destination: creq.Addr,
+		Channel:     ctx.scheme,
+	}
+	if nil != ctx.remoteAddr {
+		entry.ClientIP = ClientIP(ctx.remoteAddr.String())
+	}
+	if len(creq.Hops) > 0 {
+		entry.Server = creq.Hops[0]
+	}
+	return entry
+}
@@ -0,0 +1,54 @@
+package channel
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/yinqiwen/pmux"
+)
+
+type testAccessLogWriter struct {
+	bytes.Buffer
+}
+
+func (w *testAccessLogWriter) Close() error {
+	return nil
+}
+
+func TestWriteAccessLog(t *testing.T) {
+	w := &testAccessLogWriter{}
+	accessLog.w = w
+	defer InitAccessLog(AccessLogConfig{})
+	if !AccessLogEnabled() {
+		t.Fatalf("Access log should be enabled")
+	}
+	var reason CloseReason
+	reason.Set(CopyCloseReason("remote", nil))
+	reason.Set(CopyCloseReason("client", io.ErrUnexpectedEOF))
+	WriteAccessLog(&AccessLogEntry{Side: "server", User: "abc", ClientIP: ClientIP("1.2.3.4:5678"), Destination: "example.com:443", BytesUp: 10, CloseReason: reason.String()})
+	WriteAccessLog(&AccessLogEntry{Side: "server", CloseReason: CopyCloseReason("client", pmux.ErrTimeout)})
+
+	lines := bytes.Split(bytes.TrimSpace(w.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+	var entry AccessLogEntry
+	if err := json.Unmarshal(lines[0], &entry); nil != err {
+		t.Fatal(err)
+	}
+	if entry.User != "abc" || entry.ClientIP != "1.2.3.4" || entry.BytesUp != 10 || entry.CloseReason != "remote-closed" || entry.End.IsZero() {
+		t.Fatalf("Unexpected entry:%+v", entry)
+	}
+	json.Unmarshal(lines[1], &entry)
+	if entry.CloseReason != "idle-timeout" {
+		t.Fatalf("Unexpected close reason:%s", entry.CloseReason)
+	}
+
+	InitAccessLog(AccessLogConfig{})
+	WriteAccessLog(&AccessLogEntry{Side: "server"})
+	if AccessLogEnabled() || len(bytes.Split(bytes.TrimSpace(w.Bytes()), []byte("\n"))) != 2 {
+		t.Fatalf("Access log should be disabled")
+	}
+}
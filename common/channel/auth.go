@@ -0,0 +1,181 @@
+package channel
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+const defaultAuthClockSkew = 120
+const defaultAuthReplayCacheSize = 65536
+
+type authNonce struct {
+	nonce  string
+	expire int64
+}
+
+// authReplayCache remembers the nonces of accepted auth requests until they
+// are out of the clock skew window.
+type authReplayCache struct {
+	mutex  sync.Mutex
+	limit  int
+	nonces map[string]*list.Element
+	order  *list.List
+}
+
+func newAuthReplayCache(limit int) *authReplayCache {
+	return &authReplayCache{
+		limit:  limit,
+		nonces: make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// add returns false if the nonce is already in the cache, or the cache is full
+// of unexpired nonces, since evicting any of them makes it replayable.
+func (c *authReplayCache) add(nonce string, now, expire int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for e := c.order.Front(); nil != e; e = c.order.Front() {
+		n := e.Value.(*authNonce)
+		if n.expire > now {
+			break
+		}
+		c.order.Remove(e)
+		delete(c.nonces, n.nonce)
+	}
+	if _, exist := c.nonces[nonce]; exist {
+		return false
+	}
+	if c.order.Len() >= c.limit {
+		logger.Error("[ERROR]Auth replay cache is full of %d unexpired nonces, reject the auth request.", c.limit)
+		return false
+	}
+	c.nonces[nonce] = c.order.PushBack(&authNonce{nonce: nonce, expire: expire})
+	return true
+}
+
+var serverAuthReplayCache *authReplayCache
+var serverAuthReplayCacheOnce sync.Once
+
+func getServerAuthReplayCache() *authReplayCache {
+	serverAuthReplayCacheOnce.Do(func() {
+		limit := DefaultServerCipher.AuthReplayCacheSize
+		if limit <= 0 {
+			limit = defaultAuthReplayCacheSize
+		}
+		serverAuthReplayCache = newAuthReplayCache(limit)
+	})
+	return serverAuthReplayCache
+}
+
+type serverKey struct {
+	name string
+	key  string
+}
+
+func newServerKey(name, key string) serverKey {
+	if len(name) == 0 {
+		sum := sha256.Sum256([]byte(key))
+		name = hex.EncodeToString(sum[0:4])
+	}
+	return serverKey{name: name, key: key}
+}
+
+func parseKeyExpire(s string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if nil != err {
+		t, err = time.Parse(time.RFC3339, s)
+	}
+	return t, err
+}
+
+// acceptedKeys returns the Key & the unexpired Keys in order.
+func (conf *CipherConfig) acceptedKeys(now time.Time) []serverKey {
+	var keys []serverKey
+	if len(conf.Key) > 0 {
+		keys = append(keys, newServerKey("", conf.Key))
+	}
+	for _, k := range conf.Keys {
+		if len(k.Key) == 0 {
+			continue
+		}
+		if len(k.Expire) > 0 {
+			expire, err := parseKeyExpire(k.Expire)
+			if nil != err {
+				logger.Error("[ERROR]Invalid expire time:%s of key:%s", k.Expire, k.Name)
+				continue
+			}
+			if !now.Before(expire) {
+				continue
+			}
+		}
+		keys = append(keys, newServerKey(k.Name, k.Key))
+	}
+	return keys
+}
+
+// serverAuthKeys returns the keys to verify the auth request of the user, the
+// user's own key if it's in users file, otherwise the key decrypts the mux
+// session or all accepted keys.
+func serverAuthKeys(user string, sessionKey []byte) []serverKey {
+	if u := getServerUser(user); nil != u && len(u.Key) > 0 {
+		return []serverKey{{name: "user:" + user, key: u.Key}}
+	}
+	keys := DefaultServerCipher.acceptedKeys(time.Now())
+	if len(sessionKey) > 0 {
+		for _, k := range keys {
+			if k.key == string(sessionKey) {
+				return []serverKey{k}
+			}
+		}
+		return []serverKey{newServerKey("", string(sessionKey))}
+	}
+	return keys
+}
+
+func verifyAuthRequest(req *mux.AuthRequest, keys []serverKey, skew int64, cache *authReplayCache, now time.Time) (serverKey, bool) {
+	var key serverKey
+	if len(keys) > 0 {
+		key = keys[0]
+	}
+	if len(req.MAC) == 0 && len(req.Nonce) == 0 && DefaultServerCipher.AllowLegacyAuth {
+		return key, true
+	}
+	verified := false
+	for _, k := range keys {
+		if req.VerifyMAC(k.key) {
+			key, verified = k, true
+			break
+		}
+	}
+	if !verified {
+		logger.Error("[ERROR]Invalid auth MAC from user:%s", req.User)
+		return key, false
+	}
+	diff := now.Unix() - req.Timestamp
+	if diff > skew || diff < -skew {
+		logger.Error("[ERROR]Auth timestamp of user:%s is out of clock skew window, diff %ds", req.User, diff)
+		return key, false
+	}
+	if !cache.add(req.Nonce, now.Unix(), req.Timestamp+skew+1) {
+		logger.Error("[ERROR]Replayed auth request from user:%s", req.User)
+		return key, false
+	}
+	return key, true
+}
+
+// verifyServerAuthRequest checks the MAC, timestamp & nonce of the auth
+// request, returns the key which signs the request.
+func verifyServerAuthRequest(req *mux.AuthRequest, sessionKey []byte) (serverKey, bool) {
+	skew := int64(DefaultServerCipher.AuthClockSkew)
+	if skew <= 0 {
+		skew = defaultAuthClockSkew
+	}
+	return verifyAuthRequest(req, serverAuthKeys(req.User, sessionKey), skew, getServerAuthReplayCache(), time.Now())
+}
@@ -0,0 +1,106 @@
+package channel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+func TestVerifyAuthRequest(t *testing.T) {
+	cache := newAuthReplayCache(16)
+	keys := []serverKey{newServerKey("", "key")}
+	wrong := []serverKey{newServerKey("", "wrong")}
+	req := &mux.AuthRequest{User: "abc", CipherMethod: "chacha20poly1305", CipherCounter: 1}
+	req.Sign("key")
+	now := time.Unix(req.Timestamp, 0)
+	if _, ok := verifyAuthRequest(req, wrong, 120, cache, now); ok {
+		t.Fatalf("Request should be rejected with wrong key")
+	}
+	if _, ok := verifyAuthRequest(req, keys, 120, cache, now); !ok {
+		t.Fatalf("Request should be accepted")
+	}
+	if _, ok := verifyAuthRequest(req, keys, 120, cache, now.Add(time.Second)); ok {
+		t.Fatalf("Replayed request should be rejected")
+	}
+
+	req.Sign("key")
+	if _, ok := verifyAuthRequest(req, keys, 120, cache, now.Add(121*time.Second)); ok {
+		t.Fatalf("Request out of clock skew window should be rejected")
+	}
+	req.Sign("key")
+	req.User = "def"
+	if _, ok := verifyAuthRequest(req, keys, 120, cache, time.Unix(req.Timestamp, 0)); ok {
+		t.Fatalf("Tampered request should be rejected")
+	}
+	if _, ok := verifyAuthRequest(&mux.AuthRequest{User: "abc"}, keys, 120, cache, now); ok {
+		t.Fatalf("Request without MAC should be rejected")
+	}
+}
+
+func TestAuthReplayCache(t *testing.T) {
+	cache := newAuthReplayCache(2)
+	if !cache.add("a", 100, 200) || !cache.add("b", 100, 200) || cache.add("b", 150, 200) {
+		t.Fatalf("Unexpected replay cache result")
+	}
+	//expired nonces are evicted
+	if !cache.add("c", 200, 300) || cache.order.Len() != 1 {
+		t.Fatalf("Expired nonces should be evicted, %d left", cache.order.Len())
+	}
+	//new nonces are rejected if the cache is full of unexpired nonces
+	if !cache.add("d", 200, 300) || cache.add("e", 200, 300) || cache.order.Len() != 2 || cache.add("c", 250, 300) {
+		t.Fatalf("Unexpired nonces should never be evicted")
+	}
+	if !cache.add("e", 300, 400) || cache.order.Len() != 1 {
+		t.Fatalf("Expected new nonce accepted once the cache is expired")
+	}
+}
+
+func TestAcceptedKeys(t *testing.T) {
+	conf := &CipherConfig{
+		Key: "k0",
+		Keys: []CipherKeyConfig{
+			{Name: "old", Key: "k1", Expire: "2026-10-20"},
+			{Name: "older", Key: "k2", Expire: "2026-10-01T00:00:00Z"},
+			{Name: "invalid", Key: "k3", Expire: "someday"},
+			{Key: "k4"},
+		},
+	}
+	keys := conf.acceptedKeys(time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local))
+	if len(keys) != 3 || keys[0].key != "k0" || keys[1].name != "old" || keys[2].key != "k4" {
+		t.Fatalf("Unexpected accepted keys:%v", keys)
+	}
+	if keys[0].name != newServerKey("", "k0").name || len(keys[0].name) != 8 {
+		t.Fatalf("Key without name should be named by fingerprint")
+	}
+
+	//the key which signs the request is returned
+	req := &mux.AuthRequest{User: "abc"}
+	req.Sign("k4")
+	key, ok := verifyAuthRequest(req, keys, 120, newAuthReplayCache(16), time.Unix(req.Timestamp, 0))
+	if !ok || key.key != "k4" {
+		t.Fatalf("Request should be accepted by key k4")
+	}
+}
+
+func TestClientExchangedKey(t *testing.T) {
+	client, _ := mux.NewKeyExchange()
+	server, _ := mux.NewKeyExchange()
+	serverKey, _ := server.ServerKey("k", client.Public)
+	res := &mux.AuthResponse{Code: mux.AuthOK, KexPub: server.Public, KexMAC: mux.KexMAC("k", client.Public, server.Public)}
+	conf := &CipherConfig{User: "abc"}
+	if key, err := clientExchangedKey(conf, "k", client, res); nil != err || !bytes.Equal(key, serverKey) {
+		t.Fatalf("Unexpected exchanged key, err:%v", err)
+	}
+	if _, err := clientExchangedKey(conf, "other", client, res); err != mux.ErrAuthFailed {
+		t.Fatalf("Key exchange with invalid MAC should fail")
+	}
+	if _, err := clientExchangedKey(conf, "k", client, &mux.AuthResponse{Code: mux.AuthOK}); err != mux.ErrAuthFailed {
+		t.Fatalf("Unanswered key exchange should fail")
+	}
+	conf.AllowNoKex = true
+	if key, err := clientExchangedKey(conf, "k", client, &mux.AuthResponse{Code: mux.AuthOK}); nil != err || len(key) > 0 {
+		t.Fatalf("Unanswered key exchange should be allowed by AllowNoKex")
+	}
+}
@@ -0,0 +1,142 @@
+package channel
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+const (
+	RoundRobinPolicy   = "round-robin"
+	LeastLatencyPolicy = "least-latency"
+	LeastStreamsPolicy = "least-streams"
+	WeightedPolicy     = "weighted"
+)
+
+// rtt used for sessions which have not been pinged yet
+const defaultHolderRTT = 200 * time.Millisecond
+
+// failures older than this window are forgotten
+const holderFailureWindow = 60 * time.Second
+
+func IsValidSelectPolicy(policy string) bool {
+	switch policy {
+	case RoundRobinPolicy:
+	case LeastLatencyPolicy:
+	case LeastStreamsPolicy:
+	case WeightedPolicy:
+	default:
+		return false
+	}
+	return true
+}
+
+type holderStat struct {
+	rtt          int64
+	failures     int32
+	lastFailTime int64
+}
+
+func (s *holderStat) updateRTT(d time.Duration) {
+	prev := atomic.LoadInt64(&s.rtt)
+	if prev > 0 {
+		//exponentially weighted moving average
+		d = time.Duration(float64(prev)*0.7 + float64(d)*0.3)
+	}
+	atomic.StoreInt64(&s.rtt, int64(d))
+}
+
+func (s *holderStat) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+func (s *holderStat) onFailure() {
+	atomic.AddInt32(&s.failures, 1)
+	atomic.StoreInt64(&s.lastFailTime, time.Now().UnixNano())
+}
+
+func (s *holderStat) onSuccess() {
+	atomic.StoreInt32(&s.failures, 0)
+}
+
+func (s *holderStat) recentFailures() int {
+	last := atomic.LoadInt64(&s.lastFailTime)
+	if 0 == last || time.Now().Sub(time.Unix(0, last)) > holderFailureWindow {
+		return 0
+	}
+	return int(atomic.LoadInt32(&s.failures))
+}
+
+// ReportConnectFailure feeds the failed connect of the stream back to the
+// session which opened it. The failures answered by the server are caused by
+// the destination, so only the ack errors & timeouts are counted.
+func ReportConnectFailure(stream mux.MuxStream, err error) {
+	if _, answered := err.(*mux.ConnectError); answered || nil == err {
+		return
+	}
+	if ps, ok := stream.(*mux.ProxyMuxStream); ok && nil != ps.OnConnectFailure {
+		ps.OnConnectFailure()
+	}
+}
+
+// score is the estimated cost to use a session, the lower the better.
+func (s *holderStat) score() float64 {
+	rtt := s.RTT()
+	if rtt <= 0 {
+		rtt = defaultHolderRTT
+	}
+	ms := float64(rtt) / float64(time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return ms * float64(1+2*s.recentFailures())
+}
+
+func (ch *LocalProxyChannel) orderedSessions() []*muxSessionHolder {
+	n := len(ch.sessions)
+	if 0 == n {
+		return nil
+	}
+	start := int(uint32(atomic.AddInt32(&ch.cursor, 1)-1) % uint32(n))
+	ordered := make([]*muxSessionHolder, 0, n)
+	for i := 0; i < n; i++ {
+		ordered = append(ordered, ch.sessions[(start+i)%n])
+	}
+	switch ch.Conf.SelectPolicy {
+	case LeastLatencyPolicy:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].stat.score() < ordered[j].stat.score()
+		})
+	case LeastStreamsPolicy:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			fi, fj := ordered[i].stat.recentFailures(), ordered[j].stat.recentFailures()
+			if fi != fj {
+				return fi < fj
+			}
+			si, sj := ordered[i].numStreams(), ordered[j].numStreams()
+			if si != sj {
+				return si < sj
+			}
+			return ordered[i].stat.score() < ordered[j].stat.score()
+		})
+	case WeightedPolicy:
+		//weighted random order, the weight of each session is 1/score
+		keys := make(map[*muxSessionHolder]float64, n)
+		for _, holder := range ordered {
+			keys[holder] = -math.Log(1-rand.Float64()) * holder.stat.score()
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return keys[ordered[i]] < keys[ordered[j]]
+		})
+	default:
+		//round robin, but sessions with recent failures are tried last
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].stat.recentFailures() < ordered[j].stat.recentFailures()
+		})
+	}
+	return ordered
+}
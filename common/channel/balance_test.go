@@ -0,0 +1,143 @@
+package channel
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+func newTestChannel(policy string, rtts ...time.Duration) *LocalProxyChannel {
+	ch := &LocalProxyChannel{}
+	ch.Conf.SelectPolicy = policy
+	for i, rtt := range rtts {
+		holder := &muxSessionHolder{server: string(rune('a' + i))}
+		holder.stat.updateRTT(rtt)
+		ch.sessions = append(ch.sessions, holder)
+	}
+	return ch
+}
+
+func TestLeastLatencyPolicy(t *testing.T) {
+	ch := newTestChannel(LeastLatencyPolicy, 300*time.Millisecond, 20*time.Millisecond, 100*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		ordered := ch.orderedSessions()
+		if ordered[0].server != "b" || ordered[1].server != "c" || ordered[2].server != "a" {
+			t.Fatalf("Unexpected order:%s%s%s", ordered[0].server, ordered[1].server, ordered[2].server)
+		}
+	}
+	//a failing fast server should lose to a slower healthy one
+	for i := 0; i < 3; i++ {
+		ch.sessions[1].stat.onFailure()
+	}
+	if ordered := ch.orderedSessions(); ordered[0].server != "c" {
+		t.Fatalf("Expected 'c' first, but got '%s'", ordered[0].server)
+	}
+	ch.sessions[1].stat.onSuccess()
+	if ordered := ch.orderedSessions(); ordered[0].server != "b" {
+		t.Fatalf("Expected 'b' first, but got '%s'", ordered[0].server)
+	}
+}
+
+func TestRoundRobinPolicy(t *testing.T) {
+	ch := newTestChannel(RoundRobinPolicy, 0, 0, 0)
+	first := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		first[ch.orderedSessions()[0].server]++
+	}
+	if first["a"] != 2 || first["b"] != 2 || first["c"] != 2 {
+		t.Fatalf("Unbalanced round robin:%v", first)
+	}
+	ch.sessions[0].stat.onFailure()
+	for i := 0; i < 3; i++ {
+		ordered := ch.orderedSessions()
+		if ordered[len(ordered)-1].server != "a" {
+			t.Fatalf("Failed session should be tried last, but got order:%s%s%s", ordered[0].server, ordered[1].server, ordered[2].server)
+		}
+	}
+}
+
+func TestWeightedPolicy(t *testing.T) {
+	ch := newTestChannel(WeightedPolicy, 10*time.Millisecond, 1000*time.Millisecond)
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		first[ch.orderedSessions()[0].server]++
+	}
+	if first["a"] < first["b"]*10 {
+		t.Fatalf("Weighted selection prefer slow server:%v", first)
+	}
+}
+
+type countSession struct {
+	mux.MuxSession
+	streams int
+}
+
+func (s *countSession) NumStreams() int {
+	return s.streams
+}
+
+func (s *countSession) Close() error {
+	return nil
+}
+
+func TestLeastStreamsPolicyWithSessionChanges(t *testing.T) {
+	ch := newTestChannel(LeastStreamsPolicy, 0, 0)
+	ch.sessions[0].setSession(&countSession{streams: 5})
+	ch.sessions[1].setSession(&countSession{streams: 1})
+	if ordered := ch.orderedSessions(); ordered[0].server != "b" {
+		t.Fatalf("Expected 'b' first, but got '%s'", ordered[0].server)
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			ch.sessions[1].sessionMutex.Lock()
+			ch.sessions[1].setSession(&countSession{streams: i % 7})
+			ch.sessions[1].sessionMutex.Unlock()
+			ch.sessions[1].close()
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		ch.orderedSessions()
+	}
+	<-done
+	if ch.sessions[1].numStreams() != 0 {
+		t.Fatalf("Expected no stream of the closed session")
+	}
+}
+
+type streamSession struct {
+	mux.MuxSession
+}
+
+func (s *streamSession) OpenStream() (mux.MuxStream, error) {
+	return &mux.ProxyMuxStream{}, nil
+}
+
+func (s *streamSession) NumStreams() int {
+	return 0
+}
+
+func TestConnectFailureDeprioritised(t *testing.T) {
+	ch := newTestChannel(LeastLatencyPolicy, 20*time.Millisecond, 100*time.Millisecond)
+	for _, holder := range ch.sessions {
+		holder.setSession(&streamSession{})
+	}
+	stream, err := ch.sessions[0].getNewStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	//the destination failures answered by the server are not the server's
+	ReportConnectFailure(stream, &mux.ConnectError{Class: mux.ConnectErrRefused})
+	if ordered := ch.orderedSessions(); ordered[0].server != "a" {
+		t.Fatalf("Expected 'a' first, but got '%s'", ordered[0].server)
+	}
+	for i := 0; i < 3; i++ {
+		ReportConnectFailure(stream, io.ErrUnexpectedEOF)
+	}
+	if ordered := ch.orderedSessions(); ordered[0].server != "b" || ch.sessions[0].stat.recentFailures() != 3 {
+		t.Fatalf("Expected 'a' with connect failures de-prioritised, but got '%s' first", ordered[0].server)
+	}
+}
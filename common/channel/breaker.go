@@ -0,0 +1,124 @@
+package channel
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+const (
+	// consecutive dial failures to open the breaker
+	breakerFailureThreshold = 3
+	breakerMinBackoff       = 1 * time.Second
+	breakerMaxBackoff       = 2 * time.Minute
+)
+
+var errBreakerOpen = errors.New("Circuit breaker is open")
+var errHolderDialing = errors.New("Session is dialing")
+
+// holderBreaker guards the reconnects of a session holder, only one dial is in
+// flight at a time. Once the breaker is open no dial is made until the backoff
+// expires, then a single probe dial is allowed in half-open state to decide
+// whether to close or reopen it.
+type holderBreaker struct {
+	mutex     sync.Mutex
+	state     int
+	failures  int
+	backoff   time.Duration
+	retryTime time.Time
+	dialing   bool
+}
+
+func (b *holderBreaker) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+func (b *holderBreaker) retryAfter() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state != breakerOpen {
+		return 0
+	}
+	d := b.retryTime.Sub(time.Now())
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// skip returns true if a dial would be rejected by the breaker now.
+func (b *holderBreaker) skip() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.dialing {
+		return true
+	}
+	return b.state == breakerOpen && time.Now().Before(b.retryTime)
+}
+
+// allow returns nil if the caller could dial now, the caller must report the
+// dial result by onSuccess/onFailure.
+func (b *holderBreaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.dialing {
+		return errHolderDialing
+	}
+	if b.state == breakerOpen {
+		if time.Now().Before(b.retryTime) {
+			return errBreakerOpen
+		}
+		b.state = breakerHalfOpen
+	}
+	b.dialing = true
+	return nil
+}
+
+func (b *holderBreaker) onSuccess() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.backoff = 0
+	b.dialing = false
+}
+
+// onFailure returns the backoff if the failure opens the breaker.
+func (b *holderBreaker) onFailure() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	b.dialing = false
+	if b.state == breakerClosed && b.failures < breakerFailureThreshold {
+		return 0
+	}
+	if 0 == b.backoff {
+		b.backoff = breakerMinBackoff
+	} else {
+		b.backoff *= 2
+		if b.backoff > breakerMaxBackoff {
+			b.backoff = breakerMaxBackoff
+		}
+	}
+	//jitter in [backoff/2, backoff]
+	wait := b.backoff/2 + time.Duration(rand.Int63n(int64(b.backoff/2)+1))
+	b.state = breakerOpen
+	b.retryTime = time.Now().Add(wait)
+	return wait
+}
@@ -0,0 +1,111 @@
+package channel
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+func TestHolderBreaker(t *testing.T) {
+	var b holderBreaker
+	for i := 0; i < breakerFailureThreshold-1; i++ {
+		if nil != b.allow() {
+			t.Fatalf("Closed breaker should allow dial")
+		}
+		if !b.skip() || b.allow() != errHolderDialing {
+			t.Fatalf("Breaker should allow only one dial in flight")
+		}
+		if wait := b.onFailure(); wait > 0 {
+			t.Fatalf("Breaker opened before threshold")
+		}
+	}
+	b.allow()
+	wait := b.onFailure()
+	if wait < breakerMinBackoff/2 || wait > breakerMinBackoff {
+		t.Fatalf("Unexpected backoff:%v", wait)
+	}
+	if b.String() != "open" || !b.skip() || nil == b.allow() {
+		t.Fatalf("Breaker should be open")
+	}
+
+	//backoff expired, only one probe allowed
+	b.retryTime = time.Now().Add(-time.Second)
+	if b.skip() || nil != b.allow() {
+		t.Fatalf("Expired breaker should allow a probe")
+	}
+	if b.String() != "half-open" || !b.skip() || nil == b.allow() {
+		t.Fatalf("Half-open breaker should allow only one probe")
+	}
+	wait = b.onFailure()
+	if wait < breakerMinBackoff || wait > 2*breakerMinBackoff {
+		t.Fatalf("Backoff should be doubled, but got:%v", wait)
+	}
+
+	b.retryTime = time.Now().Add(-time.Second)
+	b.allow()
+	b.onSuccess()
+	if b.String() != "closed" || b.skip() || nil != b.allow() {
+		t.Fatalf("Breaker should be closed after success probe")
+	}
+	if wait = b.onFailure(); wait > 0 {
+		t.Fatalf("Failures should be reset after success")
+	}
+}
+
+// blockedChannel dials a dead server, the dial blocks until released.
+type blockedChannel struct {
+	dialing chan bool
+	release chan bool
+}
+
+func (c *blockedChannel) CreateMuxSession(server string, conf *ProxyChannelConfig) (mux.MuxSession, error) {
+	c.dialing <- true
+	<-c.release
+	return nil, errors.New("dial timeout")
+}
+
+func (c *blockedChannel) Features() FeatureSet {
+	return FeatureSet{}
+}
+
+func TestConcurrentStreamsDuringDial(t *testing.T) {
+	dead := &blockedChannel{dialing: make(chan bool, 1), release: make(chan bool)}
+	ch := newTestChannel(RoundRobinPolicy, 0, 0)
+	ch.sessions[0].Channel = dead
+	ch.sessions[0].conf = &ch.Conf
+	ch.sessions[1].setSession(&streamSession{})
+
+	dialErr := make(chan error)
+	go func() {
+		_, err := ch.sessions[0].getNewStream()
+		dialErr <- err
+	}()
+	<-dead.dialing
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			stream, err := ch.getMuxStream()
+			if nil != err || nil == stream {
+				t.Errorf("Failed to fail over to the healthy session:%v", err)
+			}
+			if cost := time.Now().Sub(start); cost > 100*time.Millisecond {
+				t.Errorf("Caller blocked %v by the dial of the dead server", cost)
+			}
+		}()
+	}
+	wg.Wait()
+	start := time.Now()
+	if _, err := ch.sessions[0].getNewStream(); err != errHolderDialing || time.Now().Sub(start) > 100*time.Millisecond {
+		t.Fatalf("Expected the second dial rejected at once, but got:%v", err)
+	}
+	close(dead.release)
+	if err := <-dialErr; nil == err || ch.sessions[0].stat.recentFailures() != 1 {
+		t.Fatalf("Expected the dial failure counted once, but got:%v", err)
+	}
+}
@@ -3,10 +3,12 @@ package channel
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
@@ -19,6 +21,20 @@ var ErrNotSupportedOperation = errors.New("Not supported operation")
 type ProxyLimitConfig struct {
 	WhiteList []string
 	BlackList []string
+	//rules of resolved destination like '10.0.0.0/8', '1.1.1.1:22' or 'fc00::/7:1-1023', AllowIP overrides the deny rules
+	AllowIP []string
+	DenyIP  []string
+	//deny private, loopback, link-local & unspecified addresses
+	DenyPrivate bool
+
+	compiledIP *ipPolicy
+}
+
+type HopLimitConfig struct {
+	//patterns of next hop url like 'wss://*.herokuapp.com', 'tcp://1.2.3.4:48100' or '*', all hops are denied if empty
+	Allow []string
+	//max number of hops in one connect request, default 3
+	MaxDepth int
 }
 
 func (limit *ProxyLimitConfig) Allowed(host string) bool {
@@ -89,6 +105,23 @@ type CipherConfig struct {
 	User   string
 	Method string
 	Key    string
+	//client only, the user's own key in the users file of the server
+	UserKey string
+	//client only, exchange ephemeral keys in auth for forward secret session keys
+	KeyExchange bool
+	//client only, accept old servers which do not answer the key exchange, the session is not forward secret then
+	AllowNoKex bool
+	//server only, max clock skew in seconds of auth requests, default 120
+	AuthClockSkew int
+	//server only, max number of remembered auth nonces, default 65536
+	AuthReplayCacheSize int
+	//server only, accept auth requests of old clients without MAC, which are replayable
+	AllowLegacyAuth bool
+	//server only, keys accepted after Key in order, for key rotation
+	Keys []CipherKeyConfig
+	//server only, max seconds to receive the auth request since its first bytes
+	//while trying a key which is not the last one of Keys, default 2
+	KeyTrialTimeout int
 
 	allowedUser []string
 }
@@ -134,10 +167,46 @@ func (conf *CipherConfig) VerifyUser(user string) bool {
 	return false
 }
 
+type CipherKeyConfig struct {
+	//name to log, the fingerprint of the key is logged if empty
+	Name string
+	Key  string
+	//optional expire time like '2026-10-25' or '2026-10-25T08:00:00Z'
+	Expire string
+}
+
 type RateLimitConfig struct {
 	Limit map[string]string
 }
 
+type TrafficQuota struct {
+	Daily   string
+	Monthly string
+
+	daily   int64
+	monthly int64
+}
+
+func (q *TrafficQuota) init() {
+	q.daily, q.monthly = parseQuota(q.Daily), parseQuota(q.Monthly)
+}
+
+type TrafficConfig struct {
+	//file to persist the traffic stat of users, the stat is kept in memory only if empty
+	StatFile string
+	//persist period in seconds
+	SavePeriod int
+	//user -> quota of upload & download bytes, "*" matches users without quota
+	Quota map[string]TrafficQuota
+}
+
+func (c *TrafficConfig) init() {
+	for user, q := range c.Quota {
+		q.init()
+		c.Quota[user] = q
+	}
+}
+
 type HTTPBaseConfig struct {
 	HTTPPushRateLimitPerSec int
 	UserAgent               string
@@ -234,6 +303,7 @@ type ProxyChannelConfig struct {
 	Name                   string
 	ServerList             []string
 	ConnsPerServer         int
+	SelectPolicy           string
 	SNI                    []string
 	SNIProxy               string
 	Proxy                  string
@@ -249,13 +319,29 @@ type ProxyChannelConfig struct {
 	HTTP                   HTTPConfig
 	Cipher                 CipherConfig
 	Hops                   HopServers
+	Group                  GroupConfig
 	RemoteSNIProxy         map[string]string
 	HibernateAfterSecs     int
 	P2PToken               string
 	P2S2PEnable            bool
+	//base64 ed25519 public key of the server, the auth response must be signed by it
+	ServerPubKey string
+	//base64 sha256 hashes of the TLS server's SubjectPublicKeyInfo for TLS schemes
+	SPKIPins []string
 
 	proxyURL    *url.URL
 	lazyConnect bool
+	//checks the resolved address to dial the servers
+	dialControl func(network, address string, c syscall.RawConn) error
+}
+
+// CheckDialAddr checks the resolved address to dial the server, for the
+// transports which do not dial by net.Dialer with the Control.
+func (conf *ProxyChannelConfig) CheckDialAddr(network, addr string) error {
+	if nil == conf.dialControl {
+		return nil
+	}
+	return conf.dialControl(network, addr, nil)
 }
 
 func (conf *ProxyChannelConfig) GetRemoteSNI(domain string) string {
@@ -290,6 +376,12 @@ func (conf *ProxyChannelConfig) Adjust() {
 	if conf.ConnsPerServer == 0 {
 		conf.ConnsPerServer = 3
 	}
+	if len(conf.SelectPolicy) == 0 {
+		conf.SelectPolicy = RoundRobinPolicy
+	} else if !IsValidSelectPolicy(conf.SelectPolicy) {
+		logger.Error("Invalid select policy:%s, use '%s' instead.", conf.SelectPolicy, RoundRobinPolicy)
+		conf.SelectPolicy = RoundRobinPolicy
+	}
 	if 0 == conf.RemoteDNSReadMSTimeout {
 		conf.RemoteDNSReadMSTimeout = 1000
 	}
@@ -310,6 +402,19 @@ func (conf *ProxyChannelConfig) Adjust() {
 	}
 }
 
+// Validate rejects the server pins without key exchange, since the session
+// key is the pre-shared key then, a MITM holding it could relay the signed auth
+// response of the real server & decrypt the session.
+func (conf *ProxyChannelConfig) Validate() error {
+	if len(conf.ServerPubKey) == 0 && len(conf.SPKIPins) == 0 {
+		return nil
+	}
+	if !conf.Cipher.KeyExchange || conf.Cipher.AllowNoKex {
+		return fmt.Errorf("'ServerPubKey' & 'SPKIPins' of channel:%s require 'KeyExchange':true without 'AllowNoKex'", conf.Name)
+	}
+	return nil
+}
+
 func (c *ProxyChannelConfig) ProxyURL() *url.URL {
 	if nil != c.proxyURL {
 		return c.proxyURL
@@ -318,7 +423,7 @@ func (c *ProxyChannelConfig) ProxyURL() *url.URL {
 		var err error
 		c.proxyURL, err = url.Parse(c.Proxy)
 		if nil != err {
-			logger.Error("Failed to parse proxy URL ", c.Proxy)
+			logger.Error("Failed to parse proxy URL:%s", c.Proxy)
 		}
 	}
 	return c.proxyURL
@@ -327,18 +432,27 @@ func (c *ProxyChannelConfig) ProxyURL() *url.URL {
 //var DefaultCipherKey string
 var defaultMuxConfig MuxConfig
 var defaultProxyLimitConfig ProxyLimitConfig
+var defaultHopLimitConfig HopLimitConfig
 
 func SetDefaultMuxConfig(cfg MuxConfig) {
 	defaultMuxConfig = cfg
 }
 func SetDefaultProxyLimitConfig(cfg ProxyLimitConfig) {
+	cfg.compile()
 	defaultProxyLimitConfig = cfg
 }
+func SetDefaultHopLimitConfig(cfg HopLimitConfig) {
+	defaultHopLimitConfig = cfg
+}
 
 func InitialPMuxConfig(cipher *CipherConfig) *pmux.Config {
+	return initialPMuxConfigWithKey(cipher.Key)
+}
+
+func initialPMuxConfigWithKey(key string) *pmux.Config {
 	//cfg := pmux.DefaultConfig()
 	cfg := defaultMuxConfig.ToPMuxConf()
-	cfg.CipherKey = []byte(cipher.Key)
+	cfg.CipherKey = []byte(key)
 	cfg.CipherMethod = mux.DefaultMuxCipherMethod
 	cfg.CipherInitialCounter = mux.DefaultMuxInitialCipherCounter
 	//cfg.EnableKeepAlive = false
@@ -0,0 +1,228 @@
+package channel
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+var privateNetworks = []string{ //private, loopback, link-local & unspecified networks denied by 'DenyPrivate'
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+type ipRule struct {
+	network  *net.IPNet
+	minPort  int
+	maxPort  int
+	anyPorts bool
+}
+
+func (r *ipRule) match(ip net.IP, port int) bool {
+	if !r.network.Contains(ip) {
+		return false
+	}
+	return r.anyPorts || (port >= r.minPort && port <= r.maxPort)
+}
+
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	if nil != err {
+		return 0, 0, err
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(parts[1]); nil != err {
+			return 0, 0, err
+		}
+	}
+	if min < 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range:%s", s)
+	}
+	return min, max, nil
+}
+
+// parseIPRule parses rule like '10.0.0.0/8', '10.0.0.0/8:22', '1.1.1.1:1-1023',
+// '::1', '[::1]:22' or 'fc00::/7:80'.
+func parseIPRule(s string) (*ipRule, error) {
+	rule := &ipRule{anyPorts: true}
+	addr, ports := s, ""
+	if idx := strings.Index(s, "/"); idx > 0 {
+		if pidx := strings.Index(s[idx:], ":"); pidx > 0 {
+			addr, ports = s[0:idx+pidx], s[idx+pidx+1:]
+		}
+	} else if nil == net.ParseIP(s) {
+		host, port, err := net.SplitHostPort(s)
+		if nil != err {
+			return nil, err
+		}
+		addr, ports = host, port
+	}
+	if !strings.Contains(addr, "/") {
+		ip := net.ParseIP(addr)
+		if nil == ip {
+			return nil, fmt.Errorf("invalid ip:%s", addr)
+		}
+		bits := 128
+		if nil != ip.To4() {
+			ip, bits = ip.To4(), 32
+		}
+		addr = fmt.Sprintf("%s/%d", ip, bits)
+	}
+	_, network, err := net.ParseCIDR(addr)
+	if nil != err {
+		return nil, err
+	}
+	rule.network = network
+	if len(ports) > 0 {
+		rule.anyPorts = false
+		if rule.minPort, rule.maxPort, err = parsePortRange(ports); nil != err {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+func parseIPRules(rules []string) []*ipRule {
+	var parsed []*ipRule
+	for _, s := range rules {
+		rule, err := parseIPRule(strings.TrimSpace(s))
+		if nil != err {
+			logger.Error("[ERROR]Invalid ip rule:%s for reason:%v", s, err)
+			continue
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed
+}
+
+type ipPolicy struct {
+	allow []*ipRule
+	deny  []*ipRule
+}
+
+func newIPPolicy(limit *ProxyLimitConfig) *ipPolicy {
+	p := &ipPolicy{
+		allow: parseIPRules(limit.AllowIP),
+		deny:  parseIPRules(limit.DenyIP),
+	}
+	if limit.DenyPrivate {
+		p.deny = append(p.deny, parseIPRules(privateNetworks)...)
+	}
+	return p
+}
+
+func (p *ipPolicy) allowed(ip net.IP, port int) bool {
+	for _, rule := range p.allow {
+		if rule.match(ip, port) {
+			return true
+		}
+	}
+	for _, rule := range p.deny {
+		if rule.match(ip, port) {
+			return false
+		}
+	}
+	return true
+}
+
+func (limit *ProxyLimitConfig) hasIPPolicy() bool {
+	return limit.DenyPrivate || len(limit.DenyIP) > 0
+}
+
+// compile parses the ip rules once, it should be called before the config is
+// shared.
+func (limit *ProxyLimitConfig) compile() {
+	if limit.hasIPPolicy() {
+		limit.compiledIP = newIPPolicy(limit)
+	}
+}
+
+// AllowedIP checks the resolved destination by the ip rules.
+func (limit *ProxyLimitConfig) AllowedIP(ip net.IP, port int) bool {
+	if !limit.hasIPPolicy() {
+		return true
+	}
+	p := limit.compiledIP
+	if nil == p {
+		p = newIPPolicy(limit)
+	}
+	return p.allowed(ip, port)
+}
+
+func isDestinationAllowed(user string, ip net.IP, port int) bool {
+	if !defaultProxyLimitConfig.AllowedIP(ip, port) {
+		return false
+	}
+	if u := getServerUser(user); nil != u {
+		return u.ProxyLimit.AllowedIP(ip, port)
+	}
+	return true
+}
+
+func destinationNotAllowed(addr string) error {
+	return &mux.ConnectError{Class: mux.ConnectErrNotAllowed, Reason: fmt.Sprintf("destination %s is not allowed", addr)}
+}
+
+// destinationControl checks the address to connect after DNS resolution,
+// which is used as the Control of net.Dialer.
+func destinationControl(user string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, portStr, err := net.SplitHostPort(address)
+		if nil != err {
+			return err
+		}
+		port, _ := strconv.Atoi(portStr)
+		ip := net.ParseIP(host)
+		if nil == ip || !isDestinationAllowed(user, ip, port) {
+			logger.Error("[ERROR]Destination %s is NOT allowed for user:%s", address, user)
+			return destinationNotAllowed(address)
+		}
+		return nil
+	}
+}
+
+// checkDestinationHost checks all resolved addresses of the host.
+func checkDestinationHost(user string, host string, port int) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if nil == ips[0] {
+		var err error
+		if ips, err = net.LookupIP(host); nil != err {
+			return err
+		}
+	}
+	for _, ip := range ips {
+		if !isDestinationAllowed(user, ip, port) {
+			logger.Error("[ERROR]Destination %s(%s) is NOT allowed for user:%s", host, ip, user)
+			return destinationNotAllowed(net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	return nil
+}
+
+func hopURLPort(u *url.URL) int {
+	if port, err := strconv.Atoi(u.Port()); nil == err {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "ws":
+		return 80
+	}
+	return 443
+}
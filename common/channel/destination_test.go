@@ -0,0 +1,159 @@
+package channel
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+func TestParseIPRule(t *testing.T) {
+	tests := []struct {
+		rule  string
+		ip    string
+		port  int
+		match bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3", 80, true},
+		{"10.0.0.0/8", "11.1.2.3", 80, false},
+		{"10.0.0.0/8:22", "10.1.2.3", 22, true},
+		{"10.0.0.0/8:22", "10.1.2.3", 80, false},
+		{"1.1.1.1:1-1023", "1.1.1.1", 443, true},
+		{"1.1.1.1:1-1023", "1.1.1.1", 8080, false},
+		{"::1", "::1", 80, true},
+		{"[::1]:22", "::1", 22, true},
+		{"[::1]:22", "::1", 23, false},
+		{"fc00::/7:80", "fd00::1", 80, true},
+		{"fc00::/7:80", "fd00::1", 443, false},
+		{"127.0.0.1", "::ffff:127.0.0.1", 80, true},
+	}
+	for _, test := range tests {
+		rule, err := parseIPRule(test.rule)
+		if nil != err {
+			t.Fatalf("Failed to parse rule:%s for reason:%v", test.rule, err)
+		}
+		if rule.match(net.ParseIP(test.ip), test.port) != test.match {
+			t.Fatalf("Rule:%s match %s:%d expected %v", test.rule, test.ip, test.port, test.match)
+		}
+	}
+	for _, s := range []string{"", "abc", "10.0.0.0/33", "1.1.1.1:80-22", "1.1.1.1:70000"} {
+		if _, err := parseIPRule(s); nil == err {
+			t.Fatalf("Invalid rule:%s should be rejected", s)
+		}
+	}
+}
+
+func TestProxyLimitAllowedIP(t *testing.T) {
+	limit := ProxyLimitConfig{
+		DenyPrivate: true,
+		AllowIP:     []string{"10.1.0.0/16:443"},
+		DenyIP:      []string{"8.8.8.8"},
+	}
+	limit.compile()
+	tests := []struct {
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{"127.0.0.1", 80, false},
+		{"169.254.169.254", 80, false},
+		{"192.168.1.1", 80, false},
+		{"fe80::1", 80, false},
+		{"::1", 80, false},
+		{"10.1.2.3", 443, true},
+		{"10.1.2.3", 80, false},
+		{"8.8.8.8", 53, false},
+		{"1.1.1.1", 443, true},
+	}
+	for _, test := range tests {
+		if limit.AllowedIP(net.ParseIP(test.ip), test.port) != test.allowed {
+			t.Fatalf("%s:%d allowed expected %v", test.ip, test.port, test.allowed)
+		}
+	}
+	if empty := (ProxyLimitConfig{}); !empty.AllowedIP(net.ParseIP("127.0.0.1"), 80) {
+		t.Fatalf("Empty limit should allow all")
+	}
+}
+
+func TestDestinationControl(t *testing.T) {
+	defer SetDefaultProxyLimitConfig(ProxyLimitConfig{})
+	SetDefaultProxyLimitConfig(ProxyLimitConfig{DenyPrivate: true})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialer := &net.Dialer{Control: destinationControl("abc")}
+	_, err = dialer.Dial("tcp", ln.Addr().String())
+	if nil == err {
+		t.Fatalf("Dial to loopback should be denied")
+	}
+	if class := mux.ConnectErrorClass(err); class != mux.ConnectErrNotAllowed {
+		t.Fatalf("Unexpected error class:%s for %v", class, err)
+	}
+	if err = checkDestinationHost("abc", "localhost", 80); nil == err {
+		t.Fatalf("Hop to localhost should be denied")
+	}
+	//the hop server is checked by its address to dial
+	conf := &ProxyChannelConfig{dialControl: destinationControl("abc")}
+	if _, err = DialServerByConf("tcp://"+ln.Addr().String(), conf); mux.ConnectErrorClass(err) != mux.ConnectErrNotAllowed {
+		t.Fatalf("Dial hop server at loopback should be denied, err:%v", err)
+	}
+	if err = conf.CheckDialAddr("udp", "127.0.0.1:48100"); nil == err {
+		t.Fatalf("Hop server at loopback should be denied")
+	}
+	if err = conf.CheckDialAddr("udp", "1.1.1.1:48100"); nil != err {
+		t.Fatalf("Unexpected error:%v", err)
+	}
+
+	u, _ := url.Parse("ws://example.com/ws")
+	if port := hopURLPort(u); port != 80 {
+		t.Fatalf("Unexpected port:%d", port)
+	}
+	u, _ = url.Parse("tcp://example.com:48100")
+	if port := hopURLPort(u); port != 48100 {
+		t.Fatalf("Unexpected port:%d", port)
+	}
+}
+
+func TestHopChannelPerUser(t *testing.T) {
+	alice := &ServerUser{ProxyLimit: ProxyLimitConfig{DenyIP: []string{"10.0.0.0/8"}}}
+	alice.ProxyLimit.compile()
+	defer serverUsers.Store(map[string]*ServerUser(nil))
+	serverUsers.Store(map[string]*ServerUser{"alice": alice, "bob": {}})
+
+	u, _ := url.Parse("tcp://hop.example.com:48100")
+	aliceConf := hopChannelConf(u, "alice", &CipherConfig{})
+	bobConf := hopChannelConf(u, "bob", &CipherConfig{})
+	if aliceConf.Name == bobConf.Name || aliceConf.Cipher.User != "alice" || bobConf.Cipher.User != "bob" {
+		t.Fatalf("Unexpected hop channels:%s & %s", aliceConf.Name, bobConf.Name)
+	}
+	//the resolved hop server address is checked by the limit of each user
+	if err := aliceConf.CheckDialAddr("tcp", "10.1.2.3:48100"); mux.ConnectErrorClass(err) != mux.ConnectErrNotAllowed {
+		t.Fatalf("Hop server denied by alice's limit should be denied, err:%v", err)
+	}
+	if err := bobConf.CheckDialAddr("tcp", "10.1.2.3:48100"); nil != err {
+		t.Fatalf("Unexpected error:%v", err)
+	}
+
+	ch := NewProxyChannel(aliceConf)
+	holder := &muxSessionHolder{conf: &ch.Conf, server: u.String()}
+	holder.setSession(&streamSession{})
+	ch.sessions = append(ch.sessions, holder)
+	localChannelMutex.Lock()
+	localChannelTable[aliceConf.Name] = ch
+	localChannelMutex.Unlock()
+	defer func() {
+		localChannelMutex.Lock()
+		delete(localChannelTable, aliceConf.Name)
+		localChannelMutex.Unlock()
+	}()
+	if stream, conf, err := GetMuxStreamByURL(u, "alice", &CipherConfig{}); nil != err || nil == stream || conf.Name != aliceConf.Name {
+		t.Fatalf("Expected the channel of alice reused, err:%v", err)
+	}
+	//the 'tcp' channel is not registered in the test, so a new channel fails
+	if stream, _, err := GetMuxStreamByURL(u, "bob", &CipherConfig{}); nil == err || nil != stream {
+		t.Fatalf("The channel of alice should NOT be used by bob")
+	}
+}
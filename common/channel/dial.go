@@ -24,6 +24,10 @@ func NewTLSConfig(conf *ProxyChannelConfig) *tls.Config {
 	if len(conf.SNI) > 0 {
 		tlscfg.ServerName = conf.SNI[0]
 	}
+	if len(conf.SPKIPins) > 0 {
+		//the certificate may be self-signed, the pins are the only check
+		tlscfg.VerifyPeerCertificate = verifySPKIPins(conf.SPKIPins)
+	}
 	return tlscfg
 }
 
@@ -93,6 +97,9 @@ func DialServerByConf(server string, conf *ProxyChannelConfig) (net.Conn, error)
 				DialTimeout: timeout,
 			}
 			conn, err = protector.DialContextOptions(context.Background(), "tcp", hostport, opt)
+		} else if nil != conf.dialControl {
+			dialer := &net.Dialer{Timeout: timeout, Control: conf.dialControl}
+			conn, err = dialer.Dial("tcp", hostport)
 		} else {
 			conn, err = netx.DialTimeout("tcp", hostport, timeout)
 		}
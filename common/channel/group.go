@@ -0,0 +1,126 @@
+package channel
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+const FallbackPolicy = "fallback"
+
+// GroupConfig turns a channel into a group of other channels, streams of a
+// group channel are created by its members.
+type GroupConfig struct {
+	Members []string
+	//fallback or weighted
+	Policy  string
+	Weights map[string]int
+}
+
+func (g *GroupConfig) Adjust() {
+	switch g.Policy {
+	case FallbackPolicy:
+	case WeightedPolicy:
+	case "":
+		g.Policy = FallbackPolicy
+	default:
+		logger.Error("Invalid group policy:%s, use '%s' instead.", g.Policy, FallbackPolicy)
+		g.Policy = FallbackPolicy
+	}
+}
+
+func (g *GroupConfig) weight(member string) int {
+	if nil != g.Weights {
+		if w, exist := g.Weights[member]; exist {
+			return w
+		}
+	}
+	return 1
+}
+
+func (g *GroupConfig) orderedMembers() []string {
+	members := make([]string, 0, len(g.Members))
+	if g.Policy != WeightedPolicy {
+		return append(members, g.Members...)
+	}
+	keys := make(map[string]float64, len(g.Members))
+	for _, member := range g.Members {
+		w := g.weight(member)
+		if w <= 0 {
+			continue
+		}
+		keys[member] = -math.Log(1-rand.Float64()) / float64(w)
+		members = append(members, member)
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return keys[members[i]] < keys[members[j]]
+	})
+	return members
+}
+
+var channelGroupTable = make(map[string]*ProxyChannelConfig)
+
+func (conf *ProxyChannelConfig) IsGroup() bool {
+	return len(conf.Group.Members) > 0
+}
+
+func InitChannelGroup(conf *ProxyChannelConfig) {
+	localChannelMutex.Lock()
+	defer localChannelMutex.Unlock()
+	conf.Group.Adjust()
+	channelGroupTable[conf.Name] = conf
+	logger.Notice("Proxy channel group:%s init with members:%v by policy:%s", conf.Name, conf.Group.Members, conf.Group.Policy)
+}
+
+func expandChannelCandidates(name string, visited map[string]bool, candidates []string) []string {
+	if visited[name] {
+		return candidates
+	}
+	visited[name] = true
+	group, exist := channelGroupTable[name]
+	if !exist {
+		return append(candidates, name)
+	}
+	for _, member := range group.Group.orderedMembers() {
+		candidates = expandChannelCandidates(member, visited, candidates)
+	}
+	return candidates
+}
+
+// GetChannelCandidates returns the channels to try in order for a new stream by
+// the named channel, it's the channel itself unless it's a channel group.
+func GetChannelCandidates(name string) []string {
+	return expandChannelCandidates(name, make(map[string]bool), nil)
+}
+
+func getMuxStreamByGroup(name string) (mux.MuxStream, *ProxyChannelConfig, error) {
+	var lastErr error
+	for _, member := range GetChannelCandidates(name) {
+		pch, exist := localChannelTable[member]
+		if !exist {
+			lastErr = fmt.Errorf("No proxy channel:%s found in group:%s", member, name)
+			continue
+		}
+		stream, err := pch.getMuxStream()
+		if nil == err {
+			return stream, &pch.Conf, nil
+		}
+		logger.Debug("Try next member of group:%s since channel:%s failed with err:%v", name, member, err)
+		lastErr = err
+	}
+	if nil == lastErr {
+		lastErr = fmt.Errorf("Empty channel group:%s", name)
+	}
+	return nil, nil, lastErr
+}
+
+func dumpChannelGroupStat(w io.Writer) {
+	for name, conf := range channelGroupTable {
+		fmt.Fprintf(w, "Group:%s, Policy:%s, Members:%v\n", name, conf.Group.Policy, conf.Group.Members)
+	}
+}
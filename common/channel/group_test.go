@@ -0,0 +1,33 @@
+package channel
+
+import "testing"
+
+func TestChannelGroupCandidates(t *testing.T) {
+	defer func() {
+		channelGroupTable = make(map[string]*ProxyChannelConfig)
+	}()
+	InitChannelGroup(&ProxyChannelConfig{Name: "g1", Group: GroupConfig{Members: []string{"a", "g2", "b"}}})
+	InitChannelGroup(&ProxyChannelConfig{Name: "g2", Group: GroupConfig{Members: []string{"c", "g1", "a"}}})
+	candidates := GetChannelCandidates("g1")
+	if len(candidates) != 3 || candidates[0] != "a" || candidates[1] != "c" || candidates[2] != "b" {
+		t.Fatalf("Unexpected candidates:%v", candidates)
+	}
+	if candidates = GetChannelCandidates("direct"); len(candidates) != 1 || candidates[0] != "direct" {
+		t.Fatalf("Unexpected candidates:%v", candidates)
+	}
+}
+
+func TestWeightedGroupMembers(t *testing.T) {
+	g := GroupConfig{Members: []string{"a", "b", "c"}, Policy: WeightedPolicy, Weights: map[string]int{"a": 9, "c": 0}}
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		members := g.orderedMembers()
+		if len(members) != 2 {
+			t.Fatalf("Zero weight member should be excluded:%v", members)
+		}
+		first[members[0]]++
+	}
+	if first["a"] < first["b"]*4 {
+		t.Fatalf("Weighted group prefer light member:%v", first)
+	}
+}
@@ -0,0 +1,74 @@
+package channel
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+const defaultMaxHopDepth = 3
+
+func (limit *HopLimitConfig) maxDepth() int {
+	if limit.MaxDepth <= 0 {
+		return defaultMaxHopDepth
+	}
+	return limit.MaxDepth
+}
+
+// allowedURL matches the patterns with both 'scheme://host' & 'scheme://host:port'
+// of the hop url.
+func (limit *HopLimitConfig) allowedURL(u *url.URL) bool {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	hostport := net.JoinHostPort(host, strconv.Itoa(hopURLPort(u)))
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	candidates := []string{scheme + "://" + host, scheme + "://" + hostport}
+	for _, rule := range limit.Allow {
+		if rule == "*" {
+			return true
+		}
+		rule = strings.ToLower(rule)
+		for _, s := range candidates {
+			if matched, _ := filepath.Match(rule, s); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hopNotAllowed(format string, args ...interface{}) error {
+	return &mux.ConnectError{Class: mux.ConnectErrNotAllowed, Reason: fmt.Sprintf(format, args...)}
+}
+
+// checkHops checks the hops of a connect request by the hop limit config,
+// returns the parsed url of the next hop if it's allowed.
+func checkHops(user string, hops []string) (*url.URL, error) {
+	limit := &defaultHopLimitConfig
+	if len(hops) > limit.maxDepth() {
+		logger.Error("[ERROR]%d hops exceed max depth:%d for user:%s", len(hops), limit.maxDepth(), user)
+		return nil, hopNotAllowed("%d hops exceed max hop depth:%d", len(hops), limit.maxDepth())
+	}
+	if !isServerUserHopAllowed(user) {
+		logger.Error("[ERROR]User:%s is NOT allowed to use hops", user)
+		return nil, hopNotAllowed("hop is not allowed for user:%s", user)
+	}
+	u, err := url.Parse(hops[0])
+	if nil != err {
+		logger.Error("[ERROR]Failed to parse hop url:%s with reason:%v", hops[0], err)
+		return nil, hopNotAllowed("invalid hop url:%s", hops[0])
+	}
+	if !limit.allowedURL(u) {
+		logger.Error("[ERROR]Hop:%s is NOT allowed for user:%s", hops[0], user)
+		return nil, hopNotAllowed("hop %s://%s is not allowed", u.Scheme, u.Host)
+	}
+	return u, nil
+}
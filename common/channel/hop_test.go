@@ -0,0 +1,59 @@
+package channel
+
+import (
+	"testing"
+
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+func TestCheckHops(t *testing.T) {
+	defer SetDefaultHopLimitConfig(HopLimitConfig{})
+	hops := []string{"wss://app2.herokuapp.com/ws"}
+	if _, err := checkHops("abc", hops); nil == err {
+		t.Fatalf("Hop should be denied by default")
+	}
+
+	SetDefaultHopLimitConfig(HopLimitConfig{
+		Allow:    []string{"wss://*.herokuapp.com", "tcp://1.2.3.4:48100"},
+		MaxDepth: 2,
+	})
+	defer serverUsers.Store(map[string]*ServerUser(nil))
+	serverUsers.Store(map[string]*ServerUser{"abc": {}, "def": {DisableHop: true}})
+	tests := []struct {
+		user    string
+		hops    []string
+		allowed bool
+	}{
+		{"abc", []string{"wss://app2.herokuapp.com/ws"}, true},
+		{"abc", []string{"WSS://APP2.herokuapp.com:443/ws"}, true},
+		{"abc", []string{"ws://app2.herokuapp.com/ws"}, false},
+		{"abc", []string{"tcp://1.2.3.4:48100"}, true},
+		{"abc", []string{"tcp://1.2.3.4:48101"}, false},
+		{"abc", []string{"tcp://127.0.0.1:48100"}, false},
+		{"def", []string{"wss://app2.herokuapp.com/ws"}, false},
+		{"abc", []string{"tcp://1.2.3.4:48100", "wss://app2.herokuapp.com"}, true},
+		{"abc", []string{"tcp://1.2.3.4:48100", "wss://a.herokuapp.com", "wss://b.herokuapp.com"}, false},
+	}
+	for _, test := range tests {
+		u, err := checkHops(test.user, test.hops)
+		if (nil == err) != test.allowed {
+			t.Fatalf("Hops:%v for user:%s allowed expected %v, err:%v", test.hops, test.user, test.allowed, err)
+		}
+		if nil != err && mux.ConnectErrorClass(err) != mux.ConnectErrNotAllowed {
+			t.Fatalf("Unexpected error class for %v", err)
+		}
+		if nil == err && nil == u {
+			t.Fatalf("Missing next hop url")
+		}
+	}
+
+	SetDefaultHopLimitConfig(HopLimitConfig{Allow: []string{"*"}})
+	if _, err := checkHops("abc", []string{"quic://example.com:48100"}); nil != err {
+		t.Fatalf("Hop should be allowed by '*', err:%v", err)
+	}
+	//all users are allowed without users file
+	serverUsers.Store(map[string]*ServerUser(nil))
+	if _, err := checkHops("def", []string{"quic://example.com:48100"}); nil != err {
+		t.Fatalf("Hop should be allowed without users file, err:%v", err)
+	}
+}
@@ -14,7 +14,6 @@ import (
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
 )
 
 type httpDuplexServConn struct {
@@ -249,13 +248,12 @@ func HTTPInvoke(w http.ResponseWriter, r *http.Request) {
 			logger.Error("###ERR1 : %s", r.Header.Get(mux.HTTPMuxSessionACKIDHeader))
 			return
 		}
-		session, err := pmux.Server(c, channel.InitialPMuxConfig(&channel.DefaultServerCipher))
+		muxSession, err := channel.NewServerMuxSession(c, nil)
 		if nil != err {
 			return
 		}
-		muxSession := &mux.ProxyMuxSession{Session: session}
 		go func() {
-			err := channel.ServProxyMuxSession(muxSession, nil, nil)
+			err := channel.ServProxyMuxSession(muxSession, nil, nil, "http")
 			if nil != err {
 				c.shutdown(err)
 			}
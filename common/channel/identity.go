@@ -0,0 +1,110 @@
+package channel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+var ErrServerIdentityMismatch = errors.New("server identity mismatch")
+
+var serverSigningKey ed25519.PrivateKey
+
+func loadOrCreateSigningKey(file string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if nil == err {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if nil != err || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid signing key in %s", file)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if nil != err {
+		return nil, err
+	}
+	content := base64.StdEncoding.EncodeToString(key.Seed()) + "\n"
+	if err = ioutil.WriteFile(file, []byte(content), 0600); nil != err {
+		return nil, err
+	}
+	logger.Notice("Generate server signing key into %s", file)
+	return key, nil
+}
+
+// InitServerSigningKey loads the server's long-term signing key from the file,
+// a new key is generated into the file if it does not exist.
+func InitServerSigningKey(file string) error {
+	if len(file) == 0 {
+		return nil
+	}
+	key, err := loadOrCreateSigningKey(file)
+	if nil != err {
+		return err
+	}
+	serverSigningKey = key
+	pub := key.Public().(ed25519.PublicKey)
+	logger.Notice("Server public key for clients to pin:%s", base64.StdEncoding.EncodeToString(pub))
+	return nil
+}
+
+// verifyServerIdentity checks the signature of the auth response if the
+// client pins the server's public key.
+func verifyServerIdentity(conf *ProxyChannelConfig, req *mux.AuthRequest, res *mux.AuthResponse) error {
+	if len(conf.ServerPubKey) == 0 {
+		return nil
+	}
+	pub, err := base64.StdEncoding.DecodeString(conf.ServerPubKey)
+	if nil != err || len(pub) != ed25519.PublicKeySize {
+		logger.Error("[ERROR]Invalid ServerPubKey:%s of channel:%s", conf.ServerPubKey, conf.Name)
+		return ErrServerIdentityMismatch
+	}
+	//the signature binds the exchanged keys, which the session key is derived from
+	if len(req.KexPub) > 0 && len(res.KexPub) == 0 {
+		logger.Error("[ERROR]Server of channel:%s does not answer the key exchange", conf.Name)
+		return ErrServerIdentityMismatch
+	}
+	if !res.VerifySignature(req, ed25519.PublicKey(pub)) {
+		logger.Error("[ERROR]Server of channel:%s is not signed by the pinned key", conf.Name)
+		return ErrServerIdentityMismatch
+	}
+	return nil
+}
+
+// SPKIPin returns the base64 sha256 hash of the certificate's public key.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func verifySPKIPins(pins []string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrServerIdentityMismatch
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if nil != err {
+			return err
+		}
+		pin := SPKIPin(cert)
+		for _, p := range pins {
+			if p == pin {
+				return nil
+			}
+		}
+		logger.Error("[ERROR]TLS server public key pin:%s is not pinned", pin)
+		return ErrServerIdentityMismatch
+	}
+}
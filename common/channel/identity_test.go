@@ -0,0 +1,123 @@
+package channel
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+func TestServerIdentity(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sign.key")
+	key, err := loadOrCreateSigningKey(file)
+	if nil != err {
+		t.Fatal(err)
+	}
+	loaded, err := loadOrCreateSigningKey(file)
+	if nil != err || !key.Equal(loaded) {
+		t.Fatalf("Signing key should be persisted, err:%v", err)
+	}
+	pub := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	req := &mux.AuthRequest{User: "abc"}
+	req.Sign("k")
+	res := &mux.AuthResponse{Code: mux.AuthOK, PubAddr: "1.1.1.1:1"}
+	res.Sign(req, key)
+
+	conf := &ProxyChannelConfig{}
+	if nil != verifyServerIdentity(conf, req, &mux.AuthResponse{}) {
+		t.Fatalf("Server without pinned key should be accepted")
+	}
+	conf.ServerPubKey = pub
+	if nil != verifyServerIdentity(conf, req, res) {
+		t.Fatalf("Signed response should be accepted")
+	}
+	res.PubAddr = "2.2.2.2:2"
+	if nil == verifyServerIdentity(conf, req, res) {
+		t.Fatalf("Tampered response should be rejected")
+	}
+	res.PubAddr = "1.1.1.1:1"
+	other := &mux.AuthRequest{User: "abc"}
+	other.Sign("k")
+	if nil == verifyServerIdentity(conf, other, res) {
+		t.Fatalf("Response to another request should be rejected")
+	}
+	if nil == verifyServerIdentity(conf, req, &mux.AuthResponse{Code: mux.AuthOK, PubAddr: "1.1.1.1:1"}) {
+		t.Fatalf("Unsigned response should be rejected")
+	}
+}
+
+func TestServerIdentityAgainstMITM(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(nil)
+	_, mitmKey, _ := ed25519.GenerateKey(nil)
+	conf := &ProxyChannelConfig{Name: "test", ServerPubKey: base64.StdEncoding.EncodeToString(serverKey.Public().(ed25519.PublicKey))}
+	if nil == conf.Validate() {
+		t.Fatalf("Pinned key without key exchange should be rejected")
+	}
+	conf.Cipher.KeyExchange, conf.Cipher.AllowNoKex = true, true
+	if nil == conf.Validate() {
+		t.Fatalf("Pinned key with AllowNoKex should be rejected")
+	}
+	conf.Cipher.AllowNoKex = false
+	if nil != conf.Validate() {
+		t.Fatalf("Pinned key with key exchange should be accepted")
+	}
+
+	client, _ := mux.NewKeyExchange()
+	req := &mux.AuthRequest{User: "abc", KexPub: client.Public}
+	req.Sign("psk")
+	//the MITM holds the pre-shared key, but not the identity key of the server
+	mitm, _ := mux.NewKeyExchange()
+	res := &mux.AuthResponse{Code: mux.AuthOK, KexPub: mitm.Public, KexMAC: mux.KexMAC("psk", client.Public, mitm.Public)}
+	res.Sign(req, mitmKey)
+	if _, err := clientExchangedKey(&conf.Cipher, "psk", client, res); nil != err {
+		t.Fatalf("The MITM holding the pre-shared key should pass the key exchange MAC")
+	}
+	if verifyServerIdentity(conf, req, res) != ErrServerIdentityMismatch {
+		t.Fatalf("Response of the MITM should be rejected")
+	}
+	//the MITM replaces the exchanged key of the response signed by the server
+	server, _ := mux.NewKeyExchange()
+	res = &mux.AuthResponse{Code: mux.AuthOK, KexPub: server.Public, KexMAC: mux.KexMAC("psk", client.Public, server.Public)}
+	res.Sign(req, serverKey)
+	tampered := *res
+	tampered.KexPub, tampered.KexMAC = mitm.Public, mux.KexMAC("psk", client.Public, mitm.Public)
+	if verifyServerIdentity(conf, req, &tampered) != ErrServerIdentityMismatch {
+		t.Fatalf("Response with replaced exchanged key should be rejected")
+	}
+	//the MITM relays the response signed by the server, but can not derive the session key
+	if nil != verifyServerIdentity(conf, req, res) {
+		t.Fatalf("Response of the server should be accepted")
+	}
+	sessionKey, err := clientExchangedKey(&conf.Cipher, "psk", client, res)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if mitmSessionKey, _ := mitm.ServerKey("psk", client.Public); bytes.Equal(sessionKey, mitmSessionKey) {
+		t.Fatalf("The MITM should not derive the session key")
+	}
+	//the MITM drops the key exchange to downgrade the session to the pre-shared key
+	res = &mux.AuthResponse{Code: mux.AuthOK}
+	res.Sign(req, serverKey)
+	if verifyServerIdentity(conf, req, res) != ErrServerIdentityMismatch {
+		t.Fatalf("Response without key exchange should be rejected")
+	}
+}
+
+func TestSPKIPins(t *testing.T) {
+	raw := helper.GenerateTLSConfig().Certificates[0].Certificate[0]
+	cert, err := x509.ParseCertificate(raw)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if nil != verifySPKIPins([]string{"x", SPKIPin(cert)})([][]byte{raw}, nil) {
+		t.Fatalf("Pinned cert should be accepted")
+	}
+	if nil == verifySPKIPins([]string{"x"})([][]byte{raw}, nil) {
+		t.Fatalf("Cert not pinned should be rejected")
+	}
+}
@@ -53,6 +53,9 @@ func (tc *KCPProxy) CreateMuxSession(server string, conf *channel.ProxyChannelCo
 		}
 		hostport = net.JoinHostPort(iphost, tcpPort)
 	}
+	if err = conf.CheckDialAddr("udp", hostport); nil != err {
+		return nil, err
+	}
 	block, _ := kcp.NewNoneBlockCrypt(nil)
 
 	udpaddr, err := net.ResolveUDPAddr("udp", hostport)
@@ -85,12 +88,13 @@ func (tc *KCPProxy) CreateMuxSession(server string, conf *channel.ProxyChannelCo
 	if err := kcpconn.SetWriteBuffer(conf.KCP.SockBuf); err != nil {
 		logger.Notice("SetWriteBuffer:%v", err)
 	}
-	session, err := pmux.Client(kcpconn, channel.InitialPMuxConfig(&conf.Cipher))
+	cfg := channel.InitialPMuxConfig(&conf.Cipher)
+	session, err := pmux.Client(kcpconn, cfg)
 	if nil != err {
 		return nil, err
 	}
 	logger.Debug("Connect %s success.", server)
-	return &mux.ProxyMuxSession{Session: session}, nil
+	return &mux.ProxyMuxSession{Session: session, Config: cfg}, nil
 }
 
 func init() {
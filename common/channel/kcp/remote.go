@@ -4,8 +4,6 @@ import (
 	kcp "github.com/xtaci/kcp-go"
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/logger"
-	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
 )
 
 func StartKCPProxyServer(addr string, config *channel.KCPConfig) error {
@@ -44,13 +42,12 @@ func servKCP(lp *kcp.Listener, config *channel.KCPConfig) {
 		conn.SetMtu(config.MTU)
 		conn.SetWindowSize(config.SndWnd, config.RcvWnd)
 		conn.SetACKNoDelay(config.AckNodelay)
-		session, err := pmux.Server(conn, channel.InitialPMuxConfig(&channel.DefaultServerCipher))
+		muxSession, err := channel.NewServerMuxSession(conn, conn)
 		if nil != err {
 			logger.Error("[ERROR]Failed to create mux session for tcp server with reason:%v", err)
 			continue
 		}
-		muxSession := &mux.ProxyMuxSession{Session: session}
-		go channel.ServProxyMuxSession(muxSession, nil, nil)
+		go channel.ServProxyMuxSession(muxSession, nil, nil, "kcp")
 	}
 	//ws.WriteMessage(websocket.CloseMessage, []byte{})
 }
@@ -0,0 +1,253 @@
+package channel
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+	"github.com/yinqiwen/pmux"
+)
+
+const defaultKeyTrialTimeout = 2 //max seconds to wait the auth request with a key which is not the last one
+
+// keyTrialConn records the bytes read from the conn, so that the server mux
+// session could be recreated over the same bytes with the next accepted key
+// if the current key can not decrypt the auth request.
+type keyTrialConn struct {
+	conn      io.ReadWriteCloser
+	readMutex sync.Mutex
+	readBuf   []byte
+	mutex     sync.Mutex
+	buf       []byte
+	//offset of buf[0] in the stream read from conn
+	base      int
+	recording bool
+}
+
+func (t *keyTrialConn) readAt(v *keyTrialView, p []byte) (int, error) {
+	for {
+		t.mutex.Lock()
+		if atomic.LoadInt32(&v.dead) == 1 {
+			t.mutex.Unlock()
+			return 0, io.EOF
+		}
+		if v.pos < t.base+len(t.buf) {
+			n := copy(p, t.buf[v.pos-t.base:])
+			v.pos += n
+			if !t.recording {
+				//only the accepted view reads now
+				t.buf = t.buf[v.pos-t.base:]
+				t.base = v.pos
+			}
+			t.mutex.Unlock()
+			return n, nil
+		}
+		t.mutex.Unlock()
+
+		t.readMutex.Lock()
+		t.mutex.Lock()
+		buffered := v.pos < t.base+len(t.buf)
+		t.mutex.Unlock()
+		if buffered {
+			//read by the view of the previous key
+			t.readMutex.Unlock()
+			continue
+		}
+		if len(t.readBuf) < len(p) {
+			t.readBuf = make([]byte, len(p))
+		}
+		n, err := t.conn.Read(t.readBuf[0:len(p)])
+		if n > 0 {
+			t.mutex.Lock()
+			t.buf = append(t.buf, t.readBuf[0:n]...)
+			t.mutex.Unlock()
+		}
+		t.readMutex.Unlock()
+		if 0 == n && nil != err {
+			return 0, err
+		}
+	}
+}
+
+// keyTrialView is the conn of the mux session with one key.
+type keyTrialView struct {
+	trial *keyTrialConn
+	pos   int
+	dead  int32
+	//the view owns the real conn once its key is accepted
+	owner   int32
+	wmutex  sync.Mutex
+	pending bytes.Buffer
+	//called once the view reads the first bytes
+	firstRead     func()
+	firstReadOnce sync.Once
+}
+
+func (v *keyTrialView) Read(p []byte) (int, error) {
+	n, err := v.trial.readAt(v, p)
+	if n > 0 && nil != v.firstRead {
+		v.firstReadOnce.Do(v.firstRead)
+	}
+	return n, err
+}
+
+func (v *keyTrialView) Write(p []byte) (int, error) {
+	v.wmutex.Lock()
+	defer v.wmutex.Unlock()
+	if atomic.LoadInt32(&v.dead) == 1 {
+		return 0, io.ErrClosedPipe
+	}
+	if atomic.LoadInt32(&v.owner) == 0 {
+		//never send data encrypted by a key which may be wrong, the data is
+		//flushed once the key is accepted
+		return v.pending.Write(p)
+	}
+	return v.trial.conn.Write(p)
+}
+
+func (v *keyTrialView) own() error {
+	v.wmutex.Lock()
+	defer v.wmutex.Unlock()
+	atomic.StoreInt32(&v.owner, 1)
+	if v.pending.Len() == 0 {
+		return nil
+	}
+	_, err := v.trial.conn.Write(v.pending.Bytes())
+	v.pending.Reset()
+	return err
+}
+
+func (v *keyTrialView) Close() error {
+	atomic.StoreInt32(&v.dead, 1)
+	if atomic.LoadInt32(&v.owner) == 1 {
+		return v.trial.conn.Close()
+	}
+	return nil
+}
+
+// serverKeyTrial tries the accepted keys in order on the first auth of a
+// server mux session.
+type serverKeyTrial struct {
+	trial   *keyTrialConn
+	keys    []serverKey
+	idx     int
+	view    *keyTrialView
+	timer   *time.Timer
+	timeout time.Duration
+	session *mux.ProxyMuxSession
+}
+
+func (s *serverKeyTrial) start() error {
+	key := s.keys[s.idx]
+	s.view = &keyTrialView{trial: s.trial}
+	if s.idx == len(s.keys)-1 {
+		s.view.owner = 1
+	}
+	cfg := initialPMuxConfigWithKey(key.key)
+	session, err := pmux.Server(s.view, cfg)
+	if nil != err {
+		return err
+	}
+	s.session.Session = session
+	s.session.Config = cfg
+	if 0 == s.view.owner {
+		view, timeout := s.view, s.timeout
+		timer := time.AfterFunc(timeout, func() {
+			session.Close()
+			view.Close()
+		})
+		//the timer starts once the first bytes arrive, since slow links or
+		//polling transports may take long to send the auth request
+		timer.Stop()
+		view.firstRead = func() {
+			timer.Reset(timeout)
+		}
+		s.timer = timer
+	}
+	return nil
+}
+
+// next recreates the session with the next key, returns false if there is
+// no more key.
+func (s *serverKeyTrial) next() bool {
+	if nil != s.timer {
+		s.timer.Stop()
+	}
+	s.session.Session.Close()
+	s.view.Close()
+	for s.idx++; s.idx < len(s.keys); s.idx++ {
+		if err := s.start(); nil == err {
+			return true
+		}
+	}
+	s.trial.conn.Close()
+	serverKeyTrials.Delete(s.session)
+	return false
+}
+
+// accept stops the trial since the auth request is decrypted by current key.
+func (s *serverKeyTrial) accept() serverKey {
+	if nil != s.timer {
+		s.timer.Stop()
+	}
+	s.trial.mutex.Lock()
+	s.trial.recording = false
+	s.trial.buf = s.trial.buf[s.view.pos-s.trial.base:]
+	s.trial.base = s.view.pos
+	s.trial.mutex.Unlock()
+	s.view.own()
+	serverKeyTrials.Delete(s.session)
+	return s.keys[s.idx]
+}
+
+var serverKeyTrials sync.Map //*mux.ProxyMuxSession -> *serverKeyTrial
+
+func getServerKeyTrial(session mux.MuxSession) *serverKeyTrial {
+	v, ok := serverKeyTrials.Load(session)
+	if !ok {
+		return nil
+	}
+	return v.(*serverKeyTrial)
+}
+
+// NewServerMuxSession creates the server side mux session over the conn, the
+// session would be recreated with the next accepted key of the server cipher
+// if the auth request can not be decrypted by current one.
+func NewServerMuxSession(conn io.ReadWriteCloser, netConn mux.ConnAddr) (*mux.ProxyMuxSession, error) {
+	keys := DefaultServerCipher.acceptedKeys(time.Now())
+	if len(keys) <= 1 {
+		cfg := InitialPMuxConfig(&DefaultServerCipher)
+		if len(keys) == 1 {
+			cfg = initialPMuxConfigWithKey(keys[0].key)
+		}
+		session, err := pmux.Server(conn, cfg)
+		if nil != err {
+			return nil, err
+		}
+		return &mux.ProxyMuxSession{Session: session, NetConn: netConn, Config: cfg}, nil
+	}
+	timeout := DefaultServerCipher.KeyTrialTimeout
+	if timeout <= 0 {
+		timeout = defaultKeyTrialTimeout
+	}
+	s := &serverKeyTrial{
+		trial:   &keyTrialConn{conn: conn, recording: true},
+		keys:    keys,
+		timeout: time.Duration(timeout) * time.Second,
+		session: &mux.ProxyMuxSession{NetConn: netConn},
+	}
+	for ; s.idx < len(keys); s.idx++ {
+		err := s.start()
+		if nil == err {
+			serverKeyTrials.Store(s.session, s)
+			return s.session, nil
+		}
+		logger.Error("[ERROR]Failed to create mux session with key:%s for reason:%v", keys[s.idx].name, err)
+	}
+	conn.Close()
+	return nil, mux.ErrAuthFailed
+}
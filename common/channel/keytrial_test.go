@@ -0,0 +1,87 @@
+package channel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+type testTrialConn struct {
+	io.Reader
+	written bytes.Buffer
+	closed  bool
+}
+
+func (c *testTrialConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *testTrialConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestKeyTrialConn(t *testing.T) {
+	conn := &testTrialConn{Reader: bytes.NewReader([]byte("0123456789"))}
+	trial := &keyTrialConn{conn: conn, recording: true}
+	//view of the wrong key reads part of the data & writes nothing
+	first := &keyTrialView{trial: trial}
+	b := make([]byte, 4)
+	if n, _ := first.Read(b); n != 4 || string(b) != "0123" {
+		t.Fatalf("Unexpected read %q", b[0:n])
+	}
+	first.Write([]byte("garbage"))
+	first.Close()
+	if conn.written.Len() != 0 || conn.closed {
+		t.Fatalf("View which is not owner should not write or close the conn")
+	}
+	//view of next key reads the data from beginning
+	second := &keyTrialView{trial: trial}
+	data, _ := ioutil.ReadAll(second)
+	if string(data) != "0123456789" {
+		t.Fatalf("Unexpected replayed data %q", data)
+	}
+	second.Write([]byte("o"))
+	if conn.written.Len() != 0 {
+		t.Fatalf("Data should be pending before the key is accepted")
+	}
+	second.own()
+	second.Write([]byte("k"))
+	second.Close()
+	if conn.written.String() != "ok" || !conn.closed {
+		t.Fatalf("Owner view should write & close the conn")
+	}
+}
+
+func TestKeyTrialTimeoutAfterFirstBytes(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	s := &serverKeyTrial{
+		trial:   &keyTrialConn{conn: &testTrialConn{Reader: r}, recording: true},
+		keys:    []serverKey{newServerKey("", "k1"), newServerKey("", "k2")},
+		timeout: 50 * time.Millisecond,
+		session: &mux.ProxyMuxSession{},
+	}
+	if err := s.start(); nil != err {
+		t.Fatal(err)
+	}
+	view := s.view
+	//the client is delayed longer than the timeout before sending anything
+	time.Sleep(4 * s.timeout)
+	if atomic.LoadInt32(&view.dead) == 1 {
+		t.Fatalf("Trial should not time out before the first bytes")
+	}
+	go w.Write([]byte("auth"))
+	if n, err := view.Read(make([]byte, 4)); n != 4 || nil != err {
+		t.Fatalf("Unexpected read %d %v", n, err)
+	}
+	time.Sleep(4 * s.timeout)
+	if atomic.LoadInt32(&view.dead) != 1 {
+		t.Fatalf("Trial should time out after the first bytes")
+	}
+}
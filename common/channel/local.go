@@ -58,6 +58,25 @@ func AllowedSchema() []string {
 	return schemes
 }
 
+// clientExchangedKey derives the session key from the key exchange answered
+// by server, the auth fails if the server does not answer it unless AllowNoKex
+// is set for old servers.
+func clientExchangedKey(conf *CipherConfig, authKey string, kex *mux.KeyExchange, res *mux.AuthResponse) ([]byte, error) {
+	if len(res.KexPub) == 0 {
+		if !conf.AllowNoKex {
+			logger.Error("[ERROR]Server does not answer the key exchange of user:%s, set 'AllowNoKex' to accept old servers.", conf.User)
+			return nil, mux.ErrAuthFailed
+		}
+		logger.Notice("Server does not support key exchange, the session of user:%s is not forward secret.", conf.User)
+		return nil, nil
+	}
+	if !mux.VerifyKexMAC(authKey, kex.Public, res.KexPub, res.KexMAC) {
+		logger.Error("[ERROR]Invalid key exchange MAC from server for user:%s", conf.User)
+		return nil, mux.ErrAuthFailed
+	}
+	return kex.ClientKey(authKey, res.KexPub)
+}
+
 func clientAuthMuxSession(session mux.MuxSession, cipherMethod string, conf *ProxyChannelConfig, tunnelPriAddr, tunnelPubAddr string, isFirst bool, isP2P bool) (error, *mux.AuthRequest, *mux.AuthResponse) {
 	authStream, err := session.OpenStream()
 	if nil != err {
@@ -83,37 +102,79 @@ func clientAuthMuxSession(session mux.MuxSession, cipherMethod string, conf *Pro
 		authReq.P2PPriAddr = ""
 		authReq.P2PPubAddr = ""
 	}
+	//p2p streams are relayed to the peer which may not send ConnectResponse
+	authReq.ConnectAck = len(conf.P2PToken) == 0 && !isP2P
+	authKey := conf.Cipher.Key
+	if len(conf.Cipher.UserKey) > 0 {
+		authKey = conf.Cipher.UserKey
+	}
+	psession, isPMux := session.(*mux.ProxyMuxSession)
+	var kex *mux.KeyExchange
+	if isFirst && isPMux && conf.Cipher.KeyExchange {
+		kex, err = mux.NewKeyExchange()
+		if nil != err {
+			return err, nil, nil
+		}
+		authReq.KexPub = kex.Public
+	}
+	authReq.Sign(authKey)
 	authStream.SetReadDeadline(time.Now().Add(3 * time.Second))
 	authRes := authStream.Auth(authReq)
 	err = authRes.Error()
 	if nil != err {
 		return err, nil, nil
 	}
+	if !isP2P {
+		if err = verifyServerIdentity(conf, authReq, authRes); nil != err {
+			return err, nil, nil
+		}
+	}
 	//wait auth stream close
 	var zero time.Time
 	authStream.SetReadDeadline(zero)
 	authStream.Read(make([]byte, 1))
 	//authStream.Close()
-	if isFirst {
-		if psession, ok := session.(*mux.ProxyMuxSession); ok {
-			err = psession.Session.ResetCryptoContext(cipherMethod, counter)
+	if isFirst && isPMux {
+		if authRes.UserCipher != (len(conf.Cipher.UserKey) > 0) {
+			//never fallback to the shared key silently
+			logger.Error("[ERROR]User key of user:%s is not accepted by server, user cipher:%v", conf.Cipher.User, authRes.UserCipher)
+			return mux.ErrAuthFailed, nil, nil
+		}
+		var sessionKey []byte
+		if authRes.UserCipher {
+			sessionKey = mux.DeriveUserCipherKey(conf.Cipher.UserKey, authReq)
+		}
+		if nil != kex {
+			kexKey, err := clientExchangedKey(&conf.Cipher, authKey, kex, authRes)
 			if nil != err {
-				logger.Error("[ERROR]Failed to reset cipher context with reason:%v, while cipher method:%s", err, cipherMethod)
 				return err, nil, nil
 			}
+			if len(kexKey) > 0 {
+				sessionKey = kexKey
+			}
+		}
+		if len(sessionKey) > 0 {
+			err = psession.ResetCryptoKey(sessionKey, cipherMethod, counter)
+		} else {
+			err = psession.Session.ResetCryptoContext(cipherMethod, counter)
+		}
+		if nil != err {
+			logger.Error("[ERROR]Failed to reset cipher context with reason:%v, while cipher method:%s", err, cipherMethod)
+			return err, nil, nil
 		}
 	}
 	return nil, authReq, authRes
 }
 
 func clientAuthConn(c net.Conn, cipherMethod string, conf *ProxyChannelConfig, p2pTunnel bool) (error, *mux.AuthRequest, *mux.AuthResponse, mux.MuxSession) {
-	session, err := pmux.Client(c, InitialPMuxConfig(&conf.Cipher))
+	cfg := InitialPMuxConfig(&conf.Cipher)
+	session, err := pmux.Client(c, cfg)
 	if nil != err {
 		logger.Error("Failed to init mux session:%v", err)
 		c.Close()
 		return err, nil, nil, nil
 	}
-	ps := &mux.ProxyMuxSession{Session: session}
+	ps := &mux.ProxyMuxSession{Session: session, Config: cfg}
 	var tunnelPriAddr string
 	if !p2pTunnel {
 		tunnelPriAddr = c.LocalAddr().String()
@@ -13,7 +13,6 @@ import (
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
 	"github.com/yinqiwen/gsnova/common/protector"
-	"github.com/yinqiwen/pmux"
 )
 
 const (
@@ -79,13 +78,12 @@ func handleP2PConn(p2pConn net.Conn, ch *LocalProxyChannel, opt *p2pHandshakeOpt
 			return err
 		}
 	} else {
-		session, err := pmux.Server(p2pConn, InitialPMuxConfig(&DefaultServerCipher))
+		p2pSession, err = NewServerMuxSession(p2pConn, nil)
 		if nil != err {
 			logger.Error("[ERROR]Failed to create mux session for tcp server with reason:%v", err)
 			p2pConn.Close()
 			return err
 		}
-		p2pSession = &mux.ProxyMuxSession{Session: session}
 		recvAuth, err = serverAuthSession(p2pSession, nil, true)
 		if nil != err {
 			p2pConn.Close()
@@ -154,7 +152,7 @@ func startUPNPServer() error {
 	}
 	lp, err := startP2PServer(fmt.Sprintf("0.0.0.0:%d", UPNPExposePort), nil, nil)
 	if nil != err {
-		logger.Error("Failed to listen on %s with err:%v", err)
+		logger.Error("Failed to listen on %d with err:%v", UPNPExposePort, err)
 		return err
 	}
 	upnpMappingPort = lp.(*net.TCPListener).Addr().(*net.TCPAddr).Port
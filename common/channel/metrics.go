@@ -0,0 +1,83 @@
+package channel
+
+import (
+	"sync/atomic"
+
+	"github.com/yinqiwen/gsnova/common/metrics"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+var clientDialErrors = metrics.NewCounterVec("gsnova_client_dial_errors_total", "Failed mux session creations by reason.", "channel", "server", "reason")
+var clientHeartbeatRTT = metrics.NewHistogramVec("gsnova_client_heartbeat_rtt_seconds", "Heartbeat ping RTT of mux sessions.", metrics.DefaultRTTBuckets, "channel", "server")
+
+var serverBytes = metrics.NewCounterVec("gsnova_server_bytes_total", "Bytes proxied by the server, 'up' is sent by clients.", "direction")
+var serverConnectErrors = metrics.NewCounterVec("gsnova_server_connect_errors_total", "Failed connects of proxy streams by reason.", "reason")
+
+func init() {
+	metrics.NewGaugeFunc("gsnova_client_sessions", "Mux sessions including the retired ones per server.", []string{"channel", "server"}, func(emit func(float64, ...string)) {
+		forEachSessionHolder(func(channel string, holder *muxSessionHolder) {
+			holder.sessionMutex.Lock()
+			n := len(holder.retiredSessions)
+			if nil != holder.muxSession {
+				n++
+			}
+			holder.sessionMutex.Unlock()
+			emit(float64(n), channel, holder.server)
+		})
+	})
+	metrics.NewGaugeFunc("gsnova_client_streams", "Active streams per server.", []string{"channel", "server"}, func(emit func(float64, ...string)) {
+		forEachSessionHolder(func(channel string, holder *muxSessionHolder) {
+			holder.sessionMutex.Lock()
+			n := holder.numStreams()
+			for retired := range holder.retiredSessions {
+				n += retired.NumStreams()
+			}
+			holder.sessionMutex.Unlock()
+			emit(float64(n), channel, holder.server)
+		})
+	})
+	metrics.NewGaugeFunc("gsnova_server_sessions", "Active sessions of the server.", nil, func(emit func(float64, ...string)) {
+		n := 0
+		activeSessions.Range(func(key, value interface{}) bool {
+			n++
+			return true
+		})
+		emit(float64(n))
+	})
+	metrics.NewGaugeFunc("gsnova_server_streams", "Active streams of the server.", nil, func(emit func(float64, ...string)) {
+		var n int32
+		activeSessions.Range(func(key, value interface{}) bool {
+			n += atomic.LoadInt32(&key.(*sessionContext).streamCouter)
+			return true
+		})
+		emit(float64(n))
+	})
+}
+
+func forEachSessionHolder(f func(channel string, holder *muxSessionHolder)) {
+	localChannelMutex.Lock()
+	defer localChannelMutex.Unlock()
+	for name, ch := range localChannelTable {
+		for _, holder := range ch.sessions {
+			if nil != holder {
+				f(name, holder)
+			}
+		}
+	}
+}
+
+// ConnectErrorReason returns the label of the error for metrics.
+func ConnectErrorReason(err error) string {
+	if err == mux.ErrAuthFailed {
+		return "auth"
+	}
+	return mux.ConnectErrorClass(err)
+}
+
+// StreamServer returns the server which the stream is opened by.
+func StreamServer(stream mux.MuxStream, conf *ProxyChannelConfig) string {
+	if ps, ok := stream.(*mux.ProxyMuxStream); ok && len(ps.Server) > 0 {
+		return ps.Server
+	}
+	return conf.Name
+}
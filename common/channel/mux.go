@@ -39,6 +39,31 @@ type muxSessionHolder struct {
 	sessionMutex    sync.Mutex
 	conf            *ProxyChannelConfig
 	heatbeating     bool
+	stat            holderStat
+	breaker         holderBreaker
+	connectAck      bool
+	//mirror of muxSession read without the sessionMutex
+	activeSession atomic.Value
+}
+
+type sessionRef struct {
+	session mux.MuxSession
+}
+
+// setSession updates the session with the sessionMutex held.
+func (s *muxSessionHolder) setSession(session mux.MuxSession) {
+	s.muxSession = session
+	s.activeSession.Store(sessionRef{session})
+}
+
+// numStreams is safe to call without the sessionMutex, it's called by the
+// session selection policies on every open.
+func (s *muxSessionHolder) numStreams() int {
+	ref, _ := s.activeSession.Load().(sessionRef)
+	if nil == ref.session {
+		return 0
+	}
+	return ref.session.NumStreams()
 }
 
 func (s *muxSessionHolder) tryCloseRetiredSessions() {
@@ -55,7 +80,7 @@ func (s *muxSessionHolder) dumpStat(w io.Writer) {
 	s.sessionMutex.Lock()
 	defer s.sessionMutex.Unlock()
 	s.tryCloseRetiredSessions()
-	fmt.Fprintf(w, "Server:%s, CreateTime:%v, RetireTime:%v, RetireSessionNum:%v\n", s.server, s.creatTime.Format("15:04:05"), s.expireTime.Format("15:04:05"), len(s.retiredSessions))
+	fmt.Fprintf(w, "Server:%s, CreateTime:%v, RetireTime:%v, RetireSessionNum:%v, StreamNum:%d, RTT:%v, RecentFailures:%d, Breaker:%s, RetryAfter:%v\n", s.server, s.creatTime.Format("15:04:05"), s.expireTime.Format("15:04:05"), len(s.retiredSessions), s.numStreams(), s.stat.RTT(), s.stat.recentFailures(), s.breaker.String(), s.breaker.retryAfter())
 }
 
 func (s *muxSessionHolder) close() {
@@ -64,13 +89,13 @@ func (s *muxSessionHolder) close() {
 
 	if nil != s.muxSession {
 		s.muxSession.Close()
-		s.muxSession = nil
+		s.setSession(nil)
 	}
 }
 func (s *muxSessionHolder) check() {
 	if nil != s.muxSession && !s.expireTime.IsZero() && s.expireTime.Before(time.Now()) {
 		s.retiredSessions[s.muxSession] = true
-		s.muxSession = nil
+		s.setSession(nil)
 	}
 }
 
@@ -82,13 +107,26 @@ func (s *muxSessionHolder) getNewStream() (mux.MuxStream, error) {
 	}()
 	s.check()
 	if nil == s.muxSession {
-		s.init(false)
+		if err := s.init(false); nil != err {
+			if err == errBreakerOpen || err == errHolderDialing {
+				return nil, err
+			}
+			s.stat.onFailure()
+		}
 	}
 	if nil == s.muxSession {
 		return nil, pmux.ErrSessionShutdown
 	}
 	s.activeTime = time.Now()
-	return s.muxSession.OpenStream()
+	stream, err := s.muxSession.OpenStream()
+	if nil != err {
+		s.stat.onFailure()
+	} else if ps, ok := stream.(*mux.ProxyMuxStream); ok {
+		ps.ConnectAck = s.connectAck
+		ps.Server = s.server
+		ps.OnConnectFailure = s.stat.onFailure
+	}
+	return stream, err
 }
 
 func (s *muxSessionHolder) heartbeat(interval int) {
@@ -105,11 +143,14 @@ func (s *muxSessionHolder) heartbeat(interval int) {
 			s.sessionMutex.Unlock()
 			if nil != session {
 				if s.Channel.Features().Pingable {
-					_, err := session.Ping()
+					duration, err := session.Ping()
 					if err != nil {
 						logger.Error("[ERR]: Ping remote:%s failed: %v", s.server, err)
+						s.stat.onFailure()
 						s.close()
 					} else {
+						s.stat.updateRTT(duration)
+						clientHeartbeatRTT.Observe(duration.Seconds(), s.conf.Name, s.server)
 						// if duration > time.Duration(100)*time.Millisecond {
 						// 	logger.Debug("Cost %v to ping remote:%s", duration, s.server)
 						// }
@@ -132,20 +173,34 @@ func (s *muxSessionHolder) init(lock bool) error {
 	if nil != s.muxSession {
 		return nil
 	}
+	if err := s.breaker.allow(); nil != err {
+		return err
+	}
+	//the dial is made without the sessionMutex, the concurrent callers are
+	//rejected by the breaker during the dial & fail over to the next holder
+	s.sessionMutex.Unlock()
 	session, err := s.Channel.CreateMuxSession(s.server, s.conf)
+	var authReq *mux.AuthRequest
+	var authRes *mux.AuthResponse
 	if nil == err && nil != session {
 		cipherMethod := s.conf.Cipher.Method
 		if strings.HasPrefix(s.server, "https://") || strings.HasPrefix(s.server, "wss://") || strings.HasPrefix(s.server, "tls://") || strings.HasPrefix(s.server, "quic://") || strings.HasPrefix(s.server, "http2://") {
 			cipherMethod = "none"
 		}
-		err, authReq, _ := clientAuthMuxSession(session, cipherMethod, s.conf, "", "", true, false)
+		err, authReq, authRes = clientAuthMuxSession(session, cipherMethod, s.conf, "", "", true, false)
+	}
+	s.sessionMutex.Lock()
+	if nil != session {
 		if nil != err {
-
+			s.onInitFailure(err)
 			return err
 		}
+		s.connectAck = authReq.ConnectAck && authRes.ConnectAck
 
 		s.creatTime = time.Now()
-		s.muxSession = session
+		s.setSession(session)
+		s.stat.onSuccess()
+		s.breaker.onSuccess()
 		features := s.Channel.Features()
 		if features.AutoExpire {
 			expireAfter := 1800
@@ -161,7 +216,7 @@ func (s *muxSessionHolder) init(lock bool) error {
 		}
 		if DirectChannelName != s.conf.Name {
 			if len(defaultProxyLimitConfig.BlackList) > 0 || len(defaultProxyLimitConfig.WhiteList) > 0 {
-				go ServProxyMuxSession(session, authReq, nil)
+				go ServProxyMuxSession(session, authReq, nil, "local")
 			}
 		}
 
@@ -170,9 +225,17 @@ func (s *muxSessionHolder) init(lock bool) error {
 	if nil == err {
 		err = fmt.Errorf("Empty error to create session")
 	}
+	s.onInitFailure(err)
 	return err
 }
 
+func (s *muxSessionHolder) onInitFailure(err error) {
+	clientDialErrors.Inc(s.conf.Name, s.server, ConnectErrorReason(err))
+	if wait := s.breaker.onFailure(); wait > 0 {
+		logger.Error("[ERROR]Circuit breaker opened for server:%s, retry after %v since last failure:%v", s.server, wait, err)
+	}
+}
+
 var localChannelTable = make(map[string]*LocalProxyChannel)
 var localChannelMutex sync.Mutex
 
@@ -221,7 +284,7 @@ func (ch *LocalProxyChannel) setP2PSession(c net.Conn, s mux.MuxSession, authReq
 			ch.p2pSessions.Delete(s)
 		}()
 		if len(defaultProxyLimitConfig.BlackList) > 0 || len(defaultProxyLimitConfig.WhiteList) > 0 {
-			go ServProxyMuxSession(s, authReq, nil)
+			go ServProxyMuxSession(s, authReq, nil, "p2p")
 		}
 	}
 }
@@ -259,24 +322,20 @@ func (ch *LocalProxyChannel) getMuxStream() (stream mux.MuxStream, err error) {
 		return
 	}
 
-	c := atomic.LoadInt32(&ch.cursor)
-	for i := 0; i < len(ch.sessions); i++ {
-		if int(c) >= len(ch.sessions) {
-			c = 0
+	for _, holder := range ch.orderedSessions() {
+		if holder.breaker.skip() {
+			continue
 		}
-		holder := ch.sessions[c]
 		stream, err = holder.getNewStream()
 		if nil != err {
 			if err == pmux.ErrSessionShutdown {
 				holder.close()
 			}
 			logger.Debug("Try to get next session since current session failed to open new stream with err:%v", err)
-			c++
 		} else {
 			if ch.autoExpire {
 				ch.lastActiveTime = time.Now()
 			}
-			atomic.StoreInt32(&ch.cursor, c+1)
 			return
 		}
 	}
@@ -353,6 +412,7 @@ func (ch *LocalProxyChannel) Init(lock bool) bool {
 }
 
 func DumpLoaclChannelStat(w io.Writer) {
+	dumpChannelGroupStat(w)
 	for _, pch := range localChannelTable {
 		if pch.Conf.Name != DirectChannelName {
 			for _, holder := range pch.sessions {
@@ -375,20 +435,19 @@ func NewProxyChannel(conf *ProxyChannelConfig) *LocalProxyChannel {
 func GetMuxStreamByChannel(name string) (mux.MuxStream, *ProxyChannelConfig, error) {
 	pch, exist := localChannelTable[name]
 	if !exist {
+		if _, isGroup := channelGroupTable[name]; isGroup {
+			return getMuxStreamByGroup(name)
+		}
 		return nil, nil, fmt.Errorf("No proxy found to get mux session")
 	}
 	stream, err := pch.getMuxStream()
 	return stream, &pch.Conf, err
 }
 
-func GetMuxStreamByURL(u *url.URL, defaultUser string, defaultCipher *CipherConfig) (mux.MuxStream, *ProxyChannelConfig, error) {
-	key := u.String()
-	localChannelMutex.Lock()
-	defer localChannelMutex.Unlock()
-	stream, conf, err := GetMuxStreamByChannel(key)
-	if nil == err {
-		return stream, conf, err
-	}
+// hopChannelConf returns the config of the channel to the hop server for the
+// user. The channels are not shared between users, since both the cipher user
+// & the dialControl checking the resolved server address are the user's.
+func hopChannelConf(u *url.URL, user string, defaultCipher *CipherConfig) *ProxyChannelConfig {
 	var cipher CipherConfig
 	if nil != u.User {
 		cipher.User = u.User.Username()
@@ -396,13 +455,13 @@ func GetMuxStreamByURL(u *url.URL, defaultUser string, defaultCipher *CipherConf
 		cipher.Method = u.Query().Get("method")
 	}
 	if len(cipher.User) == 0 {
-		cipher.User = defaultUser
+		cipher.User = user
 	}
 	if len(cipher.Key) == 0 {
 		cipher.Key = defaultCipher.Key
 	}
-	conf = &ProxyChannelConfig{
-		Name:                u.String(),
+	return &ProxyChannelConfig{
+		Name:                u.String() + "#" + user,
 		Enable:              true,
 		ServerList:          []string{u.String()},
 		Cipher:              cipher,
@@ -411,6 +470,19 @@ func GetMuxStreamByURL(u *url.URL, defaultUser string, defaultCipher *CipherConf
 		ReconnectPeriod:     1800,
 		RCPRandomAdjustment: 10,
 		lazyConnect:         true,
+		dialControl:         destinationControl(user),
+	}
+}
+
+// GetMuxStreamByURL returns the stream of the channel to the server url for the
+// user, the channel is created if not exist.
+func GetMuxStreamByURL(u *url.URL, user string, defaultCipher *CipherConfig) (mux.MuxStream, *ProxyChannelConfig, error) {
+	conf := hopChannelConf(u, user, defaultCipher)
+	key := conf.Name
+	localChannelMutex.Lock()
+	defer localChannelMutex.Unlock()
+	if stream, existConf, err := GetMuxStreamByChannel(key); nil == err {
+		return stream, existConf, err
 	}
 	conf.Adjust()
 	ch := NewProxyChannel(conf)
@@ -432,6 +504,7 @@ func StopLocalChannels() {
 		}
 	}
 	localChannelTable = make(map[string]*LocalProxyChannel)
+	channelGroupTable = make(map[string]*ProxyChannelConfig)
 }
 
 var expireTaskLauched int32
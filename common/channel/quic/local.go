@@ -1,7 +1,6 @@
 package quic
 
 import (
-	"crypto/tls"
 	"net"
 	"net/url"
 
@@ -44,6 +43,9 @@ func (tc *QUICProxy) CreateMuxSession(server string, conf *channel.ProxyChannelC
 	if err != nil {
 		return nil, err
 	}
+	if err = conf.CheckDialAddr("udp", udpAddr.String()); nil != err {
+		return nil, err
+	}
 	udpConn, err := netx.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
 	if err != nil {
 		return nil, err
@@ -51,7 +53,7 @@ func (tc *QUICProxy) CreateMuxSession(server string, conf *channel.ProxyChannelC
 	quicConfig := &quic.Config{
 		KeepAlive: true,
 	}
-	quicSession, err = quic.Dial(udpConn, udpAddr, hostport, &tls.Config{InsecureSkipVerify: true}, quicConfig)
+	quicSession, err = quic.Dial(udpConn, udpAddr, hostport, channel.NewTLSConfig(conf), quicConfig)
 
 	if err != nil {
 		return nil, err
@@ -16,7 +16,7 @@ func servQUIC(lp quic.Listener) {
 			continue
 		}
 		muxSession := &mux.QUICMuxSession{Session: sess}
-		go channel.ServProxyMuxSession(muxSession, nil, nil)
+		go channel.ServProxyMuxSession(muxSession, nil, nil, "quic")
 	}
 	//ws.WriteMessage(websocket.CloseMessage, []byte{})
 }
@@ -4,6 +4,7 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"github.com/juju/ratelimit"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/metrics"
 	"github.com/yinqiwen/gsnova/common/mux"
 	"github.com/yinqiwen/pmux"
 )
@@ -29,25 +31,76 @@ type sessionContext struct {
 	closed       bool
 	isP2P        bool
 	isP2PExahnge bool
+
+	id         int64
+	scheme     string
+	remoteAddr net.Addr
+	createTime time.Time
+	bytesIn    int64
+	bytesOut   int64
+	closeOnce  sync.Once
+	traffic    *userTraffic
 }
 
 func (ctx *sessionContext) close() {
-	ctx.closed = true
-	if ctx.isP2P && nil != ctx.auth {
-		removeP2PSession(ctx.auth, ctx.session)
+	ctx.closeOnce.Do(func() {
+		ctx.closed = true
+		if ctx.isP2P && nil != ctx.auth {
+			removeP2PSession(ctx.auth, ctx.session)
+		}
+		ctx.session.Close()
+		emptySessions.Delete(ctx)
+		activeSessions.Delete(ctx)
+	})
+}
+
+func (ctx *sessionContext) user() string {
+	if nil == ctx.auth {
+		return ""
 	}
-	ctx.session.Close()
-	emptySessions.Delete(ctx)
+	return ctx.auth.User
 }
 
-func getRateLimitBucket(user string) *ratelimit.Bucket {
-	if nil == DefaultServerRateLimit.Limit {
-		return nil
+type countReader struct {
+	io.Reader
+	counter *int64
+	traffic *userTraffic
+	upload  bool
+	metric  *metrics.Counter
+	//bytes of the stream
+	stream *int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		atomic.AddInt64(r.counter, int64(n))
+		if nil != r.metric {
+			r.metric.Add(int64(n))
+		}
+		if nil != r.stream {
+			atomic.AddInt64(r.stream, int64(n))
+		}
+		if r.upload {
+			addUserTraffic(r.traffic, int64(n), 0)
+		} else {
+			addUserTraffic(r.traffic, 0, int64(n))
+		}
 	}
-	l, exist := DefaultServerRateLimit.Limit[user]
-	if !exist {
-		l, exist = DefaultServerRateLimit.Limit["*"]
-		user = "*"
+	return n, err
+}
+
+func getRateLimitBucket(user string) *ratelimit.Bucket {
+	var l string
+	exist := false
+	if u := getServerUser(user); nil != u && len(u.RateLimit) > 0 {
+		l, exist = u.RateLimit, true
+	} else if nil != DefaultServerRateLimit.Limit {
+		l, exist = DefaultServerRateLimit.Limit[user]
+		if !exist {
+			l, exist = DefaultServerRateLimit.Limit["*"]
+			user = "*"
+		}
 	}
 	if !exist {
 		return nil
@@ -74,6 +127,67 @@ func getRateLimitBucket(user string) *ratelimit.Bucket {
 
 var emptySessions sync.Map
 
+var activeSessions sync.Map
+var sessionIDSeed int64
+
+// RemoteSessionInfo describes an active mux session served by this server.
+type RemoteSessionInfo struct {
+	ID         int64
+	User       string
+	RemoteAddr string
+	Scheme     string
+	StreamNum  int32
+	BytesIn    int64
+	BytesOut   int64
+	AgeSecs    int64
+}
+
+// ListRemoteSessions returns all active sessions ordered by id, only sessions
+// of the user are returned if user is not empty.
+func ListRemoteSessions(user string) []RemoteSessionInfo {
+	sessions := make([]RemoteSessionInfo, 0)
+	activeSessions.Range(func(key, value interface{}) bool {
+		ctx := key.(*sessionContext)
+		if len(user) > 0 && ctx.user() != user {
+			return true
+		}
+		info := RemoteSessionInfo{
+			ID:        ctx.id,
+			User:      ctx.user(),
+			Scheme:    ctx.scheme,
+			StreamNum: atomic.LoadInt32(&ctx.streamCouter),
+			BytesIn:   atomic.LoadInt64(&ctx.bytesIn),
+			BytesOut:  atomic.LoadInt64(&ctx.bytesOut),
+			AgeSecs:   int64(time.Now().Sub(ctx.createTime).Seconds()),
+		}
+		if nil != ctx.remoteAddr {
+			info.RemoteAddr = ctx.remoteAddr.String()
+		}
+		sessions = append(sessions, info)
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// KickRemoteSessions closes the session by id, or all sessions of the user if
+// id is 0, returns the number of closed sessions.
+func KickRemoteSessions(id int64, user string) int {
+	n := 0
+	activeSessions.Range(func(key, value interface{}) bool {
+		ctx := key.(*sessionContext)
+		if (id > 0 && ctx.id == id) || (0 == id && len(user) > 0 && ctx.user() == user) {
+			logger.Notice("Kick session:%d of user:%s from %v", ctx.id, ctx.user(), ctx.remoteAddr)
+			ctx.close()
+			n++
+		}
+		return true
+	})
+	return n
+}
+
 func init() {
 	upBytesPool = &sync.Pool{
 		New: func() interface{} {
@@ -137,8 +251,25 @@ func handleProxyStream(stream mux.MuxStream, ctx *sessionContext) {
 	}
 	start := time.Now()
 	logger.Debug("[%d]Start handle stream:%v with comprresor:%s", stream.StreamID(), creq, ctx.auth.CompressMethod)
-	if !defaultProxyLimitConfig.Allowed(creq.Addr) {
-		logger.Error("'%s' is NOT allowed by proxy limit config.", creq.Addr)
+	var bytesUp, bytesDown int64
+	var closeReason CloseReason
+	defer func() {
+		if !AccessLogEnabled() {
+			return
+		}
+		entry := newServerAccessLogEntry(ctx, creq, start)
+		entry.BytesUp = atomic.LoadInt64(&bytesUp)
+		entry.BytesDown = atomic.LoadInt64(&bytesDown)
+		entry.CloseReason = closeReason.String()
+		WriteAccessLog(entry)
+	}()
+	if !defaultProxyLimitConfig.Allowed(creq.Addr) || !isServerUserAllowed(ctx.user(), creq.Addr) {
+		logger.Error("'%s' is NOT allowed by proxy limit config for user:%s.", creq.Addr, ctx.user())
+		serverConnectErrors.Inc(mux.ConnectErrNotAllowed)
+		closeReason.Set("not-allowed")
+		if ctx.auth.ConnectAck {
+			mux.WriteMessage(stream, &mux.ConnectResponse{Code: mux.ConnectFailed, Class: mux.ConnectErrNotAllowed, Reason: "not allowed by proxy limit"})
+		}
 		stream.Close()
 		return
 	}
@@ -154,7 +285,12 @@ func handleProxyStream(stream mux.MuxStream, ctx *sessionContext) {
 	}
 	if len(creq.Hops) == 0 {
 		var conn net.Conn
-		conn, err = net.DialTimeout(creq.Network, creq.Addr, time.Duration(dialTimeout)*time.Millisecond)
+		dialer := &net.Dialer{
+			Timeout: time.Duration(dialTimeout) * time.Millisecond,
+			//check the resolved address to avoid proxying to internal networks
+			Control: destinationControl(ctx.user()),
+		}
+		conn, err = dialer.Dial(creq.Network, creq.Addr)
 		if nil != err {
 			logger.Error("[ERROR]:Failed to connect %s:%v for reason:%v", creq.Network, creq.Addr, err)
 		} else {
@@ -170,9 +306,13 @@ func handleProxyStream(stream mux.MuxStream, ctx *sessionContext) {
 		var nextStream mux.MuxStream
 		next := creq.Hops[0]
 		nextHops := creq.Hops[1:]
-		nextURL, err = url.Parse(next)
+		nextURL, err = checkHops(ctx.user(), creq.Hops)
 		if nil == err {
-			nextStream, _, err = GetMuxStreamByURL(nextURL, ctx.auth.User, &DefaultServerCipher)
+			err = checkDestinationHost(ctx.user(), nextURL.Hostname(), hopURLPort(nextURL))
+			if nil == err {
+				//the hop host may be resolved to another address while dialing
+				nextStream, _, err = GetMuxStreamByURL(nextURL, ctx.user(), &DefaultServerCipher)
+			}
 			if nil == err {
 				opt := mux.StreamOptions{
 					DialTimeout: creq.DialTimeout,
@@ -184,18 +324,27 @@ func handleProxyStream(stream mux.MuxStream, ctx *sessionContext) {
 					c = nextStream
 				} else {
 					logger.Error("[ERROR]:Failed to connect next:%s for reason:%v", next, err)
+					ReportConnectFailure(nextStream, err)
+					nextStream.Close()
 				}
 			}
-		} else {
-			logger.Error("Failed to parse proxy url:%s with reason:%v", next, err)
 		}
 	}
 
+	if ctx.auth.ConnectAck {
+		if werr := mux.WriteMessage(stream, mux.NewConnectResponse(err)); nil != werr && nil == err {
+			err = werr
+			c.Close()
+		}
+	}
 	if nil != err {
+		serverConnectErrors.Inc(ConnectErrorReason(err))
+		closeReason.Set("connect-failed:" + ConnectErrorReason(err))
 		stream.Close()
 		return
 	}
 	streamReader, streamWriter := mux.GetCompressStreamReaderWriter(stream, ctx.auth.CompressMethod)
+	streamReader = &countReader{Reader: streamReader, counter: &ctx.bytesIn, traffic: ctx.traffic, upload: true, metric: serverBytes.With("up"), stream: &bytesUp}
 	defer c.Close()
 	closeSig := make(chan bool, 1)
 
@@ -206,7 +355,8 @@ func handleProxyStream(stream mux.MuxStream, ctx *sessionContext) {
 		if _, ok := c.(io.ReaderFrom); !ok {
 			buf = upBytesPool.Get().([]byte)
 		}
-		io.CopyBuffer(c, streamReader, buf)
+		_, cerr := io.CopyBuffer(c, streamReader, buf)
+		closeReason.Set(CopyCloseReason("client", cerr))
 		if len(buf) > 0 {
 			upBytesPool.Put(buf)
 		}
@@ -215,10 +365,10 @@ func handleProxyStream(stream mux.MuxStream, ctx *sessionContext) {
 	}()
 
 	var connReader io.Reader
-	connReader = c
+	connReader = &countReader{Reader: c, counter: &ctx.bytesOut, traffic: ctx.traffic, metric: serverBytes.With("down"), stream: &bytesDown}
 	rateLimitBucket := getRateLimitBucket(ctx.auth.User)
 	if nil != rateLimitBucket {
-		connReader = ratelimit.Reader(c, rateLimitBucket)
+		connReader = ratelimit.Reader(connReader, rateLimitBucket)
 	}
 
 	//buf := make([]byte, 128*1024)
@@ -234,6 +384,7 @@ func handleProxyStream(stream mux.MuxStream, ctx *sessionContext) {
 		if isTimeoutErr(err) && time.Now().Sub(stream.LatestIOTime()) < maxIdleTime {
 			continue
 		}
+		closeReason.Set(CopyCloseReason("remote", err))
 		c.Close()
 		stream.Close()
 		logger.Debug("[%d]2Cost %v to handle stream:%v  with %d bytes err:%v", stream.StreamID(), time.Now().Sub(start), creq, n, err)
@@ -254,24 +405,60 @@ func handleProxyStream(stream mux.MuxStream, ctx *sessionContext) {
 
 var DefaultServerCipher CipherConfig
 
-func serverAuthSession(session mux.MuxSession, raddr net.Addr, isFirst bool) (*mux.AuthRequest, error) {
+func acceptAuthRequest(session mux.MuxSession) (mux.MuxStream, *mux.AuthRequest, error) {
 	stream, err := session.AcceptStream()
 	if nil != err {
 		if err != pmux.ErrSessionShutdown {
 			logger.Error("Failed to accept stream with error:%v", err)
 		}
-		return nil, err
+		return nil, nil, err
 	}
 	recvAuth, err := mux.ReadAuthRequest(stream)
 	if nil != err {
 		logger.Error("[ERROR]:Failed to read auth request:%v", err)
+		return nil, nil, err
+	}
+	return stream, recvAuth, nil
+}
+
+func serverAuthSession(session mux.MuxSession, raddr net.Addr, isFirst bool) (*mux.AuthRequest, error) {
+	stream, recvAuth, err := acceptAuthRequest(session)
+	if trial := getServerKeyTrial(session); nil != trial {
+		//try next key if current one can not decrypt the auth request
+		for nil != err && trial.next() {
+			stream, recvAuth, err = acceptAuthRequest(session)
+		}
+		if nil == err {
+			trial.accept()
+		}
+	}
+	if nil != err {
 		return nil, err
 	}
 	logger.Info("Recv auth:%v %v", recvAuth, isFirst)
-	if !DefaultServerCipher.VerifyUser(recvAuth.User) {
+	//the key decrypts the auth request
+	var initialKey []byte
+	if tmp, ok := session.(*mux.ProxyMuxSession); ok && isFirst && nil != tmp.Config {
+		initialKey = tmp.Config.CipherKey
+	}
+	//replayed or unauthenticated requests are rejected just like invalid users
+	if !verifyServerUser(recvAuth.User) {
+		session.Close()
+		return nil, mux.ErrAuthFailed
+	}
+	authKey, verified := verifyServerAuthRequest(recvAuth, initialKey)
+	if !verified {
 		session.Close()
 		return nil, mux.ErrAuthFailed
 	}
+	logger.Info("User:%s auth by key:%s", recvAuth.User, authKey.name)
+	if IsUserQuotaExceeded(recvAuth.User) {
+		logger.Error("[ERROR]Reject user:%s since it exceeds traffic quota.", recvAuth.User)
+		mux.WriteMessage(stream, &mux.AuthResponse{Code: mux.AuthQuotaExceeded})
+		stream.Close()
+		session.Close()
+		return nil, mux.ErrQuotaExceeded
+	}
 	if !mux.IsValidCompressor(recvAuth.CompressMethod) {
 		logger.Error("[ERROR]Invalid compressor:%s", recvAuth.CompressMethod)
 		session.Close()
@@ -285,7 +472,31 @@ func serverAuthSession(session mux.MuxSession, raddr net.Addr, isFirst bool) (*m
 		//ctx.isP2P = true
 	}
 	authRes := &mux.AuthResponse{
-		Code: mux.AuthOK,
+		Code:       mux.AuthOK,
+		ConnectAck: recvAuth.ConnectAck,
+	}
+	//derive the session cipher from the user's own key if there is, and
+	//from the ephemeral keys if the client asks for key exchange
+	var sessionKey []byte
+	if tmp, ok := session.(*mux.ProxyMuxSession); ok && isFirst && nil != tmp.Config {
+		if u := getServerUser(recvAuth.User); nil != u && len(u.Key) > 0 {
+			sessionKey = mux.DeriveUserCipherKey(u.Key, recvAuth)
+			authRes.UserCipher = true
+		}
+		if len(recvAuth.KexPub) > 0 {
+			psk := authKey.key
+			kex, err := mux.NewKeyExchange()
+			if nil == err {
+				sessionKey, err = kex.ServerKey(psk, recvAuth.KexPub)
+			}
+			if nil != err {
+				logger.Error("[ERROR]Failed to exchange key with user:%s for reason:%v", recvAuth.User, err)
+				session.Close()
+				return nil, mux.ErrAuthFailed
+			}
+			authRes.KexPub = kex.Public
+			authRes.KexMAC = mux.KexMAC(psk, recvAuth.KexPub, kex.Public)
+		}
 	}
 	if len(recvAuth.P2PPriAddr) > 0 {
 		peerPriAddr, peerPubAddr := getPeerAddr(recvAuth)
@@ -302,22 +513,37 @@ func serverAuthSession(session mux.MuxSession, raddr net.Addr, isFirst bool) (*m
 	} else {
 		authRes.PubAddr = recvAuth.P2PPubAddr
 	}
+	if nil != serverSigningKey {
+		authRes.Sign(recvAuth, serverSigningKey)
+	}
 	mux.WriteMessage(stream, authRes)
 	stream.Close()
 	if isFirst {
 		if tmp, ok := session.(*mux.ProxyMuxSession); ok {
-			tmp.Session.ResetCryptoContext(recvAuth.CipherMethod, recvAuth.CipherCounter)
+			if len(sessionKey) > 0 {
+				tmp.ResetCryptoKey(sessionKey, recvAuth.CipherMethod, recvAuth.CipherCounter)
+			} else {
+				tmp.Session.ResetCryptoContext(recvAuth.CipherMethod, recvAuth.CipherCounter)
+			}
 		}
 	}
 
 	return recvAuth, nil
 }
 
-func ServProxyMuxSession(session mux.MuxSession, auth *mux.AuthRequest, raddr net.Addr) error {
+func ServProxyMuxSession(session mux.MuxSession, auth *mux.AuthRequest, raddr net.Addr, scheme string) error {
 	ctx := &sessionContext{}
 	ctx.auth = auth
 	ctx.activeIOTime = time.Now()
 	ctx.session = session
+	ctx.id = atomic.AddInt64(&sessionIDSeed, 1)
+	ctx.scheme = scheme
+	ctx.createTime = time.Now()
+	ctx.remoteAddr = raddr
+	if nil == ctx.remoteAddr {
+		ctx.remoteAddr = session.RemoteAddr()
+	}
+	activeSessions.Store(ctx, true)
 	defer ctx.close()
 	isFirst := true
 	for {
@@ -328,6 +554,7 @@ func ServProxyMuxSession(session mux.MuxSession, auth *mux.AuthRequest, raddr ne
 			}
 			isFirst = false
 			ctx.auth = recvAuth
+			ctx.traffic = getUserTraffic(recvAuth.User)
 			if len(recvAuth.P2PPriAddr) > 0 {
 				ctx.isP2PExahnge = true
 			}
@@ -0,0 +1,49 @@
+package channel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+type closeSession struct {
+	mux.MuxSession
+	closed bool
+}
+
+func (s *closeSession) NumStreams() int {
+	return 0
+}
+
+func (s *closeSession) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestKickRemoteSessions(t *testing.T) {
+	var sessions []*closeSession
+	for i, user := range []string{"alice", "bob", "alice"} {
+		session := &closeSession{}
+		sessions = append(sessions, session)
+		ctx := &sessionContext{
+			id:         int64(1000 + i),
+			auth:       &mux.AuthRequest{User: user},
+			session:    session,
+			createTime: time.Now(),
+		}
+		activeSessions.Store(ctx, true)
+	}
+	if infos := ListRemoteSessions("alice"); len(infos) != 2 || infos[0].ID != 1000 || infos[1].ID != 1002 {
+		t.Fatalf("Unexpected sessions of alice:%v", infos)
+	}
+	if n := KickRemoteSessions(1001, ""); n != 1 || !sessions[1].closed || len(ListRemoteSessions("bob")) != 0 {
+		t.Fatalf("Expected session 1001 kicked & removed")
+	}
+	if n := KickRemoteSessions(0, "alice"); n != 2 || !sessions[0].closed || !sessions[2].closed {
+		t.Fatalf("Expected sessions of alice kicked")
+	}
+	if len(ListRemoteSessions("")) != 0 || KickRemoteSessions(1000, "") != 0 {
+		t.Fatalf("Expected no session left")
+	}
+}
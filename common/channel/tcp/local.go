@@ -24,12 +24,13 @@ func (tc *TcpProxy) CreateMuxSession(server string, conf *channel.ProxyChannelCo
 		return nil, err
 	}
 
-	ps, err := pmux.Client(conn, channel.InitialPMuxConfig(&conf.Cipher))
+	cfg := channel.InitialPMuxConfig(&conf.Cipher)
+	ps, err := pmux.Client(conn, cfg)
 	if nil != err {
 		return nil, err
 	}
 	logger.Info("TCP Session:%v", server)
-	return &mux.ProxyMuxSession{Session: ps, NetConn: conn}, nil
+	return &mux.ProxyMuxSession{Session: ps, NetConn: conn, Config: cfg}, nil
 }
 
 func init() {
@@ -6,8 +6,6 @@ import (
 
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/logger"
-	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
 )
 
 func servTCP(lp net.Listener) {
@@ -16,15 +14,18 @@ func servTCP(lp net.Listener) {
 		if nil != err {
 			continue
 		}
-		session, err := pmux.Server(conn, channel.InitialPMuxConfig(&channel.DefaultServerCipher))
+		muxSession, err := channel.NewServerMuxSession(conn, conn)
 		if nil != err {
 			logger.Error("[ERROR]Failed to create mux session for tcp server with reason:%v", err)
 			continue
 		}
 		//conn.RemoteAddr().String()
-		muxSession := &mux.ProxyMuxSession{Session: session}
+		scheme := "tcp"
+		if _, ok := conn.(*tls.Conn); ok {
+			scheme = "tls"
+		}
 		go func() {
-			channel.ServProxyMuxSession(muxSession, nil, conn.RemoteAddr())
+			channel.ServProxyMuxSession(muxSession, nil, conn.RemoteAddr(), scheme)
 			conn.Close()
 		}()
 	}
@@ -0,0 +1,239 @@
+package channel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+var DefaultServerTraffic TrafficConfig
+
+// UserTrafficStat is the upload/download bytes of a user, upload is the data
+// sent by the user.
+type UserTrafficStat struct {
+	User          string
+	Day           string
+	Month         string
+	DayUpload     int64
+	DayDownload   int64
+	MonthUpload   int64
+	MonthDownload int64
+	TotalUpload   int64
+	TotalDownload int64
+}
+
+type userTraffic struct {
+	mutex sync.Mutex
+	stat  UserTrafficStat
+	//whether the sessions of the user have been kicked for exceeding quota
+	kicked bool
+}
+
+func (t *userTraffic) rollover(now time.Time) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if t.stat.Day != day {
+		t.stat.Day = day
+		t.stat.DayUpload = 0
+		t.stat.DayDownload = 0
+		t.kicked = false
+	}
+	if t.stat.Month != month {
+		t.stat.Month = month
+		t.stat.MonthUpload = 0
+		t.stat.MonthDownload = 0
+		t.kicked = false
+	}
+}
+
+// add returns true if the user exceeds the quota by the traffic at first time.
+func (t *userTraffic) add(now time.Time, upload, download int64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rollover(now)
+	t.stat.DayUpload += upload
+	t.stat.DayDownload += download
+	t.stat.MonthUpload += upload
+	t.stat.MonthDownload += download
+	t.stat.TotalUpload += upload
+	t.stat.TotalDownload += download
+	if !t.kicked && t.exceeded() {
+		t.kicked = true
+		return true
+	}
+	return false
+}
+
+func (t *userTraffic) exceeded() bool {
+	daily, monthly := getTrafficQuota(t.stat.User)
+	if daily > 0 && t.stat.DayUpload+t.stat.DayDownload >= daily {
+		return true
+	}
+	if monthly > 0 && t.stat.MonthUpload+t.stat.MonthDownload >= monthly {
+		return true
+	}
+	return false
+}
+
+func (t *userTraffic) quotaExceeded(now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rollover(now)
+	return t.exceeded()
+}
+
+func (t *userTraffic) snapshot() UserTrafficStat {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rollover(time.Now())
+	return t.stat
+}
+
+var userTrafficTable = make(map[string]*userTraffic)
+var userTrafficMutex sync.Mutex
+
+func parseQuota(s string) int64 {
+	if len(s) == 0 {
+		return -1
+	}
+	v, err := helper.ToBytes(s)
+	if nil != err {
+		return -1
+	}
+	return int64(v)
+}
+
+func getTrafficQuota(user string) (int64, int64) {
+	if u := getServerUser(user); nil != u && (len(u.Quota.Daily) > 0 || len(u.Quota.Monthly) > 0) {
+		return u.Quota.daily, u.Quota.monthly
+	}
+	if nil == DefaultServerTraffic.Quota {
+		return -1, -1
+	}
+	q, exist := DefaultServerTraffic.Quota[user]
+	if !exist {
+		q, exist = DefaultServerTraffic.Quota["*"]
+	}
+	if !exist {
+		return -1, -1
+	}
+	return q.daily, q.monthly
+}
+
+func getUserTraffic(user string) *userTraffic {
+	userTrafficMutex.Lock()
+	defer userTrafficMutex.Unlock()
+	t, exist := userTrafficTable[user]
+	if !exist {
+		t = &userTraffic{}
+		t.stat.User = user
+		userTrafficTable[user] = t
+	}
+	return t
+}
+
+func addUserTraffic(t *userTraffic, upload, download int64) {
+	if nil == t {
+		return
+	}
+	if t.add(time.Now(), upload, download) {
+		logger.Error("[ERROR]User:%s exceeds traffic quota, close all sessions of the user.", t.stat.User)
+		go KickRemoteSessions(0, t.stat.User)
+	}
+}
+
+// IsUserQuotaExceeded returns true if the user exceeds the daily or monthly quota.
+func IsUserQuotaExceeded(user string) bool {
+	return getUserTraffic(user).quotaExceeded(time.Now())
+}
+
+// GetUserTrafficStats returns the traffic stat of all users ordered by user.
+func GetUserTrafficStats() []UserTrafficStat {
+	userTrafficMutex.Lock()
+	traffics := make([]*userTraffic, 0, len(userTrafficTable))
+	for _, t := range userTrafficTable {
+		traffics = append(traffics, t)
+	}
+	userTrafficMutex.Unlock()
+	stats := make([]UserTrafficStat, 0, len(traffics))
+	for _, t := range traffics {
+		stats = append(stats, t.snapshot())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].User < stats[j].User
+	})
+	return stats
+}
+
+func saveUserTrafficStats(file string) error {
+	data, err := json.MarshalIndent(GetUserTrafficStats(), "", "    ")
+	if nil != err {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); nil != err {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func loadUserTrafficStats(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var stats []UserTrafficStat
+	if err = json.Unmarshal(data, &stats); nil != err {
+		return err
+	}
+	for _, stat := range stats {
+		t := getUserTraffic(stat.User)
+		t.mutex.Lock()
+		t.stat = stat
+		t.mutex.Unlock()
+	}
+	return nil
+}
+
+// InitServerTraffic loads the persisted traffic stat & starts the task to
+// persist it periodically.
+func InitServerTraffic(conf TrafficConfig) {
+	conf.init()
+	DefaultServerTraffic = conf
+	if len(conf.StatFile) == 0 {
+		return
+	}
+	if err := loadUserTrafficStats(conf.StatFile); nil != err {
+		logger.Error("[ERROR]Failed to load traffic stat from %s for reason:%v", conf.StatFile, err)
+	}
+	period := conf.SavePeriod
+	if period <= 0 {
+		period = 60
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(period) * time.Second)
+		for range ticker.C {
+			SaveServerTraffic()
+		}
+	}()
+}
+
+// SaveServerTraffic persists the traffic stat, it's called on shutdown to keep
+// the traffic since the last periodic save.
+func SaveServerTraffic() {
+	file := DefaultServerTraffic.StatFile
+	if len(file) == 0 {
+		return
+	}
+	if err := saveUserTrafficStats(file); nil != err {
+		logger.Error("[ERROR]Failed to save traffic stat to %s for reason:%v", file, err)
+	}
+}
@@ -0,0 +1,65 @@
+package channel
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUserTrafficQuota(t *testing.T) {
+	InitServerTraffic(TrafficConfig{Quota: map[string]TrafficQuota{
+		"abc": {Daily: "1K", Monthly: "2K"},
+		"*":   {Daily: "", Monthly: ""},
+	}})
+	defer func() {
+		DefaultServerTraffic = TrafficConfig{}
+	}()
+	traffic := &userTraffic{}
+	traffic.stat.User = "abc"
+	day1 := time.Date(2026, 10, 1, 10, 0, 0, 0, time.Local)
+	if traffic.add(day1, 512, 500) || traffic.quotaExceeded(day1) {
+		t.Fatalf("Quota should not be exceeded")
+	}
+	if !traffic.add(day1, 0, 12) || !traffic.quotaExceeded(day1) {
+		t.Fatalf("Daily quota should be exceeded")
+	}
+	if traffic.add(day1, 1, 1) {
+		t.Fatalf("Exceeding should be reported only once")
+	}
+	//next day resets the daily quota, but not the monthly quota
+	day2 := day1.Add(24 * time.Hour)
+	if traffic.quotaExceeded(day2) || traffic.stat.DayUpload != 0 {
+		t.Fatalf("Daily stat should be reset")
+	}
+	if !traffic.add(day2, 1100, 0) {
+		t.Fatalf("Monthly quota should be exceeded")
+	}
+	nextMonth := time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local)
+	if traffic.quotaExceeded(nextMonth) || traffic.stat.TotalUpload != 1613 {
+		t.Fatalf("Unexpected stat:%+v", traffic.stat)
+	}
+
+	other := &userTraffic{}
+	other.stat.User = "xyz"
+	if other.add(day1, 1<<30, 1<<30) {
+		t.Fatalf("User without quota should never exceed")
+	}
+}
+
+func TestSaveUserTrafficStats(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "traffic.json")
+	addUserTraffic(getUserTraffic("save-test"), 100, 200)
+	DefaultServerTraffic = TrafficConfig{StatFile: file}
+	defer func() {
+		DefaultServerTraffic = TrafficConfig{}
+	}()
+	SaveServerTraffic()
+	userTrafficTable = make(map[string]*userTraffic)
+	if err := loadUserTrafficStats(file); nil != err {
+		t.Fatalf("Failed to load:%v", err)
+	}
+	stat := getUserTraffic("save-test").snapshot()
+	if stat.TotalUpload != 100 || stat.DayDownload != 200 {
+		t.Fatalf("Unexpected loaded stat:%+v", stat)
+	}
+}
@@ -0,0 +1,177 @@
+package channel
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/juju/ratelimit"
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+// ServerUser is the entry of a user in the users file of the server.
+type ServerUser struct {
+	//key to derive the session cipher of the user, the shared Cipher.Key is used if empty
+	Key string
+	//bandwidth limit per second, overrides the RateLimit config
+	RateLimit string
+	//overrides the Traffic.Quota config
+	Quota TrafficQuota
+	//allowed destinations of the user, checked besides the ProxyLimit config
+	ProxyLimit ProxyLimitConfig
+	Disabled   bool
+	//deny the user to connect by hops, which are allowed by the Hop config
+	DisableHop bool
+}
+
+var serverUsers atomic.Value //map[string]*ServerUser, nil if no users file configured
+
+func getServerUsers() map[string]*ServerUser {
+	v := serverUsers.Load()
+	if nil == v {
+		return nil
+	}
+	return v.(map[string]*ServerUser)
+}
+
+func getServerUser(user string) *ServerUser {
+	users := getServerUsers()
+	if nil == users {
+		return nil
+	}
+	return users[user]
+}
+
+// verifyServerUser checks the user by the users file if it's configured,
+// otherwise by the User allow-list of the server cipher.
+func verifyServerUser(user string) bool {
+	users := getServerUsers()
+	if nil == users {
+		return DefaultServerCipher.VerifyUser(user)
+	}
+	u, exist := users[user]
+	if !exist || u.Disabled {
+		logger.Error("[ERROR]Invalid or disabled user:%s", user)
+		return false
+	}
+	return true
+}
+
+func isServerUserAllowed(user string, addr string) bool {
+	u := getServerUser(user)
+	if nil == u {
+		return true
+	}
+	return u.ProxyLimit.Allowed(addr)
+}
+
+func isServerUserHopAllowed(user string) bool {
+	u := getServerUser(user)
+	return nil == u || !u.DisableHop
+}
+
+func setServerUsers(users map[string]*ServerUser) {
+	old := getServerUsers()
+	serverUsers.Store(users)
+	//rate limits may be changed
+	rateLimitBucketLock.Lock()
+	rateLimitBuckets = make(map[string]*ratelimit.Bucket)
+	rateLimitBucketLock.Unlock()
+
+	kicked := make(map[string]bool)
+	activeSessions.Range(func(key, value interface{}) bool {
+		ctx := key.(*sessionContext)
+		name := ctx.user()
+		if nil == ctx.auth || kicked[name] {
+			return true
+		}
+		u, exist := users[name]
+		kick := !exist || u.Disabled
+		if prev, ok := old[name]; ok && exist && prev.Key != u.Key {
+			kick = true
+		}
+		if kick {
+			kicked[name] = true
+		}
+		return true
+	})
+	for name := range kicked {
+		logger.Notice("User:%s is removed, disabled or rekeyed, close all sessions of the user.", name)
+		KickRemoteSessions(0, name)
+	}
+}
+
+func loadServerUsers(file string) (map[string]*ServerUser, error) {
+	data, err := helper.ReadWithoutComment(file, "//")
+	if nil != err {
+		return nil, err
+	}
+	users := make(map[string]*ServerUser)
+	if err = json.Unmarshal(data, &users); nil != err {
+		return nil, err
+	}
+	for name, u := range users {
+		if nil == u {
+			users[name] = &ServerUser{}
+		} else {
+			u.ProxyLimit.compile()
+			u.Quota.init()
+		}
+	}
+	return users, nil
+}
+
+func reloadServerUsers(file string) error {
+	users, err := loadServerUsers(file)
+	if nil != err {
+		return err
+	}
+	setServerUsers(users)
+	logger.Info("Load %d users from %s", len(users), file)
+	return nil
+}
+
+func watchServerUsers(watcher *fsnotify.Watcher, file string) {
+	for {
+		select {
+		case event := <-watcher.Events:
+			if filepath.Clean(event.Name) != file {
+				continue
+			}
+			if 0 != event.Op&(fsnotify.Write|fsnotify.Create) {
+				//keep the current users if the file is broken or being written
+				if err := reloadServerUsers(file); nil != err {
+					logger.Error("[ERROR]Failed to reload users from %s for reason:%v", file, err)
+				}
+			}
+		case err := <-watcher.Errors:
+			logger.Error("[ERROR]Users file watcher error:%v", err)
+		}
+	}
+}
+
+// InitServerUsers loads the users file & reloads it once it's changed, all
+// users are rejected if the file is configured but can not be loaded.
+func InitServerUsers(file string) error {
+	if len(file) == 0 {
+		return nil
+	}
+	file = filepath.Clean(file)
+	if err := reloadServerUsers(file); nil != err {
+		serverUsers.Store(make(map[string]*ServerUser))
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if nil != err {
+		return err
+	}
+	//watch the dir since editors may replace the file
+	if err = watcher.Add(filepath.Dir(file)); nil != err {
+		watcher.Close()
+		return err
+	}
+	go watchServerUsers(watcher, file)
+	return nil
+}
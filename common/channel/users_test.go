@@ -0,0 +1,52 @@
+package channel
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerUsers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	content := `{
+	//comment is allowed
+	"abc":{"Key":"k1", "RateLimit":"1K", "Quota":{"Daily":"1K"}, "ProxyLimit":{"WhiteList":["*.example.com:443"]}},
+	"def":{"Disabled":true},
+	"xyz":null
+}`
+	if err := ioutil.WriteFile(file, []byte(content), 0644); nil != err {
+		t.Fatal(err)
+	}
+	defer serverUsers.Store(map[string]*ServerUser(nil))
+	if err := reloadServerUsers(file); nil != err {
+		t.Fatal(err)
+	}
+	if !verifyServerUser("abc") || !verifyServerUser("xyz") {
+		t.Fatalf("Users in file should be allowed")
+	}
+	if verifyServerUser("def") || verifyServerUser("unknown") {
+		t.Fatalf("Disabled or unknown users should be rejected")
+	}
+	if !isServerUserAllowed("abc", "www.example.com:443") || isServerUserAllowed("abc", "www.example.org:443") {
+		t.Fatalf("Unexpected proxy limit for user abc")
+	}
+	if !isServerUserAllowed("xyz", "www.example.org:443") {
+		t.Fatalf("User without proxy limit should be allowed")
+	}
+	if daily, monthly := getTrafficQuota("abc"); daily != 1024 || monthly != -1 {
+		t.Fatalf("Unexpected quota %d/%d", daily, monthly)
+	}
+	if nil == getRateLimitBucket("abc") || nil != getRateLimitBucket("xyz") {
+		t.Fatalf("Unexpected rate limit")
+	}
+
+	//broken file keeps current users
+	ioutil.WriteFile(file, []byte(`{"abc":`), 0644)
+	if err := reloadServerUsers(file); nil == err || !verifyServerUser("abc") {
+		t.Fatalf("Users should be kept if reload failed")
+	}
+	ioutil.WriteFile(file, []byte(`{"xyz":{}}`), 0644)
+	if err := reloadServerUsers(file); nil != err || verifyServerUser("abc") {
+		t.Fatalf("Removed user should be rejected after reload")
+	}
+}
@@ -35,11 +35,12 @@ func (ws *WebsocketProxy) CreateMuxSession(server string, conf *channel.ProxyCha
 		return nil, err
 	}
 	logger.Info("Connect %s success from %v->%v", server, c.LocalAddr(), c.RemoteAddr())
-	ps, err := pmux.Client(&mux.WsConn{Conn: c}, channel.InitialPMuxConfig(&conf.Cipher))
+	cfg := channel.InitialPMuxConfig(&conf.Cipher)
+	ps, err := pmux.Client(&mux.WsConn{Conn: c}, cfg)
 	if nil != err {
 		return nil, err
 	}
-	return &mux.ProxyMuxSession{Session: ps, NetConn: c}, nil
+	return &mux.ProxyMuxSession{Session: ps, NetConn: c, Config: cfg}, nil
 }
 
 func init() {
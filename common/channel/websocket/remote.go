@@ -6,7 +6,6 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
 )
 
 var (
@@ -30,11 +29,10 @@ func WebsocketInvoke(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error Upgrading to websockets", 400)
 		return
 	}
-	session, err := pmux.Server(&mux.WsConn{Conn: ws}, channel.InitialPMuxConfig(&channel.DefaultServerCipher))
+	muxSession, err := channel.NewServerMuxSession(&mux.WsConn{Conn: ws}, ws)
 	if nil != err {
 		return
 	}
-	muxSession := &mux.ProxyMuxSession{Session: session}
-	channel.ServProxyMuxSession(muxSession, nil, nil)
+	channel.ServProxyMuxSession(muxSession, nil, nil, "ws")
 	//ws.WriteMessage(websocket.CloseMessage, []byte{})
 }
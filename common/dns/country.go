@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+type CountryIPConfig struct {
+	//country code like 'JP'
+	Country string
+	//file of IPv4/IPv6 CIDR lines, also the cache of the content fetched from URL
+	File string
+	//fetch the CIDR lines from the URL periodically
+	URL string
+	//channel to fetch the URL, 'direct' by default
+	Channel string
+	//refresh period of the URL, default 1440
+	RefreshPeriodMinutes int
+}
+
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// IPRangeSet is a sorted set of IPv4/IPv6 ranges.
+type IPRangeSet struct {
+	ranges []ipRange
+}
+
+func lastIP(network *net.IPNet) net.IP {
+	ip := make(net.IP, len(network.IP))
+	for i := range ip {
+		ip[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return ip
+}
+
+// ParseIPRangeSet reads the set by lines of CIDR or single IP, empty lines
+// and lines starting with '#' are skipped.
+func ParseIPRangeSet(r io.Reader) (*IPRangeSet, error) {
+	var ranges []ipRange
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			ip := net.ParseIP(line)
+			if nil == ip {
+				return nil, fmt.Errorf("Invalid IP:%s", line)
+			}
+			ranges = append(ranges, ipRange{ip.To16(), ip.To16()})
+			continue
+		}
+		_, network, err := net.ParseCIDR(line)
+		if nil != err {
+			return nil, err
+		}
+		ranges = append(ranges, ipRange{network.IP.To16(), lastIP(network).To16()})
+	}
+	if err := scanner.Err(); nil != err {
+		return nil, err
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+	set := &IPRangeSet{}
+	for _, r := range ranges {
+		n := len(set.ranges)
+		if n > 0 && bytes.Compare(r.start, set.ranges[n-1].end) <= 0 {
+			if bytes.Compare(r.end, set.ranges[n-1].end) > 0 {
+				set.ranges[n-1].end = r.end
+			}
+			continue
+		}
+		set.ranges = append(set.ranges, r)
+	}
+	return set, nil
+}
+
+func LoadIPRangeSet(file string) (*IPRangeSet, error) {
+	f, err := os.Open(file)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseIPRangeSet(f)
+}
+
+func (s *IPRangeSet) Len() int {
+	return len(s.ranges)
+}
+
+func (s *IPRangeSet) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if nil == ip {
+		return false
+	}
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return bytes.Compare(s.ranges[i].end, ip) >= 0
+	})
+	return i < len(s.ranges) && bytes.Compare(s.ranges[i].start, ip) <= 0
+}
+
+var countryIPSets sync.Map
+
+func SetCountryIPSet(country string, set *IPRangeSet) {
+	countryIPSets.Store(strings.ToUpper(country), set)
+}
+
+func HasCountryIPSet(country string) bool {
+	_, exist := countryIPSets.Load(strings.ToUpper(country))
+	return exist
+}
+
+// IsInCountry returns true if the ip is in any of the countries' IP sets.
+func IsInCountry(ip net.IP, countries ...string) bool {
+	for _, country := range countries {
+		if v, exist := countryIPSets.Load(strings.ToUpper(country)); exist && v.(*IPRangeSet).Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadCountryIPFile(country, file string) {
+	set, err := LoadIPRangeSet(file)
+	if nil != err {
+		logger.Error("Failed to load IP range file:%s with reason:%v", file, err)
+		return
+	}
+	SetCountryIPSet(country, set)
+	logger.Info("Load %d IP ranges of country:%s from %s", set.Len(), strings.ToUpper(country), file)
+}
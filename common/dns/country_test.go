@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIPRangeSet(t *testing.T) {
+	content := `
+# comment
+1.0.2.0/23
+1.0.1.0/24
+1.0.1.128/25
+8.8.8.8
+2400:da00::/32
+`
+	set, err := ParseIPRangeSet(strings.NewReader(content))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if set.Len() != 4 {
+		t.Fatalf("Expected merged ranges, got %d", set.Len())
+	}
+	for ip, expected := range map[string]bool{
+		"1.0.1.0":        true,
+		"1.0.1.200":      true,
+		"1.0.3.255":      true,
+		"1.0.4.0":        false,
+		"1.0.0.255":      false,
+		"8.8.8.8":        true,
+		"8.8.8.9":        false,
+		"2400:da00::1":   true,
+		"2400:da01::1":   false,
+		"::ffff:1.0.2.1": true,
+	} {
+		if set.Contains(net.ParseIP(ip)) != expected {
+			t.Fatalf("Unexpected result for %s", ip)
+		}
+	}
+	if _, err := ParseIPRangeSet(strings.NewReader("1.0.1.0/33")); nil == err {
+		t.Fatalf("Expected error for invalid CIDR")
+	}
+}
+
+func TestIsInCountry(t *testing.T) {
+	jp, _ := ParseIPRangeSet(strings.NewReader("1.0.16.0/20"))
+	us, _ := ParseIPRangeSet(strings.NewReader("3.0.0.0/8"))
+	SetCountryIPSet("jp", jp)
+	SetCountryIPSet("US", us)
+	if !HasCountryIPSet("JP") || HasCountryIPSet("KR") {
+		t.Fatalf("Unexpected country IP sets")
+	}
+	ip := net.ParseIP("1.0.16.1")
+	if !IsInCountry(ip, "JP") || IsInCountry(ip, "us") || !IsInCountry(ip, "US", "jp") {
+		t.Fatalf("Unexpected country of %v", ip)
+	}
+}
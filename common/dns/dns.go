@@ -2,18 +2,56 @@ package dns
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math/rand"
 	"net"
 
 	"github.com/miekg/dns"
 	"github.com/yinqiwen/fdns"
-	"github.com/yinqiwen/gotoolkit/cip"
 	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/metrics"
 	"github.com/yinqiwen/gsnova/common/netx"
 )
 
 var LocalDNS *fdns.TrustedDNS
 
+var dnsQueries = metrics.NewCounterVec("gsnova_client_dns_queries_total", "DNS queries by resolver & result.", "resolver", "result")
+
+// CountQuery counts a DNS query resolved by the resolver, which could be
+// 'local', 'system' or 'proxy'.
+func CountQuery(resolver string, err error) {
+	result := "ok"
+	if nil != err {
+		result = "error"
+	}
+	dnsQueries.Inc(resolver, result)
+}
+
+// CountResponse counts a DNS query by the raw response read from the resolver
+// or the error reading it, the broken response & the response of a failed
+// server are counted as errors.
+func CountResponse(resolver string, res []byte, err error) {
+	if nil == err {
+		if len(res) < 12 {
+			err = errors.New("broken dns response")
+		} else if rcode := int(res[3] & 0x0f); rcode == dns.RcodeServerFailure || rcode == dns.RcodeRefused {
+			err = fmt.Errorf("dns response with rcode:%s", dns.RcodeToString[rcode])
+		}
+	}
+	CountQuery(resolver, err)
+}
+
+// QueryRaw resolves the raw DNS request by the local DNS.
+func QueryRaw(content []byte) ([]byte, error) {
+	if res, ok := FakeIPAnswer(content); ok {
+		return res, nil
+	}
+	res, err := LocalDNS.QueryRaw(content)
+	CountQuery("local", err)
+	return res, err
+}
+
 func pickIP(rr []dns.RR) string {
 	for _, answer := range rr {
 		if a, ok := answer.(*dns.A); ok {
@@ -41,6 +79,7 @@ func selectDNSServer(ss []string) string {
 
 func getIPByDefaultResolver(domain string) (string, error) {
 	addrs, err := net.DefaultResolver.LookupHost(context.Background(), domain)
+	CountQuery("system", err)
 	if nil == err && len(addrs) > 0 {
 		return addrs[0], nil
 	}
@@ -50,6 +89,7 @@ func getIPByDefaultResolver(domain string) (string, error) {
 func DnsGetDoaminIP(domain string) (string, error) {
 	if nil != LocalDNS {
 		ips, err := LocalDNS.LookupA(domain)
+		CountQuery("local", err)
 		if len(ips) > 0 {
 			return pickIP(ips), err
 		}
@@ -57,24 +97,39 @@ func DnsGetDoaminIP(domain string) (string, error) {
 	return getIPByDefaultResolver(domain)
 }
 
-var CNIPSet *cip.CountryIPSet
-
 type LocalDNSConfig struct {
 	Listen     string
 	TrustedDNS []string
 	FastDNS    []string
 	CNIPSet    string
+	//answer A/AAAA queries by fake IPs mapped back to domains for exact routing
+	FakeIP FakeIPConfig
+	//IP sets of 'IsCountry:XX' rules, 'CNIPSet' is loaded as country 'CN'
+	CountryIP []CountryIPConfig
+	//answers of FastDNS are trusted if the IPs are in the countries, default ['CN']
+	FastDNSCountry []string
 }
 
 func Init(conf *LocalDNSConfig) {
-	cnipset, err := cip.LoadIPSet(conf.CNIPSet, "CN")
-	if nil != err {
-		logger.Error("Failed to load IP range file:%s with reason:%v", conf.CNIPSet, err)
-	} else {
-		CNIPSet = cnipset
+	if len(conf.CNIPSet) > 0 {
+		loadCountryIPFile("CN", conf.CNIPSet)
+	}
+	for _, c := range conf.CountryIP {
+		if len(c.File) > 0 {
+			loadCountryIPFile(c.Country, c.File)
+		}
+	}
+	fastDNSCountry := conf.FastDNSCountry
+	if len(fastDNSCountry) == 0 {
+		fastDNSCountry = []string{"CN"}
+	}
+	if err := InitFakeIP(&conf.FakeIP); nil != err {
+		logger.Error("[ERROR]Failed to init fake IP with reason:%v", err)
 	}
 	cfg := &fdns.Config{}
-	cfg.Listen = conf.Listen
+	if !FakeIPEnabled() {
+		cfg.Listen = conf.Listen
+	}
 	for _, s := range conf.FastDNS {
 		ss := fdns.ServerConfig{
 			Server:      s,
@@ -94,17 +149,16 @@ func Init(conf *LocalDNSConfig) {
 	cfg.MinTTL = 24 * 3600
 	cfg.DialTimeout = netx.DialTimeout
 	cfg.IsCNIP = func(ip net.IP) bool {
-		if nil == CNIPSet {
-			return false
-		}
-		return CNIPSet.IsInCountry(ip, "CN")
+		return IsInCountry(ip, fastDNSCountry...)
 	}
 	cfg.IsDomainPoisioned = func(domain string) int {
 		//conf.GFWList.Load()
 		return -1
 	}
 	LocalDNS, _ = fdns.NewTrustedDNS(cfg)
-	if len(conf.Listen) > 0 {
+	if len(conf.Listen) > 0 && FakeIPEnabled() {
+		startFakeIPDNS(conf.Listen)
+	} else if len(conf.Listen) > 0 {
 		go func() {
 			err := LocalDNS.Start()
 			if nil != err {
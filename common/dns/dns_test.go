@@ -0,0 +1,29 @@
+package dns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCountResponse(t *testing.T) {
+	ok, failed := dnsQueries.With("test", "ok"), dnsQueries.With("test", "error")
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	res := new(dns.Msg)
+	res.SetRcode(req, dns.RcodeNameError)
+	nxdomain, _ := res.Pack()
+	res.SetRcode(req, dns.RcodeServerFailure)
+	servfail, _ := res.Pack()
+	CountResponse("test", nxdomain, nil)
+	if ok.Value() != 1 || failed.Value() != 0 {
+		t.Fatalf("NXDOMAIN response should be counted as ok")
+	}
+	CountResponse("test", servfail, nil)
+	CountResponse("test", nxdomain[0:4], nil)
+	CountResponse("test", nil, errors.New("timeout"))
+	if ok.Value() != 1 || failed.Value() != 3 {
+		t.Fatalf("Unexpected counts ok:%d error:%d", ok.Value(), failed.Value())
+	}
+}
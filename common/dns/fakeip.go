@@ -0,0 +1,395 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+type FakeIPConfig struct {
+	//IPv4 pool like '198.18.0.0/15' to answer A queries, disabled if empty
+	Range string
+	//IPv6 pool to answer AAAA queries, AAAA queries get empty answers if not set
+	Range6 string
+	//domain patterns like '*.lan' answered by the real resolvers
+	Exclude []string
+	//file to keep the domain<->IP mapping across restarts
+	Persist string
+}
+
+const fakeIPTTL = 1
+const maxFakeIPPoolSize = 1 << 24
+
+type fakeIPPool struct {
+	network    *net.IPNet
+	size       uint64
+	next       uint64
+	ipToDomain map[string]string
+	domainToIP map[string]net.IP
+}
+
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if nil != err {
+		return nil, err
+	}
+	if ip4 := network.IP.To4(); nil != ip4 {
+		network.IP = ip4
+	}
+	ones, bits := network.Mask.Size()
+	size := uint64(maxFakeIPPoolSize)
+	if bits-ones < 25 {
+		//skip the network & broadcast address
+		size = (uint64(1) << uint(bits-ones)) - 2
+	}
+	if size < 1 || size > maxFakeIPPoolSize {
+		return nil, fmt.Errorf("Invalid fake IP range:%s", cidr)
+	}
+	return &fakeIPPool{
+		network:    network,
+		size:       size,
+		ipToDomain: make(map[string]string),
+		domainToIP: make(map[string]net.IP),
+	}, nil
+}
+
+func (p *fakeIPPool) ipAt(offset uint64) net.IP {
+	ip := make(net.IP, len(p.network.IP))
+	copy(ip, p.network.IP)
+	n := offset + 1
+	for i := len(ip) - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(ip[i]) + (n & 0xff)
+		ip[i] = byte(sum)
+		n = (n >> 8) + (sum >> 8)
+	}
+	return ip
+}
+
+func (p *fakeIPPool) offsetOf(ip net.IP) (uint64, bool) {
+	if ip4 := ip.To4(); nil != ip4 && len(p.network.IP) == net.IPv4len {
+		ip = ip4
+	}
+	if len(ip) != len(p.network.IP) || !p.network.Contains(ip) {
+		return 0, false
+	}
+	var n uint64
+	for i := range ip {
+		n = n<<8 | uint64(ip[i]-p.network.IP[i])
+		if n > p.size {
+			return 0, false
+		}
+	}
+	if n < 1 {
+		return 0, false
+	}
+	return n - 1, true
+}
+
+func (p *fakeIPPool) set(domain string, ip net.IP) {
+	if prev, exist := p.ipToDomain[ip.String()]; exist {
+		delete(p.domainToIP, prev)
+	}
+	if prev, exist := p.domainToIP[domain]; exist {
+		delete(p.ipToDomain, prev.String())
+	}
+	p.ipToDomain[ip.String()] = domain
+	p.domainToIP[domain] = ip
+}
+
+// the oldest allocated IP is recycled once the pool is exhausted
+func (p *fakeIPPool) allocate(domain string) (net.IP, bool) {
+	if ip, exist := p.domainToIP[domain]; exist {
+		return ip, false
+	}
+	ip := p.ipAt(p.next)
+	p.next = (p.next + 1) % p.size
+	p.set(domain, ip)
+	return ip, true
+}
+
+type fakeIPResolver struct {
+	mutex   sync.Mutex
+	v4      *fakeIPPool
+	v6      *fakeIPPool
+	exclude []string
+	persist string
+	dirty   bool
+}
+
+var fakeIP *fakeIPResolver
+
+func newFakeIPResolver(conf *FakeIPConfig) (*fakeIPResolver, error) {
+	r := &fakeIPResolver{persist: conf.Persist}
+	var err error
+	if r.v4, err = newFakeIPPool(conf.Range); nil != err {
+		return nil, err
+	}
+	if nil == r.v4.network.IP.To4() {
+		return nil, fmt.Errorf("Fake IP range:%s is not IPv4", conf.Range)
+	}
+	if len(conf.Range6) > 0 {
+		if r.v6, err = newFakeIPPool(conf.Range6); nil != err {
+			return nil, err
+		}
+		if len(r.v6.network.IP) != net.IPv6len {
+			return nil, fmt.Errorf("Fake IP range:%s is not IPv6", conf.Range6)
+		}
+	}
+	for _, pattern := range conf.Exclude {
+		r.exclude = append(r.exclude, strings.ToLower(pattern))
+	}
+	return r, nil
+}
+
+func (r *fakeIPResolver) excluded(domain string) bool {
+	for _, pattern := range r.exclude {
+		if matched, _ := filepath.Match(pattern, domain); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *fakeIPResolver) pool(qtype uint16) *fakeIPPool {
+	if qtype == dns.TypeA {
+		return r.v4
+	}
+	return r.v6
+}
+
+func (r *fakeIPResolver) lookup(domain string, qtype uint16) net.IP {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	pool := r.pool(qtype)
+	if nil == pool {
+		return nil
+	}
+	ip, created := pool.allocate(domain)
+	if created {
+		r.dirty = true
+		logger.Debug("Allocate fake IP:%s for domain:%s", ip, domain)
+	}
+	return ip
+}
+
+func (r *fakeIPResolver) domain(ip net.IP) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, pool := range []*fakeIPPool{r.v4, r.v6} {
+		if nil == pool {
+			continue
+		}
+		if _, ok := pool.offsetOf(ip); ok {
+			domain, exist := pool.ipToDomain[ip.String()]
+			return domain, exist
+		}
+	}
+	return "", false
+}
+
+// answer returns nil if the request should be resolved by real resolvers.
+func (r *fakeIPResolver) answer(req *dns.Msg) *dns.Msg {
+	if len(req.Question) != 1 {
+		return nil
+	}
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		return nil
+	}
+	domain := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+	if len(domain) == 0 || nil != net.ParseIP(domain) || r.excluded(domain) {
+		return nil
+	}
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.RecursionAvailable = true
+	ip := r.lookup(domain, q.Qtype)
+	if nil == ip {
+		//no IPv6 pool, the client would fallback to A query
+		return res
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: fakeIPTTL}
+	if q.Qtype == dns.TypeA {
+		res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: ip})
+	} else {
+		res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+	}
+	return res
+}
+
+func (r *fakeIPResolver) load() error {
+	content, err := ioutil.ReadFile(r.persist)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	//fake IP -> domain
+	var mapping map[string]string
+	if err = json.Unmarshal(content, &mapping); nil != err {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for ipStr, domain := range mapping {
+		ip := net.ParseIP(ipStr)
+		if nil == ip {
+			continue
+		}
+		for _, pool := range []*fakeIPPool{r.v4, r.v6} {
+			if nil == pool {
+				continue
+			}
+			if offset, ok := pool.offsetOf(ip); ok {
+				if ip4 := ip.To4(); nil != ip4 && pool == r.v4 {
+					ip = ip4
+				}
+				pool.set(domain, ip)
+				if offset >= pool.next {
+					pool.next = (offset + 1) % pool.size
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (r *fakeIPResolver) save() error {
+	r.mutex.Lock()
+	if !r.dirty {
+		r.mutex.Unlock()
+		return nil
+	}
+	mapping := make(map[string]string)
+	for _, pool := range []*fakeIPPool{r.v4, r.v6} {
+		if nil == pool {
+			continue
+		}
+		for ip, domain := range pool.ipToDomain {
+			mapping[ip] = domain
+		}
+	}
+	r.dirty = false
+	r.mutex.Unlock()
+	content, _ := json.Marshal(mapping)
+	tmp := r.persist + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); nil != err {
+		return err
+	}
+	return os.Rename(tmp, r.persist)
+}
+
+func (r *fakeIPResolver) persistLoop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := r.save(); nil != err {
+			logger.Error("[ERROR]Failed to save fake IP mapping:%s for reason:%v", r.persist, err)
+		}
+	}
+}
+
+// InitFakeIP enables answering A/AAAA queries by fake IPs.
+func InitFakeIP(conf *FakeIPConfig) error {
+	if len(conf.Range) == 0 {
+		fakeIP = nil
+		return nil
+	}
+	r, err := newFakeIPResolver(conf)
+	if nil != err {
+		return err
+	}
+	if len(r.persist) > 0 {
+		if err = r.load(); nil != err {
+			logger.Error("[ERROR]Failed to load fake IP mapping:%s for reason:%v", r.persist, err)
+		}
+		go r.persistLoop()
+	}
+	fakeIP = r
+	logger.Info("Answer DNS queries by fake IP range:%s %s", conf.Range, conf.Range6)
+	return nil
+}
+
+func FakeIPEnabled() bool {
+	return nil != fakeIP
+}
+
+// FakeIPDomain returns the domain mapped to the fake IP.
+func FakeIPDomain(host string) (string, bool) {
+	if nil == fakeIP {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if nil == ip {
+		return "", false
+	}
+	return fakeIP.domain(ip)
+}
+
+// FakeIPAnswer answers the raw DNS request by fake IPs if it's enabled and
+// the request is an A/AAAA query.
+func FakeIPAnswer(content []byte) ([]byte, bool) {
+	if nil == fakeIP {
+		return nil, false
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(content); nil != err {
+		return nil, false
+	}
+	res := fakeIP.answer(req)
+	if nil == res {
+		return nil, false
+	}
+	b, err := res.Pack()
+	if nil != err {
+		return nil, false
+	}
+	dnsQueries.Inc("fakeip", "ok")
+	return b, true
+}
+
+func serveFakeIPDNS(w dns.ResponseWriter, req *dns.Msg) {
+	res := fakeIP.answer(req)
+	if nil != res {
+		dnsQueries.Inc("fakeip", "ok")
+		w.WriteMsg(res)
+		return
+	}
+	content, err := req.Pack()
+	if nil == err {
+		content, err = LocalDNS.QueryRaw(content)
+		CountQuery("local", err)
+	}
+	if nil == err {
+		_, err = w.Write(content)
+	}
+	if nil != err {
+		logger.Error("[ERROR]Failed to query dns with reason:%v", err)
+		res = new(dns.Msg)
+		res.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(res)
+	}
+}
+
+// listen the local dns server in front of the trusted dns to answer fake IPs
+func startFakeIPDNS(listen string) {
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: listen, Net: network, Handler: dns.HandlerFunc(serveFakeIPDNS)}
+		go func() {
+			if err := server.ListenAndServe(); nil != err {
+				logger.Error("Failed to start dns server:%v", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	pool, err := newFakeIPPool("198.18.0.0/30")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if pool.size != 2 {
+		t.Fatalf("Unexpected pool size:%d", pool.size)
+	}
+	ip1, _ := pool.allocate("a.com")
+	ip2, _ := pool.allocate("b.com")
+	if ip1.String() != "198.18.0.1" || ip2.String() != "198.18.0.2" {
+		t.Fatalf("Unexpected fake IPs:%v %v", ip1, ip2)
+	}
+	if ip, created := pool.allocate("a.com"); created || !ip.Equal(ip1) {
+		t.Fatalf("Expected same fake IP for same domain")
+	}
+	//recycle the oldest one
+	ip3, _ := pool.allocate("c.com")
+	if !ip3.Equal(ip1) {
+		t.Fatalf("Expected recycled fake IP, got %v", ip3)
+	}
+	if _, exist := pool.domainToIP["a.com"]; exist {
+		t.Fatalf("Expected recycled domain removed")
+	}
+	if _, ok := pool.offsetOf(net.ParseIP("198.18.0.3")); ok {
+		t.Fatalf("Broadcast address should not in pool")
+	}
+
+	pool6, err := newFakeIPPool("fd00::/64")
+	if nil != err {
+		t.Fatal(err)
+	}
+	ip, _ := pool6.allocate("a.com")
+	if ip.String() != "fd00::1" {
+		t.Fatalf("Unexpected fake IPv6:%v", ip)
+	}
+	if offset, ok := pool6.offsetOf(pool6.ipAt(0x1ff)); !ok || offset != 0x1ff {
+		t.Fatalf("Unexpected offset:%d", offset)
+	}
+}
+
+func TestFakeIPAnswer(t *testing.T) {
+	defer InitFakeIP(&FakeIPConfig{})
+	if err := InitFakeIP(&FakeIPConfig{Range: "198.18.0.0/16", Exclude: []string{"*.lan"}}); nil != err {
+		t.Fatal(err)
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(name), qtype)
+		content, _ := req.Pack()
+		b, ok := FakeIPAnswer(content)
+		if !ok {
+			return nil
+		}
+		res := new(dns.Msg)
+		if err := res.Unpack(b); nil != err {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res := query("WWW.Example.com", dns.TypeA)
+	if nil == res || len(res.Answer) != 1 {
+		t.Fatalf("Expected fake A answer")
+	}
+	ip := res.Answer[0].(*dns.A).A.String()
+	if domain, ok := FakeIPDomain(ip); !ok || domain != "www.example.com" {
+		t.Fatalf("Unexpected domain:%s for fake IP:%s", domain, ip)
+	}
+	if res = query("www.example.com", dns.TypeAAAA); nil == res || len(res.Answer) != 0 {
+		t.Fatalf("Expected empty AAAA answer without IPv6 pool")
+	}
+	if nil != query("nas.lan", dns.TypeA) || nil != query("example.com", dns.TypeMX) {
+		t.Fatalf("Expected excluded domain & non A/AAAA query not answered")
+	}
+	if _, ok := FakeIPDomain("198.18.9.9"); ok {
+		t.Fatalf("Expected no domain for unallocated fake IP")
+	}
+}
+
+func TestFakeIPPersist(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fakeip")
+	defer os.RemoveAll(dir)
+	conf := &FakeIPConfig{Range: "198.18.0.0/16", Range6: "fd00::/64", Persist: filepath.Join(dir, "fakeip.json")}
+	r, err := newFakeIPResolver(conf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	ip4 := r.lookup("a.com", dns.TypeA)
+	ip6 := r.lookup("a.com", dns.TypeAAAA)
+	if err = r.save(); nil != err {
+		t.Fatal(err)
+	}
+
+	r, _ = newFakeIPResolver(conf)
+	if err = r.load(); nil != err {
+		t.Fatal(err)
+	}
+	if domain, ok := r.domain(ip4); !ok || domain != "a.com" {
+		t.Fatalf("Expected persisted IPv4 mapping")
+	}
+	if domain, ok := r.domain(ip6); !ok || domain != "a.com" {
+		t.Fatalf("Expected persisted IPv6 mapping")
+	}
+	if ip := r.lookup("b.com", dns.TypeA); ip.Equal(ip4) {
+		t.Fatalf("Expected new fake IP after loaded ones")
+	}
+}
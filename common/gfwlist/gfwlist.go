@@ -1,7 +1,6 @@
 package gfwlist
 
 import (
-	"bufio"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
@@ -14,175 +13,164 @@ import (
 	"time"
 
 	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/route"
 )
 
-type hostWildcardRule struct {
-	pattern string
+// rules compiled into a domain trie for the domain rules & a bucketed regex set
+// for the url rules
+type ruleIndex struct {
+	hosts *route.DomainTrie
+	urls  *route.RegexSet
+	rules []string
 }
 
-func (r *hostWildcardRule) match(req *http.Request) bool {
-	if strings.Contains(req.Host, r.pattern) {
-		return true
+func newRuleIndex() *ruleIndex {
+	return &ruleIndex{
+		hosts: route.NewDomainTrie(),
+		urls:  route.NewRegexSet(),
 	}
-	return false
 }
 
-type urlWildcardRule struct {
-	pattern     string
-	prefixMatch bool
-}
-
-func (r *urlWildcardRule) match(req *http.Request) bool {
-	if len(req.URL.Scheme) == 0 {
-		req.URL.Scheme = "https"
-	}
-	if r.prefixMatch {
-		return strings.HasPrefix(req.URL.String(), r.pattern)
+func wildcardToRegex(pattern string) string {
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
 	}
-	return strings.Contains(req.URL.String(), r.pattern)
+	return strings.Join(parts, ".*")
 }
 
-type regexRule struct {
-	pattern string
+func isDomain(s string) bool {
+	return strings.Contains(s, ".") && !strings.ContainsAny(s, "*/:?[]|")
 }
 
-func (r *regexRule) match(req *http.Request) bool {
-	if len(req.URL.Scheme) == 0 {
-		req.URL.Scheme = "https"
+func (idx *ruleIndex) add(text string, rule string) error {
+	err := idx.compile(rule, len(idx.rules))
+	if nil == err {
+		idx.rules = append(idx.rules, text)
 	}
-	matched, err := regexp.MatchString(r.pattern, req.URL.String())
-	if nil != err {
-		logger.Error("Invalid regex pattern:%s wiuth reason:%v", r.pattern, err)
-	}
-	return matched
+	return err
 }
 
-type whiteListRule struct {
-	r gfwListRule
+func (idx *ruleIndex) compile(rule string, v int) error {
+	if strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") && len(rule) > 1 {
+		return idx.urls.Add(rule[1:len(rule)-1], v)
+	}
+	if pos := strings.Index(rule, "$"); pos > 0 {
+		rule = rule[0:pos]
+	}
+	rule = strings.TrimSuffix(rule, "^")
+	if strings.HasPrefix(rule, "||") {
+		rule = rule[2:]
+		if domain := strings.ToLower(rule); isDomain(domain) {
+			idx.hosts.AddSuffix(domain, v)
+			return nil
+		}
+		return idx.urls.Add(`^[\w\-]+://([^/]*\.)?`+wildcardToRegex(rule), v)
+	}
+	if strings.HasPrefix(rule, "|") {
+		return idx.urls.Add("^"+wildcardToRegex(rule[1:]), v)
+	}
+	if domain := strings.ToLower(strings.TrimPrefix(rule, ".")); isDomain(domain) {
+		idx.hosts.AddSuffix(domain, v)
+		return nil
+	}
+	return idx.urls.Add(wildcardToRegex(rule), v)
 }
 
-func (r *whiteListRule) match(req *http.Request) bool {
-	return r.r.match(req)
+// match returns the first rule in order matching the host or url, the domain
+// rules go first.
+func (idx *ruleIndex) match(host string, url string) (string, bool) {
+	matched := -1
+	lowest := func(v int) {
+		if matched < 0 || v < matched {
+			matched = v
+		}
+	}
+	idx.hosts.Lookup(host, lowest)
+	if matched < 0 {
+		//the regex set is bucketed, the hits are not in the order of the rules
+		idx.urls.Match(url, func(v int) bool {
+			lowest(v)
+			return true
+		})
+	}
+	if matched < 0 {
+		return "", false
+	}
+	return idx.rules[matched], true
 }
 
-type gfwListRule interface {
-	match(req *http.Request) bool
+type GFWList struct {
+	block *ruleIndex
+	white *ruleIndex
+	mutex sync.RWMutex
 }
 
-type GFWList struct {
-	ruleMap  map[string]gfwListRule
-	ruleList []gfwListRule
-	mutex    sync.Mutex
+func newGFWList() *GFWList {
+	return &GFWList{
+		block: newRuleIndex(),
+		white: newRuleIndex(),
+	}
 }
 
 func (gfw *GFWList) clone(n *GFWList) {
 	gfw.mutex.Lock()
 	defer gfw.mutex.Unlock()
-	gfw.ruleList = n.ruleList
+	gfw.block = n.block
+	gfw.white = n.white
 }
 
-func (gfw *GFWList) FastMatchDoamin(req *http.Request) (bool, bool) {
-	domain := req.Host
-	rootDomain := domain
-	if strings.Contains(domain, ":") {
-		domain, _, _ = net.SplitHostPort(domain)
-		rootDomain = domain
+// Add compiles the rule into the list, the comments & invalid rules are ignored.
+func (gfw *GFWList) Add(rule string) {
+	rule = strings.TrimSpace(rule)
+	if strings.HasPrefix(rule, "!") || len(rule) == 0 || strings.HasPrefix(rule, "[") {
+		return
 	}
-
-	rule, exist := gfw.ruleMap[domain]
-	if !exist {
-		ss := strings.Split(domain, ".")
-		if len(ss) > 2 {
-			rootDomain = ss[len(ss)-2] + "." + ss[len(ss)-1]
-			if len(ss[len(ss)-2]) < 4 && len(ss) >= 3 {
-				rootDomain = ss[len(ss)-3] + "." + rootDomain
-			}
-		}
-		rule, exist = gfw.ruleMap[rootDomain]
+	gfw.mutex.Lock()
+	defer gfw.mutex.Unlock()
+	text := rule
+	idx := gfw.block
+	if strings.HasPrefix(rule, "@@") {
+		rule = rule[2:]
+		idx = gfw.white
 	}
-	if exist {
-		matched := rule.match(req)
-		if _, ok := rule.(*whiteListRule); ok {
-			return !matched, true
-		}
-		return matched, true
+	if err := idx.add(text, rule); nil != err {
+		logger.Error("[ERROR]Invalid GFWList rule:%s with reason:%v", rule, err)
 	}
-	return false, false
 }
 
 func (gfw *GFWList) IsBlockedByGFW(req *http.Request) bool {
-	gfw.mutex.Lock()
-	defer gfw.mutex.Unlock()
+	blocked, _ := gfw.MatchedRule(req)
+	return blocked
+}
 
-	fastMatchResult, exist := gfw.FastMatchDoamin(req)
-	if exist {
-		return fastMatchResult
+// MatchedRule returns whether the request is blocked & the rule deciding it,
+// which is a '@@' rule if the request is in the white list.
+func (gfw *GFWList) MatchedRule(req *http.Request) (bool, string) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
 	}
+	host = strings.ToLower(host)
+	u := *req.URL
+	if len(u.Scheme) == 0 {
+		u.Scheme = "https"
+	}
+	url := u.String()
 
-	for _, rule := range gfw.ruleList {
-		if rule.match(req) {
-			if _, ok := rule.(*whiteListRule); ok {
-				//log.Printf("#### %s is in whilte list %v", req.Host, rule.(*whiteListRule).r)
-				return false
-			}
-			return true
-		}
+	gfw.mutex.RLock()
+	defer gfw.mutex.RUnlock()
+	if rule, matched := gfw.white.match(host, url); matched {
+		return false, rule
 	}
-	return false
+	rule, matched := gfw.block.match(host, url)
+	return matched, rule
 }
 
 func Parse(rules string) (*GFWList, error) {
-	reader := bufio.NewReader(strings.NewReader(rules))
-	gfw := new(GFWList)
-	gfw.ruleMap = make(map[string]gfwListRule)
-	//i := 0
-	for {
-		line, _, err := reader.ReadLine()
-		if nil != err {
-			break
-		}
-		str := strings.TrimSpace(string(line))
-		//comment
-		if strings.HasPrefix(str, "!") || len(str) == 0 || strings.HasPrefix(str, "[") {
-			continue
-		}
-		var rule gfwListRule
-		isWhileListRule := false
-		fastMatch := false
-		if strings.HasPrefix(str, "@@") {
-			str = str[2:]
-			isWhileListRule = true
-		}
-		if strings.HasPrefix(str, "/") && strings.HasSuffix(str, "/") {
-			str = str[1 : len(str)-1]
-			rule = &regexRule{str}
-		} else {
-			if strings.HasPrefix(str, "||") {
-				str = str[2:]
-				rule = &hostWildcardRule{str}
-				fastMatch = true
-			} else if strings.HasPrefix(str, "|") {
-				rule = &urlWildcardRule{str[1:], true}
-			} else {
-				if !strings.Contains(str, "/") {
-					fastMatch = true
-					rule = &hostWildcardRule{str}
-					if strings.HasPrefix(str, ".") {
-						str = str[1:]
-					}
-				} else {
-					rule = &urlWildcardRule{str, false}
-				}
-			}
-		}
-		if isWhileListRule {
-			rule = &whiteListRule{rule}
-		}
-		if fastMatch {
-			gfw.ruleMap[str] = rule
-		} else {
-			gfw.ruleList = append(gfw.ruleList, rule)
-		}
+	gfw := newGFWList()
+	for _, line := range strings.Split(rules, "\n") {
+		gfw.Add(line)
 	}
 	return gfw, nil
 }
@@ -195,6 +183,13 @@ func ParseRaw(rules string) (*GFWList, error) {
 	return Parse(string(content))
 }
 
+func NewFromString(rules string, base64Encoded bool) (*GFWList, error) {
+	if base64Encoded {
+		return ParseRaw(rules)
+	}
+	return Parse(rules)
+}
+
 func NewGFWList(u string, hc *http.Client, userRules []string, cacheFile string, watch bool) (*GFWList, error) {
 	// hc := &http.Client{}
 	// if len(proxy) > 0 {
@@ -1,15 +1,19 @@
 package gfwlist
 
 import (
+	"encoding/base64"
+	"fmt"
 	"log"
 	"net/http"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestGFWList(t *testing.T) {
 	userRules := []string{"||4ter2n.com", "|https://85.17.73.31/"}
-	gfwlist, err := NewGFWList("https://raw.githubusercontent.com/gfwlist/gfwlist/master/gfwlist.txt", "", userRules, "gfwlist.txt", false)
+	gfwlist, err := NewGFWList("https://raw.githubusercontent.com/gfwlist/gfwlist/master/gfwlist.txt", http.DefaultClient, userRules, "gfwlist.txt", false)
 	if nil != err {
 		log.Printf("#####%v", err)
 		return
@@ -22,3 +26,138 @@ func TestGFWList(t *testing.T) {
 	v := gfwlist.IsBlockedByGFW(req)
 	log.Printf("#####match %v %v", v, time.Now().Sub(s1))
 }
+
+func TestCompiledRules(t *testing.T) {
+	content := `[AutoProxy 0.2.9]
+! comment
+||google.com
+|https://85.17.73.31/
+.twitter.com
+@@||mail.google.com
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+example.org/search
+||*.cdn.com
+`
+	gfw, err := Parse(content)
+	if nil != err {
+		t.Fatal(err)
+	}
+	gfw.Add("||4ter2n.com")
+	for u, expected := range map[string]bool{
+		"https://www.google.com/":       true,
+		"https://google.com:443":        true,
+		"https://mail.google.com/":      false,
+		"https://notgoogle.com/":        false,
+		"https://85.17.73.31/index":     true,
+		"http://85.17.73.31/index":      false,
+		"https://api.Twitter.com/":      true,
+		"https://x.blogspot.com/":       true,
+		"http://www.example.org/search": true,
+		"http://www.example.org/":       false,
+		"http://a.cdn.com/":             true,
+		"http://a.4ter2n.com/":          true,
+	} {
+		req, _ := http.NewRequest("GET", u, nil)
+		if gfw.IsBlockedByGFW(req) != expected {
+			t.Fatalf("Unexpected result for %s", u)
+		}
+	}
+	req, _ := http.NewRequest("GET", "https://mail.google.com/", nil)
+	if blocked, rule := gfw.MatchedRule(req); blocked || rule != "@@||mail.google.com" {
+		t.Fatalf("Unexpected matched rule:%s", rule)
+	}
+	req, _ = http.NewRequest("GET", "https://x.blogspot.com/", nil)
+	if blocked, rule := gfw.MatchedRule(req); !blocked || rule != `/^https?:\/\/[^\/]+blogspot\.(.*)/` {
+		t.Fatalf("Unexpected matched rule:%s", rule)
+	}
+	raw, _ := NewFromString(base64.StdEncoding.EncodeToString([]byte(content)), true)
+	req, _ = http.NewRequest("CONNECT", "https://www.google.com", nil)
+	if nil == raw || !raw.IsBlockedByGFW(req) {
+		t.Fatalf("Unexpected result for base64 content")
+	}
+}
+
+func TestMatchedRuleInOrder(t *testing.T) {
+	//the regexes without a required literal are tried before the bucketed ones,
+	//& the buckets are tried in the order of their first rule
+	gfw, _ := Parse(`|http://www.blocked.example/
+/(?i)BLOCKED/
+/^http:\/\/[^\/]+\.example\/path/
+|http://www.blocked.example/path
+@@||allowed.example/path
+@@/(?i)ALLOWED/
+`)
+	for u, expected := range map[string]string{
+		"http://www.blocked.example/":     "|http://www.blocked.example/",
+		"https://www.blocked.example/":    "/(?i)BLOCKED/",
+		"http://www.other.example/path":   `/^http:\/\/[^\/]+\.example\/path/`,
+		"http://www.blocked.example/path": "|http://www.blocked.example/",
+		"http://a.allowed.example/path":   "@@||allowed.example/path",
+	} {
+		req, _ := http.NewRequest("GET", u, nil)
+		if _, rule := gfw.MatchedRule(req); rule != expected {
+			t.Fatalf("Unexpected matched rule:%s for %s", rule, u)
+		}
+	}
+}
+
+func benchmarkRules(n int) []string {
+	rules := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		switch i % 4 {
+		case 0:
+			rules = append(rules, fmt.Sprintf("||domain%d.com", i))
+		case 1:
+			rules = append(rules, fmt.Sprintf(".site%d.net", i))
+		case 2:
+			rules = append(rules, fmt.Sprintf("|http://host%d.org/path", i))
+		default:
+			rules = append(rules, fmt.Sprintf("/^https?:\\/\\/[^\\/]+blog%d\\.(.*)/", i))
+		}
+	}
+	return rules
+}
+
+// the matching of the rules before compiling, one by one in order
+func linearMatch(rules []string, req *http.Request) bool {
+	u := req.URL.String()
+	for _, rule := range rules {
+		switch {
+		case strings.HasPrefix(rule, "||"):
+			if strings.Contains(req.Host, rule[2:]) {
+				return true
+			}
+		case strings.HasPrefix(rule, "|"):
+			if strings.HasPrefix(u, rule[1:]) {
+				return true
+			}
+		case strings.HasPrefix(rule, "/"):
+			if matched, _ := regexp.MatchString(rule[1:len(rule)-1], u); matched {
+				return true
+			}
+		default:
+			if strings.Contains(req.Host, rule) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func BenchmarkLinearRules(b *testing.B) {
+	rules := benchmarkRules(5000)
+	req, _ := http.NewRequest("GET", "https://www.notblocked.com/", nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearMatch(rules, req)
+	}
+}
+
+func BenchmarkCompiledRules(b *testing.B) {
+	gfw, _ := Parse(strings.Join(benchmarkRules(5000), "\n"))
+	req, _ := http.NewRequest("GET", "https://www.notblocked.com/", nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gfw.IsBlockedByGFW(req)
+	}
+}
@@ -0,0 +1,30 @@
+package logger
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// LevelHandler serves GET /loglevel to show the levels and
+// POST /loglevel?level=info,channel=debug to change them.
+func LevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		spec := r.FormValue("level")
+		if len(spec) == 0 {
+			http.Error(w, "Log level required", http.StatusBadRequest)
+			return
+		}
+		if err := SetLevel(spec); nil != err {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Notice("Log level changed to %s", GetLevel())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, GetLevel())
+}
@@ -1,15 +1,155 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	//"github.com/fatih/color"
 	//"syscall"
 )
 
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	NoticeLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
+)
+
+var levelNames = []string{"debug", "info", "notice", "warn", "error", "fatal"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > FatalLevel {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warning" {
+		s = "warn"
+	}
+	for i, name := range levelNames {
+		if name == s {
+			return Level(i), nil
+		}
+	}
+	return DebugLevel, fmt.Errorf("Invalid log level:%s", s)
+}
+
+type Config struct {
+	//'stdout'/'console', 'color', 'syslog', 'syslog://host:port' or file path
+	Output []string
+	//min level with per-package overrides, e.g. 'info,channel=debug,dns=warn'
+	Level string
+	//write one JSON object per line instead of text
+	JSON bool
+	//rotation of the log files in Output
+	Rotate RotateConfig
+}
+
+type levelConfig struct {
+	level   Level
+	modules map[string]Level
+	//min level of the default & module levels
+	min Level
+}
+
+// parse the spec like 'info,channel=debug,dns=warn'
+func parseLevelSpec(spec string) (*levelConfig, error) {
+	lc := &levelConfig{level: DebugLevel, modules: make(map[string]Level)}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		if pos := strings.Index(item, "="); pos > 0 {
+			l, err := ParseLevel(item[pos+1:])
+			if nil != err {
+				return nil, err
+			}
+			lc.modules[strings.TrimSpace(item[0:pos])] = l
+		} else {
+			l, err := ParseLevel(item)
+			if nil != err {
+				return nil, err
+			}
+			lc.level = l
+		}
+	}
+	lc.min = lc.level
+	for _, l := range lc.modules {
+		if l < lc.min {
+			lc.min = l
+		}
+	}
+	return lc, nil
+}
+
+func (lc *levelConfig) String() string {
+	items := []string{lc.level.String()}
+	var modules []string
+	for m := range lc.modules {
+		modules = append(modules, m)
+	}
+	sort.Strings(modules)
+	for _, m := range modules {
+		items = append(items, m+"="+lc.modules[m].String())
+	}
+	return strings.Join(items, ",")
+}
+
+var currentLevel atomic.Value //*levelConfig
+
+func getLevelConfig() *levelConfig {
+	return currentLevel.Load().(*levelConfig)
+}
+
+// SetLevel changes the levels at runtime by a spec like 'info,channel=debug'.
+func SetLevel(spec string) error {
+	lc, err := parseLevelSpec(spec)
+	if nil != err {
+		return err
+	}
+	currentLevel.Store(lc)
+	return nil
+}
+
+func GetLevel() string {
+	return getLevelConfig().String()
+}
+
+// the package of a caller is the directory name of its source file
+func moduleOf(file string) string {
+	return filepath.Base(filepath.Dir(file))
+}
+
+func (lc *levelConfig) enabled(l Level, file string) bool {
+	if len(lc.modules) > 0 && len(file) > 0 {
+		if ml, exist := lc.modules[moduleOf(file)]; exist {
+			return l >= ml
+		}
+	}
+	return l >= lc.level
+}
+
+func enabled(l Level, file string) bool {
+	return getLevelConfig().enabled(l, file)
+}
+
 type colorConsoleWriter struct {
 	prefix  string
 	postfix string
@@ -26,137 +166,183 @@ func (writer *colorConsoleWriter) Write(p []byte) (n int, err error) {
 	return writer.w.Write(p)
 }
 
-type logFileWriter struct {
-	path string
-	file *os.File
+func IsDebugEnable() bool {
+	_, file, _, _ := runtime.Caller(1)
+	return enabled(DebugLevel, file)
 }
 
-func (writer *logFileWriter) close() {
-	if nil != writer.file {
-		writer.file.Close()
+// InitLogger keeps the level and format, and only changes the outputs.
+func InitLogger(output []string) {
+	outputMutex.Lock()
+	jsonMode, rotate := withJSON, rotateConf
+	outputMutex.Unlock()
+	if err := initOutputs(output, jsonMode, rotate); nil != err {
+		Error("[ERROR]%v", err)
 	}
 }
 
-func (writer *logFileWriter) Write(p []byte) (n int, err error) {
-	if nil != writer.file {
-		_, err := writer.file.Write(p)
-		if nil != err {
-			fmt.Printf("Failed to write logfile for reason:%v\n", err)
+func Init(conf Config) error {
+	if len(conf.Level) > 0 {
+		if err := SetLevel(conf.Level); nil != err {
+			return err
 		}
-		fi, err := writer.file.Stat()
-		//5MB
-		if nil == err && fi.Size() >= 1*1024*1024 {
-			os.Remove(writer.path + ".1")
-			writer.file.Close()
-			os.Rename(writer.path, writer.path+".1")
-			writer.file, _ = os.OpenFile(writer.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-		}
-	} else {
-		fmt.Printf("No log file inited for %s \n", writer.path)
 	}
-	return len(p), nil
+	return initOutputs(conf.Output, conf.JSON, conf.Rotate)
 }
 
-func initLogWriter(path string) *logFileWriter {
-	writer := new(logFileWriter)
-	writer.path = path
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	//fmt.Printf("file is %s\n", path)
-	if err != nil {
-		fmt.Println(err)
-	} else {
-		writer.file = file
-	}
-	return writer
-}
-
-func IsDebugEnable() bool {
-	return true
-}
-
-func InitLogger(output []string) {
-	withFile = false
+func initOutputs(output []string, jsonMode bool, rotate RotateConfig) error {
 	ws := make([]io.Writer, 0)
+	var syslogs []*syslogWriter
+	file := false
+	color := false
+	var err error
 	for _, name := range output {
-		if strings.EqualFold(name, "stdout") {
+		if strings.EqualFold(name, "stdout") || strings.EqualFold(name, "console") {
 			ws = append(ws, os.Stdout)
-			withFile = true
-		} else if strings.EqualFold(name, "console") {
-			ws = append(ws, os.Stdout)
-			withFile = true
+			file = true
 		} else if strings.EqualFold(name, "color") {
-			//ws = append(ws, os.Stderr)
-			withColorConsole = true
+			color = true
+		} else if strings.EqualFold(name, "syslog") || strings.HasPrefix(strings.ToLower(name), "syslog://") {
+			w, serr := newSyslogWriter(name)
+			if nil != serr {
+				err = serr
+				continue
+			}
+			syslogs = append(syslogs, w)
 		} else {
-			ws = append(ws, initLogWriter(name))
-			withFile = true
+			ws = append(ws, newLogFileWriter(name, rotate))
+			file = true
+		}
+	}
+	outputMutex.Lock()
+	prevSyslogs := syslogWriters
+	prevFiles := fileWriters
+	fileWriters = nil
+	for _, w := range ws {
+		if fw, ok := w.(*logFileWriter); ok {
+			fileWriters = append(fileWriters, fw)
 		}
 	}
+	withFile, withColorConsole, withJSON, rotateConf = file, color, jsonMode, rotate
+	syslogWriters = syslogs
 	if len(ws) > 0 {
 		log.SetOutput(io.MultiWriter(ws...))
 	}
+	flags := log.LstdFlags | log.Lshortfile
+	if jsonMode {
+		flags = 0
+	}
+	log.SetFlags(flags)
+	colorConsoleLogger.SetFlags(flags)
+	outputMutex.Unlock()
+	for _, w := range prevSyslogs {
+		w.close()
+	}
+	for _, w := range prevFiles {
+		w.close()
+	}
+	return err
 }
 
+var outputMutex sync.Mutex
 var withColorConsole bool
 var withFile bool
+var withJSON bool
+var rotateConf RotateConfig
+var fileWriters []*logFileWriter
+var syslogWriters []*syslogWriter
 var colorConsoleLogger *log.Logger
 
-func Debug(format string, v ...interface{}) {
-	if withFile {
-		log.Output(2, fmt.Sprintf(format, v...))
+type jsonRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Module  string `json:"module"`
+	Caller  string `json:"caller"`
+	Message string `json:"msg"`
+}
+
+func formatJSON(l Level, file string, line int, msg string) string {
+	r := jsonRecord{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Level:   l.String(),
+		Module:  moduleOf(file),
+		Caller:  fmt.Sprintf("%s:%d", filepath.Base(file), line),
+		Message: msg,
 	}
-	if withColorConsole {
-		colorConsoleLogger.Output(2, fmt.Sprintf(format, v...))
+	js, _ := json.Marshal(&r)
+	return string(js)
+}
+
+func output(l Level, format string, v ...interface{}) {
+	lc := getLevelConfig()
+	if l < lc.min {
+		return
+	}
+	outputMutex.Lock()
+	toFile, toColor, jsonMode, syslogs := withFile, withColorConsole, withJSON, syslogWriters
+	outputMutex.Unlock()
+	//the caller is only needed by module levels & JSON records
+	var file string
+	var line int
+	if len(lc.modules) > 0 || jsonMode {
+		_, file, line, _ = runtime.Caller(2)
+	}
+	if !lc.enabled(l, file) {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	for _, w := range syslogs {
+		w.write(l, msg)
+	}
+	if jsonMode {
+		msg = formatJSON(l, file, line, msg)
 	}
+	if toFile {
+		log.Output(3, msg)
+	}
+	if toColor {
+		switch l {
+		case NoticeLevel, WarnLevel:
+			setNoticeColor()
+			defer unsetNoticeColor()
+		case InfoLevel:
+			setINFOColor()
+			defer unsetINFOColor()
+		case ErrorLevel, FatalLevel:
+			setErrorColor()
+			defer unsetErrorColor()
+		}
+		colorConsoleLogger.Output(3, msg)
+	}
+}
 
+func Debug(format string, v ...interface{}) {
+	output(DebugLevel, format, v...)
 }
+
 func Notice(format string, v ...interface{}) {
-	if withFile {
-		log.Output(2, fmt.Sprintf(format, v...))
-	}
-	if withColorConsole {
-		setNoticeColor()
-		colorConsoleLogger.Output(2, fmt.Sprintf(format, v...))
-		unsetNoticeColor()
-	}
+	output(NoticeLevel, format, v...)
 }
 
 func Info(format string, v ...interface{}) {
-	if withFile {
-		log.Output(2, fmt.Sprintf(format, v...))
-	}
+	output(InfoLevel, format, v...)
+}
 
-	if withColorConsole {
-		setINFOColor()
-		colorConsoleLogger.Output(2, fmt.Sprintf(format, v...))
-		unsetINFOColor()
-	}
+func Warn(format string, v ...interface{}) {
+	output(WarnLevel, format, v...)
 }
 
 func Error(format string, v ...interface{}) {
-	if withFile {
-		log.Output(2, fmt.Sprintf(format, v...))
-	}
-	if withColorConsole {
-		setErrorColor()
-		colorConsoleLogger.Output(2, fmt.Sprintf(format, v...))
-		unsetErrorColor()
-	}
+	output(ErrorLevel, format, v...)
 }
 
 func Fatal(format string, v ...interface{}) {
-	if withFile {
-		log.Output(2, fmt.Sprintf(format, v...))
-	}
-	if withColorConsole {
-		setErrorColor()
-		colorConsoleLogger.Output(2, fmt.Sprintf(format, v...))
-		unsetErrorColor()
-	}
+	output(FatalLevel, format, v...)
 	os.Exit(1)
 }
 
 func init() {
+	currentLevel.Store(&levelConfig{level: DebugLevel, modules: make(map[string]Level)})
 	logFlag := log.LstdFlags | log.Lshortfile
 	log.SetFlags(logFlag)
 	log.SetOutput(os.Stdout)
@@ -0,0 +1,117 @@
+package logger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLevelSpec(t *testing.T) {
+	lc, err := parseLevelSpec("info, channel=debug,dns=WARNING")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if lc.level != InfoLevel || lc.modules["channel"] != DebugLevel || lc.modules["dns"] != WarnLevel {
+		t.Fatalf("Unexpected level config:%s", lc)
+	}
+	if lc.String() != "info,channel=debug,dns=warn" || lc.min != DebugLevel {
+		t.Fatalf("Unexpected level spec:%s", lc)
+	}
+	if lc, _ = parseLevelSpec("warn,dns=error"); lc.min != WarnLevel {
+		t.Fatalf("Unexpected min level:%s", lc.min)
+	}
+	if _, err := parseLevelSpec("info,dns=verbose"); nil == err {
+		t.Fatalf("Expected error for invalid level")
+	}
+}
+
+func TestModuleLevel(t *testing.T) {
+	defer SetLevel("debug")
+	if err := SetLevel("warn,logger=debug,dns=error"); nil != err {
+		t.Fatal(err)
+	}
+	if !enabled(DebugLevel, "/src/common/logger/log.go") {
+		t.Fatalf("Expected debug enabled for module override")
+	}
+	if enabled(WarnLevel, "/src/common/dns/dns.go") || !enabled(ErrorLevel, "/src/common/dns/dns.go") {
+		t.Fatalf("Unexpected level for dns")
+	}
+	if enabled(InfoLevel, "/src/local/proxy.go") || !enabled(WarnLevel, "/src/local/proxy.go") {
+		t.Fatalf("Unexpected default level")
+	}
+	if !IsDebugEnable() {
+		t.Fatalf("Expected debug enabled for caller")
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+	defer Init(Config{Output: []string{"stdout"}, Level: "debug"})
+	if err := Init(Config{Output: []string{path}, Level: "info", JSON: true}); nil != err {
+		t.Fatal(err)
+	}
+	Debug("hidden")
+	Warn("hello %d", 1)
+	content, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line, got %q", content)
+	}
+	var r jsonRecord
+	if err := json.Unmarshal([]byte(lines[0]), &r); nil != err {
+		t.Fatal(err)
+	}
+	if r.Level != "warn" || r.Module != "logger" || r.Message != "hello 1" || !strings.HasPrefix(r.Caller, "log_test.go:") {
+		t.Fatalf("Unexpected record:%+v", r)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+	w := newLogFileWriter(path, RotateConfig{MaxSizeMB: 1, MaxBackups: 2, Daily: true})
+	defer w.close()
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.Local)
+	w.now = func() time.Time { return now }
+	w.opened = now
+
+	line := make([]byte, 512*1024)
+	for i := 0; i < 6; i++ {
+		w.Write(line)
+	}
+	for _, p := range []string{path + ".1", path + ".2"} {
+		if _, err := os.Stat(p); nil != err {
+			t.Fatalf("Expected backup %s", p)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); nil == err {
+		t.Fatalf("Expected at most 2 backups")
+	}
+
+	w.Write([]byte("a\n"))
+	now = now.Add(24 * time.Hour)
+	w.Write([]byte("b\n"))
+	content, _ := ioutil.ReadFile(path)
+	if string(content) != "b\n" {
+		t.Fatalf("Expected daily rotation, got %q", content)
+	}
+	backup, _ := ioutil.ReadFile(path + ".1")
+	if string(backup) != "a\n" {
+		t.Fatalf("Unexpected backup content %q", backup)
+	}
+}
+
+func BenchmarkDisabledLevel(b *testing.B) {
+	defer SetLevel("debug")
+	SetLevel("error")
+	for i := 0; i < b.N; i++ {
+		Debug("hidden %d", i)
+	}
+}
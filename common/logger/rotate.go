@@ -0,0 +1,134 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type RotateConfig struct {
+	//rotate the log file once it exceeds the size in MB, default 1
+	MaxSizeMB int
+	//also rotate the log file at the first write of every day
+	Daily bool
+	//number of rotated files kept as 'path.1'...'path.N', default 1
+	MaxBackups int
+	//remove rotated files older than the days, 0 to keep them
+	MaxAgeDays int
+}
+
+func (conf RotateConfig) maxSize() int64 {
+	if conf.MaxSizeMB <= 0 {
+		return 1 * 1024 * 1024
+	}
+	return int64(conf.MaxSizeMB) * 1024 * 1024
+}
+
+func (conf RotateConfig) maxBackups() int {
+	if conf.MaxBackups <= 0 {
+		return 1
+	}
+	return conf.MaxBackups
+}
+
+type logFileWriter struct {
+	path   string
+	conf   RotateConfig
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	now    func() time.Time
+}
+
+func (writer *logFileWriter) close() {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if nil != writer.file {
+		writer.file.Close()
+		writer.file = nil
+	}
+}
+
+func (writer *logFileWriter) open() error {
+	file, err := os.OpenFile(writer.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if nil != err {
+		return err
+	}
+	writer.file = file
+	writer.size = 0
+	writer.opened = writer.now()
+	if fi, err := file.Stat(); nil == err {
+		writer.size = fi.Size()
+		if writer.size > 0 {
+			writer.opened = fi.ModTime()
+		}
+	}
+	return nil
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+func (writer *logFileWriter) rotate() {
+	writer.file.Close()
+	writer.file = nil
+	n := writer.conf.maxBackups()
+	os.Remove(backupPath(writer.path, n))
+	for i := n - 1; i >= 1; i-- {
+		os.Rename(backupPath(writer.path, i), backupPath(writer.path, i+1))
+	}
+	os.Rename(writer.path, backupPath(writer.path, 1))
+	if writer.conf.MaxAgeDays > 0 {
+		deadline := writer.now().Add(-time.Duration(writer.conf.MaxAgeDays) * 24 * time.Hour)
+		for i := 1; i <= n; i++ {
+			fi, err := os.Stat(backupPath(writer.path, i))
+			if nil == err && fi.ModTime().Before(deadline) {
+				os.Remove(backupPath(writer.path, i))
+			}
+		}
+	}
+	if err := writer.open(); nil != err {
+		fmt.Printf("Failed to open logfile for reason:%v\n", err)
+	}
+}
+
+func sameDay(a, b time.Time) bool {
+	y1, m1, d1 := a.Date()
+	y2, m2, d2 := b.Date()
+	return y1 == y2 && m1 == m2 && d1 == d2
+}
+
+func (writer *logFileWriter) Write(p []byte) (n int, err error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if nil == writer.file {
+		fmt.Printf("No log file inited for %s \n", writer.path)
+		return len(p), nil
+	}
+	if writer.conf.Daily && writer.size > 0 && !sameDay(writer.opened, writer.now()) {
+		writer.rotate()
+		if nil == writer.file {
+			return len(p), nil
+		}
+	}
+	n, err = writer.file.Write(p)
+	writer.size += int64(n)
+	if nil != err {
+		fmt.Printf("Failed to write logfile for reason:%v\n", err)
+	}
+	if writer.size >= writer.conf.maxSize() {
+		writer.rotate()
+	}
+	return len(p), nil
+}
+
+func newLogFileWriter(path string, conf RotateConfig) *logFileWriter {
+	writer := &logFileWriter{path: path, conf: conf, now: time.Now}
+	if err := writer.open(); nil != err {
+		fmt.Println(err)
+	}
+	return writer
+}
@@ -0,0 +1,55 @@
+// +build !windows
+
+package logger
+
+import (
+	"log/syslog"
+	"net/url"
+	"strings"
+)
+
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// 'syslog' for the local daemon, 'syslog://host:port' for udp and
+// 'syslog://host:port?tcp' for tcp
+func newSyslogWriter(name string) (*syslogWriter, error) {
+	var network, addr string
+	if strings.HasPrefix(strings.ToLower(name), "syslog://") {
+		u, err := url.Parse(name)
+		if nil != err {
+			return nil, err
+		}
+		network, addr = "udp", u.Host
+		if u.RawQuery == "tcp" {
+			network = "tcp"
+		}
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "gsnova")
+	if nil != err {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (writer *syslogWriter) write(l Level, msg string) {
+	switch l {
+	case DebugLevel:
+		writer.w.Debug(msg)
+	case InfoLevel:
+		writer.w.Info(msg)
+	case NoticeLevel:
+		writer.w.Notice(msg)
+	case WarnLevel:
+		writer.w.Warning(msg)
+	case ErrorLevel:
+		writer.w.Err(msg)
+	default:
+		writer.w.Crit(msg)
+	}
+}
+
+func (writer *syslogWriter) close() {
+	writer.w.Close()
+}
@@ -0,0 +1,17 @@
+// +build windows
+
+package logger
+
+import "errors"
+
+type syslogWriter struct{}
+
+func newSyslogWriter(name string) (*syslogWriter, error) {
+	return nil, errors.New("Syslog is not supported on windows")
+}
+
+func (writer *syslogWriter) write(l Level, msg string) {
+}
+
+func (writer *syslogWriter) close() {
+}
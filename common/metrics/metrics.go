@@ -0,0 +1,256 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var DefaultRTTBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.2, 0.3, 0.5, 1, 2, 5} //seconds
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var registry struct {
+	sync.Mutex
+	collectors []collector
+}
+
+func register(c collector) {
+	registry.Lock()
+	registry.collectors = append(registry.collectors, c)
+	registry.Unlock()
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabelValue(extra[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+type labeled struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	keys   []string
+	values map[string][]string
+}
+
+func (l *labeled) key(lvs []string) string {
+	if len(lvs) != len(l.labels) {
+		panic(fmt.Sprintf("metric %s requires %d label values, got %d", l.name, len(l.labels), len(lvs)))
+	}
+	return strings.Join(lvs, "\xff")
+}
+
+func (l *labeled) sortedKeys() []string {
+	keys := make([]string, len(l.keys))
+	copy(keys, l.keys)
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	value int64
+}
+
+func (c *Counter) Add(delta int64) {
+	atomic.AddInt64(&c.value, delta)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+type CounterVec struct {
+	labeled
+	counters map[string]*Counter
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{counters: make(map[string]*Counter)}
+	c.name, c.help, c.labels = name, help, labels
+	c.values = make(map[string][]string)
+	register(c)
+	return c
+}
+
+// With returns the counter of the label values, it could be kept by callers
+// in hot path to avoid the lookup.
+func (c *CounterVec) With(lvs ...string) *Counter {
+	key := c.key(lvs)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	counter, exist := c.counters[key]
+	if !exist {
+		counter = &Counter{}
+		c.counters[key] = counter
+		c.keys = append(c.keys, key)
+		c.values[key] = append([]string(nil), lvs...)
+	}
+	return counter
+}
+
+func (c *CounterVec) Add(delta int64, lvs ...string) {
+	c.With(lvs...).Add(delta)
+}
+
+func (c *CounterVec) Inc(lvs ...string) {
+	c.With(lvs...).Inc()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, c.values[key]), c.counters[key].Value())
+	}
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+type HistogramVec struct {
+	labeled
+	buckets    []float64
+	histograms map[string]*Histogram
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{buckets: buckets, histograms: make(map[string]*Histogram)}
+	h.name, h.help, h.labels = name, help, labels
+	h.values = make(map[string][]string)
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) With(lvs ...string) *Histogram {
+	key := h.key(lvs)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	histogram, exist := h.histograms[key]
+	if !exist {
+		histogram = &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = histogram
+		h.keys = append(h.keys, key)
+		h.values[key] = append([]string(nil), lvs...)
+	}
+	return histogram
+}
+
+func (h *HistogramVec) Observe(v float64, lvs ...string) {
+	h.With(lvs...).Observe(v)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, key := range h.sortedKeys() {
+		lvs := h.values[key]
+		histogram := h.histograms[key]
+		histogram.mutex.Lock()
+		for i, upper := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, lvs, "le", formatValue(upper)), histogram.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, lvs, "le", "+Inf"), histogram.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, lvs), formatValue(histogram.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, lvs), histogram.count)
+		histogram.mutex.Unlock()
+	}
+}
+
+// GaugeFunc collects the current values by the callback on every scrape.
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func(emit func(value float64, lvs ...string))
+}
+
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, lvs ...string))) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	g.collect(func(value float64, lvs ...string) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, lvs), formatValue(value))
+	})
+}
+
+// WriteText writes all metrics in Prometheus text format.
+func WriteText(w io.Writer) {
+	registry.Lock()
+	collectors := make([]collector, len(registry.collectors))
+	copy(collectors, registry.collectors)
+	registry.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves GET /metrics.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteText(w)
+}
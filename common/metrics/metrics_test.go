@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Test requests.", "code")
+	counter.Inc("200")
+	counter.Add(2, "200")
+	counter.Inc(`5"0\0`)
+	histogram := NewHistogramVec("test_rtt_seconds", "Test rtt.", []float64{0.1, 1}, "server")
+	histogram.Observe(0.05, "s1")
+	histogram.Observe(0.5, "s1")
+	histogram.Observe(3, "s1")
+	NewGaugeFunc("test_sessions", "Test sessions.", nil, func(emit func(float64, ...string)) {
+		emit(7)
+	})
+
+	var buf bytes.Buffer
+	WriteText(&buf)
+	text := buf.String()
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{code="200"} 3`,
+		`test_requests_total{code="5\"0\\0"} 1`,
+		"# TYPE test_rtt_seconds histogram",
+		`test_rtt_seconds_bucket{server="s1",le="0.1"} 1`,
+		`test_rtt_seconds_bucket{server="s1",le="1"} 2`,
+		`test_rtt_seconds_bucket{server="s1",le="+Inf"} 3`,
+		`test_rtt_seconds_sum{server="s1"} 3.55`,
+		`test_rtt_seconds_count{server="s1"} 3`,
+		"# TYPE test_sessions gauge",
+		"test_sessions 7",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatalf("Missing line:%s in\n%s", line, text)
+		}
+	}
+}
@@ -6,6 +6,9 @@ const (
 	DefaultMuxCipherMethod         = "chacha20poly1305"
 	DefaultMuxInitialCipherCounter = uint64(47816489)
 	AuthOK                         = 1
+	AuthQuotaExceeded              = 2
+	ConnectOK                      = 1
+	ConnectFailed                  = 2
 
 	//GZipCompressor   = "gzip"
 
@@ -14,8 +17,21 @@ const (
 	HTTPMuxPullPeriodHeader   = "X-PullPeriod"
 )
 
+// error classes of ConnectResponse
+const (
+	ConnectErrGeneral         = "general"
+	ConnectErrNotAllowed      = "not-allowed"
+	ConnectErrNetUnreachable  = "net-unreachable"
+	ConnectErrHostUnreachable = "host-unreachable"
+	ConnectErrRefused         = "refused"
+	ConnectErrTimeout         = "timeout"
+	ConnectErrDNS             = "dns"
+)
+
 var (
 	ErrToolargeMessage = errors.New("too large message length")
 	ErrAuthFailed      = errors.New("auth failed")
+	ErrQuotaExceeded   = errors.New("traffic quota exceeded")
+	ErrNoCipherConfig  = errors.New("no cipher config for session")
 	ErrDataReadMissing = errors.New("auth failed")
 )
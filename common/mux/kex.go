@@ -0,0 +1,70 @@
+package mux
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyExchange is the ephemeral X25519 key pair of one side in auth, the
+// derived session key keeps past sessions secret even if the pre-shared key
+// leaks.
+type KeyExchange struct {
+	private []byte
+	Public  []byte
+}
+
+func NewKeyExchange() (*KeyExchange, error) {
+	k := &KeyExchange{private: make([]byte, curve25519.ScalarSize)}
+	if _, err := io.ReadFull(crand.Reader, k.private); nil != err {
+		return nil, err
+	}
+	var err error
+	k.Public, err = curve25519.X25519(k.private, curve25519.Basepoint)
+	if nil != err {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *KeyExchange) sessionKey(psk string, peerPub, clientPub, serverPub []byte) ([]byte, error) {
+	secret, err := curve25519.X25519(k.private, peerPub)
+	if nil != err {
+		return nil, err
+	}
+	info := []byte("gsnova session key")
+	info = append(info, clientPub...)
+	info = append(info, serverPub...)
+	key := make([]byte, 32)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, secret, []byte(psk), info), key); nil != err {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ClientKey derives the session key on client side by the server's public key.
+func (k *KeyExchange) ClientKey(psk string, serverPub []byte) ([]byte, error) {
+	return k.sessionKey(psk, serverPub, k.Public, serverPub)
+}
+
+// ServerKey derives the session key on server side by the client's public key.
+func (k *KeyExchange) ServerKey(psk string, clientPub []byte) ([]byte, error) {
+	return k.sessionKey(psk, clientPub, clientPub, k.Public)
+}
+
+// KexMAC authenticates the exchanged public keys by the pre-shared key.
+func KexMAC(psk string, clientPub, serverPub []byte) []byte {
+	h := hmac.New(sha256.New, []byte(psk))
+	h.Write([]byte("gsnova kex"))
+	h.Write(clientPub)
+	h.Write(serverPub)
+	return h.Sum(nil)
+}
+
+func VerifyKexMAC(psk string, clientPub, serverPub, mac []byte) bool {
+	return hmac.Equal(mac, KexMAC(psk, clientPub, serverPub))
+}
@@ -0,0 +1,32 @@
+package mux
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyExchange(t *testing.T) {
+	client, err := NewKeyExchange()
+	if nil != err {
+		t.Fatal(err)
+	}
+	server, _ := NewKeyExchange()
+	ck, err := client.ClientKey("psk", server.Public)
+	if nil != err {
+		t.Fatal(err)
+	}
+	sk, _ := server.ServerKey("psk", client.Public)
+	if len(ck) != 32 || !bytes.Equal(ck, sk) {
+		t.Fatalf("Both sides should derive same session key")
+	}
+	if wrong, _ := server.ServerKey("wrong", client.Public); bytes.Equal(ck, wrong) {
+		t.Fatalf("Session key should depend on pre-shared key")
+	}
+	mac := KexMAC("psk", client.Public, server.Public)
+	if !VerifyKexMAC("psk", client.Public, server.Public, mac) || VerifyKexMAC("wrong", client.Public, server.Public, mac) {
+		t.Fatalf("Unexpected kex MAC verify result")
+	}
+	if _, err = client.ClientKey("psk", make([]byte, 32)); nil == err {
+		t.Fatalf("Low order public key should be rejected")
+	}
+}
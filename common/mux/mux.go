@@ -2,12 +2,20 @@ package mux
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"os"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	quic "github.com/lucas-clemente/quic-go"
@@ -32,6 +40,78 @@ type ConnectRequest struct {
 	Hops        []string
 }
 
+// ConnectResponse is the dial result of a ConnectRequest, it's only sent if
+// both sides agree on ConnectAck in auth.
+type ConnectResponse struct {
+	Code   int
+	Class  string
+	Reason string
+}
+
+func (res *ConnectResponse) Error() error {
+	if ConnectOK == res.Code {
+		return nil
+	}
+	return &ConnectError{Class: res.Class, Reason: res.Reason}
+}
+
+// ConnectError is the error to connect the remote address of a stream.
+type ConnectError struct {
+	Class  string
+	Reason string
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connect failed(%s):%s", e.Class, e.Reason)
+}
+
+// NewConnectResponse creates the response for the dial result err.
+func NewConnectResponse(err error) *ConnectResponse {
+	if nil == err {
+		return &ConnectResponse{Code: ConnectOK}
+	}
+	return &ConnectResponse{Code: ConnectFailed, Class: ConnectErrorClass(err), Reason: err.Error()}
+}
+
+// ConnectErrorClass returns the error class of a failed connect/dial.
+func ConnectErrorClass(err error) string {
+	if nil == err {
+		return ""
+	}
+	if cerr, ok := err.(*ConnectError); ok {
+		return cerr.Class
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return ConnectErrDNS
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return ConnectErrTimeout
+	}
+	if oerr, ok := err.(*net.OpError); ok {
+		err = oerr.Err
+		if _, ok := err.(*net.DNSError); ok {
+			return ConnectErrDNS
+		}
+		if cerr, ok := err.(*ConnectError); ok {
+			return cerr.Class
+		}
+	}
+	if serr, ok := err.(*os.SyscallError); ok {
+		err = serr.Err
+	}
+	switch err {
+	case syscall.ECONNREFUSED:
+		return ConnectErrRefused
+	case syscall.EHOSTUNREACH:
+		return ConnectErrHostUnreachable
+	case syscall.ENETUNREACH:
+		return ConnectErrNetUnreachable
+	case syscall.ETIMEDOUT:
+		return ConnectErrTimeout
+	}
+	return ConnectErrGeneral
+}
+
 type AuthRequest struct {
 	Rand           string
 	User           string
@@ -43,18 +123,108 @@ type AuthRequest struct {
 	P2PConnID  string
 	P2PPriAddr string
 	P2PPubAddr string
+
+	//ask the server to send ConnectResponse for each stream
+	ConnectAck bool
+
+	//unix time & random nonce to resist replay, authenticated by MAC
+	Timestamp int64
+	Nonce     string
+	MAC       []byte
+
+	//client's ephemeral X25519 public key, empty if key exchange disabled
+	KexPub []byte
+}
+
+func (req *AuthRequest) mac(key string) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	fields := []string{req.Rand, req.User, req.CipherMethod, req.CompressMethod,
+		req.P2PToken, req.P2PConnID, req.P2PPriAddr, req.P2PPubAddr, req.Nonce}
+	for _, field := range fields {
+		binary.Write(h, binary.BigEndian, uint32(len(field)))
+		h.Write([]byte(field))
+	}
+	binary.Write(h, binary.BigEndian, req.CipherCounter)
+	binary.Write(h, binary.BigEndian, req.Timestamp)
+	binary.Write(h, binary.BigEndian, req.ConnectAck)
+	if len(req.KexPub) > 0 {
+		h.Write(req.KexPub)
+	}
+	return h.Sum(nil)
 }
+
+// Sign fills the Rand if it's empty, the Timestamp & Nonce, then
+// authenticates the request with the key.
+func (req *AuthRequest) Sign(key string) {
+	if len(req.Rand) == 0 {
+		req.Rand = newAuthRand()
+	}
+	nonce := make([]byte, 16)
+	crand.Read(nonce)
+	req.Nonce = hex.EncodeToString(nonce)
+	req.Timestamp = time.Now().Unix()
+	req.MAC = req.mac(key)
+}
+
+// VerifyMAC returns true if the request is signed by the key.
+func (req *AuthRequest) VerifyMAC(key string) bool {
+	if len(req.MAC) == 0 {
+		return false
+	}
+	return hmac.Equal(req.MAC, req.mac(key))
+}
+
 type AuthResponse struct {
 	Code        int
 	PeerPriAddr string
 	PeerPubAddr string
 	PubAddr     string
+	ConnectAck  bool
+	//the session cipher is switched to the key derived from the user key
+	UserCipher bool
+	//server's ephemeral X25519 public key & its MAC by the pre-shared key
+	KexPub []byte
+	KexMAC []byte
+	//signature by the server's long-term signing key
+	Signature []byte
+}
+
+func (res *AuthResponse) signedContent(req *AuthRequest) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("gsnova auth")
+	fields := [][]byte{[]byte(req.User), []byte(req.Rand), []byte(req.Nonce), req.KexPub,
+		[]byte(res.PeerPriAddr), []byte(res.PeerPubAddr), []byte(res.PubAddr), res.KexPub, res.KexMAC}
+	for _, field := range fields {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+	binary.Write(buf, binary.BigEndian, int64(res.Code))
+	binary.Write(buf, binary.BigEndian, res.ConnectAck)
+	binary.Write(buf, binary.BigEndian, res.UserCipher)
+	return buf.Bytes()
+}
+
+// Sign signs the response to the request by the server's signing key.
+func (res *AuthResponse) Sign(req *AuthRequest, key ed25519.PrivateKey) {
+	res.Signature = ed25519.Sign(key, res.signedContent(req))
+}
+
+// VerifySignature returns true if the response to the request is signed by
+// the server with the public key.
+func (res *AuthResponse) VerifySignature(req *AuthRequest, pub ed25519.PublicKey) bool {
+	if len(res.Signature) != ed25519.SignatureSize || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(pub, res.signedContent(req), res.Signature)
 }
 
 func (res *AuthResponse) Error() error {
 	if AuthOK == res.Code {
 		return nil
 	}
+	if AuthQuotaExceeded == res.Code {
+		return ErrQuotaExceeded
+	}
 	return ErrAuthFailed
 }
 
@@ -141,6 +311,12 @@ type ProxyMuxStream struct {
 	session      MuxSession
 	sessionID    int64
 	latestIOTime time.Time
+	//wait ConnectResponse after ConnectRequest
+	ConnectAck bool
+	//server url of the session which opens the stream
+	Server string
+	//reports the failed connect to the session which opens the stream
+	OnConnectFailure func()
 }
 
 func (s *ProxyMuxStream) OnIO(read bool) {
@@ -219,7 +395,17 @@ func (s *ProxyMuxStream) Close() error {
 	return s.TimeoutReadWriteCloser.Close()
 }
 
+// Connect closes the stream if the connect request failed, so that no caller
+// leaks the stream.
 func (s *ProxyMuxStream) Connect(network string, addr string, opt StreamOptions) error {
+	err := s.connect(network, addr, opt)
+	if nil != err {
+		s.Close()
+	}
+	return err
+}
+
+func (s *ProxyMuxStream) connect(network string, addr string, opt StreamOptions) error {
 	req := &ConnectRequest{
 		Network:     network,
 		Addr:        addr,
@@ -227,11 +413,28 @@ func (s *ProxyMuxStream) Connect(network string, addr string, opt StreamOptions)
 		ReadTimeout: opt.ReadTimeout,
 		Hops:        opt.Hops,
 	}
-	return WriteMessage(s, req)
+	err := WriteMessage(s, req)
+	if nil != err || !s.ConnectAck {
+		return err
+	}
+	dialTimeout := opt.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = 10000
+	}
+	s.SetReadDeadline(time.Now().Add(time.Duration(dialTimeout)*time.Millisecond + 5*time.Second))
+	res := &ConnectResponse{}
+	err = ReadMessage(s, res)
+	var zero time.Time
+	s.SetReadDeadline(zero)
+	if nil != err {
+		return err
+	}
+	return res.Error()
 }
 func (s *ProxyMuxStream) Auth(req *AuthRequest) *AuthResponse {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	req.Rand = helper.RandAsciiString(int(r.Int31n(128)))
+	if len(req.Rand) == 0 {
+		req.Rand = newAuthRand()
+	}
 	err := WriteMessage(s, req)
 	res := &AuthResponse{Code: -1}
 	if nil != err {
@@ -257,6 +460,18 @@ type ConnAddr interface {
 type ProxyMuxSession struct {
 	*pmux.Session
 	NetConn ConnAddr
+	//config the session created with, required by ResetCryptoKey
+	Config *pmux.Config
+}
+
+// ResetCryptoKey resets the session cipher like ResetCryptoContext but with
+// a new key.
+func (s *ProxyMuxSession) ResetCryptoKey(key []byte, method string, counter uint64) error {
+	if nil == s.Config {
+		return ErrNoCipherConfig
+	}
+	s.Config.CipherKey = key
+	return s.Session.ResetCryptoContext(method, counter)
 }
 
 func (s *ProxyMuxSession) CloseStream(stream MuxStream) error {
@@ -296,6 +511,22 @@ func (s *ProxyMuxSession) LocalAddr() net.Addr {
 	return nil
 }
 
+func newAuthRand() string {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	//Rand salts the user cipher key, keep it long enough
+	return helper.RandAsciiString(16 + int(r.Int31n(112)))
+}
+
+// DeriveUserCipherKey derives the session cipher key of the user from the
+// user's own key & the Rand of the auth request.
+func DeriveUserCipherKey(userKey string, req *AuthRequest) []byte {
+	h := hmac.New(sha256.New, []byte(userKey))
+	h.Write([]byte(req.User))
+	h.Write([]byte{0})
+	h.Write([]byte(req.Rand))
+	return h.Sum(nil)
+}
+
 func init() {
 	//msgpack.RegisterExt(1, (*AuthRequest)(nil))
 	// msgpack.RegisterExt(2, (*AuthResponse)(nil))
@@ -2,7 +2,11 @@ package mux
 
 import (
 	"bytes"
+	"io"
 	"log"
+	"net"
+	"os"
+	"syscall"
 	"testing"
 )
 
@@ -36,3 +40,58 @@ func TestXYZ(t *testing.T) {
 	// err := ReadMessage(&buffer, zz)
 	// log.Printf("#### %v %v", zz, err)
 }
+
+func TestConnectAck(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go func() {
+		for _, err := range []error{nil, &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}} {
+			if _, rerr := ReadConnectRequest(remote); nil != rerr {
+				return
+			}
+			WriteMessage(remote, NewConnectResponse(err))
+		}
+	}()
+	stream := &ProxyMuxStream{TimeoutReadWriteCloser: local, ConnectAck: true}
+	if err := stream.Connect("tcp", "example.com:80", StreamOptions{}); nil != err {
+		t.Fatalf("Unexpected connect error:%v", err)
+	}
+	err := stream.Connect("tcp", "example.com:81", StreamOptions{})
+	if ConnectErrorClass(err) != ConnectErrRefused {
+		t.Fatalf("Expected refused error, but got:%v", err)
+	}
+	if _, err := local.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("Expected the stream closed after connect failed, but got:%v", err)
+	}
+}
+
+func TestConnectErrorClass(t *testing.T) {
+	cases := map[error]string{
+		&net.DNSError{Err: "no such host", Name: "x"}:                                      ConnectErrDNS,
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}: ConnectErrHostUnreachable,
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}:  ConnectErrNetUnreachable,
+		&ConnectError{Class: ConnectErrNotAllowed}:                                         ConnectErrNotAllowed,
+		ErrAuthFailed: ConnectErrGeneral,
+	}
+	for err, class := range cases {
+		if c := ConnectErrorClass(err); c != class {
+			t.Fatalf("Expected class %s for %v, but got %s", class, err, c)
+		}
+	}
+}
+
+func TestDeriveUserCipherKey(t *testing.T) {
+	req := &AuthRequest{User: "abc", Rand: "0123456789abcdef"}
+	key := DeriveUserCipherKey("k1", req)
+	if len(key) != 32 || !bytes.Equal(key, DeriveUserCipherKey("k1", req)) {
+		t.Fatalf("Invalid user cipher key")
+	}
+	if bytes.Equal(key, DeriveUserCipherKey("k2", req)) {
+		t.Fatalf("User cipher key should depend on user key")
+	}
+	req2 := &AuthRequest{User: "abc", Rand: "0123456789abcdeg"}
+	if bytes.Equal(key, DeriveUserCipherKey("k1", req2)) {
+		t.Fatalf("User cipher key should depend on auth rand")
+	}
+}
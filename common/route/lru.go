@@ -0,0 +1,82 @@
+package route
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type lruEntry struct {
+	key    string
+	value  interface{}
+	expire time.Time
+}
+
+// LRU is a fixed capacity cache, entries expire after the ttl.
+type LRU struct {
+	mutex    sync.Mutex
+	capacity int
+	ttl      time.Duration
+	ll       *list.List
+	items    map[string]*list.Element
+	now      func() time.Time
+}
+
+func NewLRU(capacity int, ttl time.Duration) *LRU {
+	return &LRU{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+func (c *LRU) Get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, exist := c.items[key]
+	if !exist {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if c.ttl > 0 && c.now().After(entry.expire) {
+		c.ll.Remove(elem)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *LRU) Put(key string, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	expire := c.now().Add(c.ttl)
+	if elem, exist := c.items[key]; exist {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expire = expire
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key, value, expire})
+	for c.capacity > 0 && c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *LRU) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ll.Len()
+}
+
+func (c *LRU) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
@@ -0,0 +1,53 @@
+package route
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+type globPattern struct {
+	pattern string
+	v       int
+}
+
+// PatternIndex indexes the host patterns of filepath.Match, the exact & '*.'
+// prefixed patterns are looked up in a domain trie, others are matched one by one.
+type PatternIndex struct {
+	trie  *DomainTrie
+	any   []int
+	globs []globPattern
+}
+
+func NewPatternIndex() *PatternIndex {
+	return &PatternIndex{trie: NewDomainTrie()}
+}
+
+func isPlainDomain(s string) bool {
+	return len(s) > 0 && !strings.ContainsAny(s, "*?[]\\/") && s == strings.ToLower(s)
+}
+
+func (p *PatternIndex) Add(pattern string, v int) {
+	switch {
+	case pattern == "*":
+		p.any = append(p.any, v)
+	case strings.HasPrefix(pattern, "*.") && isPlainDomain(pattern[2:]):
+		p.trie.AddSubdomains(pattern[2:], v)
+	case isPlainDomain(pattern):
+		p.trie.AddExact(pattern, v)
+	default:
+		p.globs = append(p.globs, globPattern{pattern, v})
+	}
+}
+
+// Lookup calls f with the values of the patterns matching the lower case host.
+func (p *PatternIndex) Lookup(host string, f func(v int)) {
+	for _, v := range p.any {
+		f(v)
+	}
+	p.trie.Lookup(host, f)
+	for _, g := range p.globs {
+		if matched, _ := filepath.Match(g.pattern, host); matched {
+			f(g.v)
+		}
+	}
+}
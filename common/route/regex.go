@@ -0,0 +1,99 @@
+package route
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+type regexEntry struct {
+	re *regexp.Regexp
+	v  int
+}
+
+// RegexSet buckets regexes by the longest literal they require, so that only
+// the regexes whose literal is contained in the input are evaluated.
+type RegexSet struct {
+	buckets map[string][]regexEntry
+	keys    []string
+	always  []regexEntry
+}
+
+func NewRegexSet() *RegexSet {
+	return &RegexSet{buckets: make(map[string][]regexEntry)}
+}
+
+func literalOf(re *syntax.Regexp) string {
+	if re.Flags&syntax.FoldCase != 0 {
+		return ""
+	}
+	switch re.Op {
+	case syntax.OpLiteral:
+		return string(re.Rune)
+	case syntax.OpCapture, syntax.OpPlus:
+		return literalOf(re.Sub[0])
+	case syntax.OpConcat:
+		var longest string
+		for _, sub := range re.Sub {
+			if s := literalOf(sub); len(s) > len(longest) {
+				longest = s
+			}
+		}
+		return longest
+	}
+	return ""
+}
+
+// RequiredLiteral returns the longest literal any match of the regex contains.
+func RequiredLiteral(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if nil != err {
+		return ""
+	}
+	return literalOf(re.Simplify())
+}
+
+func (s *RegexSet) Add(expr string, v int) error {
+	re, err := regexp.Compile(expr)
+	if nil != err {
+		return err
+	}
+	entry := regexEntry{re, v}
+	key := RequiredLiteral(expr)
+	if len(key) == 0 {
+		s.always = append(s.always, entry)
+		return nil
+	}
+	if _, exist := s.buckets[key]; !exist {
+		s.keys = append(s.keys, key)
+	}
+	s.buckets[key] = append(s.buckets[key], entry)
+	return nil
+}
+
+func (s *RegexSet) Len() int {
+	n := len(s.always)
+	for _, entries := range s.buckets {
+		n += len(entries)
+	}
+	return n
+}
+
+// Match calls f with the values of the matched regexes until f returns false.
+func (s *RegexSet) Match(input string, f func(v int) bool) {
+	for _, entry := range s.always {
+		if entry.re.MatchString(input) && !f(entry.v) {
+			return
+		}
+	}
+	for _, key := range s.keys {
+		if !strings.Contains(input, key) {
+			continue
+		}
+		for _, entry := range s.buckets[key] {
+			if entry.re.MatchString(input) && !f(entry.v) {
+				return
+			}
+		}
+	}
+}
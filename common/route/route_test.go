@@ -0,0 +1,194 @@
+package route
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+)
+
+func lookupAll(f func(string, func(int)), host string) []int {
+	var vs []int
+	f(host, func(v int) {
+		vs = append(vs, v)
+	})
+	sort.Ints(vs)
+	return vs
+}
+
+func TestDomainTrie(t *testing.T) {
+	trie := NewDomainTrie()
+	trie.AddSuffix("google.com", 1)
+	trie.AddExact("mail.google.com", 2)
+	trie.AddSubdomains("youtube.com", 3)
+	for host, expected := range map[string]string{
+		"google.com":        "[1]",
+		"www.google.com":    "[1]",
+		"mail.google.com":   "[1 2]",
+		"a.mail.google.com": "[1]",
+		"notgoogle.com":     "[]",
+		"youtube.com":       "[]",
+		"m.youtube.com":     "[3]",
+		"com":               "[]",
+		"":                  "[]",
+	} {
+		if s := fmt.Sprint(lookupAll(trie.Lookup, host)); s != expected {
+			t.Fatalf("Unexpected result %s for %s", s, host)
+		}
+	}
+}
+
+func TestIPTree(t *testing.T) {
+	tree := NewIPTree()
+	for i, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "0.0.0.0/0", "2400:da00::/32"} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		tree.Add(ipnet, i)
+	}
+	for ip, expected := range map[string]string{
+		"10.1.2.3":        "[0 1 2]",
+		"10.2.0.1":        "[0 2]",
+		"8.8.8.8":         "[2]",
+		"::ffff:10.1.0.1": "[0 1 2]",
+		"2400:da00::1":    "[3]",
+		"2400:da01::1":    "[]",
+	} {
+		s := fmt.Sprint(lookupAll(func(host string, f func(int)) {
+			tree.Lookup(net.ParseIP(host), f)
+		}, ip))
+		if s != expected {
+			t.Fatalf("Unexpected result %s for %s", s, ip)
+		}
+	}
+}
+
+func TestRegexSet(t *testing.T) {
+	if RequiredLiteral(`^https?:\/\/[^\/]+blogspot\.(.*)`) != "blogspot." || RequiredLiteral(`(?i)abc`) != "" || RequiredLiteral(`a|b`) != "" {
+		t.Fatalf("Unexpected required literal")
+	}
+	set := NewRegexSet()
+	set.Add(`^https?:\/\/[^\/]+blogspot\.(.*)`, 1)
+	set.Add(`(?i)TWITTER`, 2)
+	set.Add(`google\.com/search`, 3)
+	if nil == set.Add(`(`, 4) || set.Len() != 3 {
+		t.Fatalf("Unexpected regex set")
+	}
+	var matched []int
+	set.Match("https://x.blogspot.com/twitter", func(v int) bool {
+		matched = append(matched, v)
+		return true
+	})
+	sort.Ints(matched)
+	if fmt.Sprint(matched) != "[1 2]" {
+		t.Fatalf("Unexpected matched regexes %v", matched)
+	}
+}
+
+func TestPatternIndex(t *testing.T) {
+	p := NewPatternIndex()
+	for i, pattern := range []string{"*.google.com", "google.com", "*", "*ggpht.com", "Yahoo.com", "a?.com"} {
+		p.Add(pattern, i)
+	}
+	for _, host := range []string{"google.com", "www.google.com", "lh3.ggpht.com", "yahoo.com", "ab.com", "abc.com"} {
+		var expected []int
+		for i, pattern := range []string{"*.google.com", "google.com", "*", "*ggpht.com", "Yahoo.com", "a?.com"} {
+			if matched, _ := filepath.Match(pattern, host); matched {
+				expected = append(expected, i)
+			}
+		}
+		if fmt.Sprint(lookupAll(p.Lookup, host)) != fmt.Sprint(expected) {
+			t.Fatalf("Unexpected result for %s", host)
+		}
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c := NewLRU(2, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	c.Put("a", 1)
+	c.Put("b", 2)
+	c.Get("a")
+	c.Put("c", 3)
+	if _, exist := c.Get("b"); exist || c.Len() != 2 {
+		t.Fatalf("Expected the least recently used entry evicted")
+	}
+	if v, exist := c.Get("a"); !exist || v.(int) != 1 {
+		t.Fatalf("Unexpected entry")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, exist := c.Get("c"); exist {
+		t.Fatalf("Expected the entry expired")
+	}
+	c.Purge()
+	if c.Len() != 0 {
+		t.Fatalf("Expected empty cache")
+	}
+}
+
+func benchmarkPatterns(n int) []string {
+	patterns := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		patterns = append(patterns, fmt.Sprintf("*.domain%d.com", i))
+	}
+	return patterns
+}
+
+func BenchmarkLinearPatterns(b *testing.B) {
+	patterns := benchmarkPatterns(5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, "www.notmatched.com"); matched {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkPatternIndex(b *testing.B) {
+	p := NewPatternIndex()
+	for i, pattern := range benchmarkPatterns(5000) {
+		p.Add(pattern, i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Lookup("www.notmatched.com", func(int) {})
+	}
+}
+
+func benchmarkRegexes(n int) []string {
+	exprs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		exprs = append(exprs, fmt.Sprintf(`^https?:\/\/[^\/]+blog%d\.(.*)`, i))
+	}
+	return exprs
+}
+
+func BenchmarkLinearRegexes(b *testing.B) {
+	var res []*regexp.Regexp
+	for _, expr := range benchmarkRegexes(1000) {
+		res = append(res, regexp.MustCompile(expr))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, re := range res {
+			if re.MatchString("https://www.notmatched.com/") {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkRegexSet(b *testing.B) {
+	set := NewRegexSet()
+	for i, expr := range benchmarkRegexes(1000) {
+		set.Add(expr, i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Match("https://www.notmatched.com/", func(int) bool { return false })
+	}
+}
@@ -0,0 +1,159 @@
+package route
+
+import (
+	"net"
+	"strings"
+)
+
+type trieNode struct {
+	children map[string]*trieNode
+	//the domain of the node exactly
+	exact []int
+	//the domain of the node & its subdomains
+	suffix []int
+	//subdomains of the node only
+	sub []int
+}
+
+func (n *trieNode) child(label string, create bool) *trieNode {
+	c, exist := n.children[label]
+	if !exist && create {
+		if nil == n.children {
+			n.children = make(map[string]*trieNode)
+		}
+		c = &trieNode{}
+		n.children[label] = c
+	}
+	return c
+}
+
+// DomainTrie indexes values by domains from the top level label, the domains
+// are expected in lower case.
+type DomainTrie struct {
+	root trieNode
+	size int
+}
+
+func NewDomainTrie() *DomainTrie {
+	return &DomainTrie{}
+}
+
+func (t *DomainTrie) node(domain string) *trieNode {
+	n := &t.root
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		n = n.child(labels[i], true)
+	}
+	t.size++
+	return n
+}
+
+// AddExact adds the value matching the domain only.
+func (t *DomainTrie) AddExact(domain string, v int) {
+	n := t.node(domain)
+	n.exact = append(n.exact, v)
+}
+
+// AddSuffix adds the value matching the domain & its subdomains.
+func (t *DomainTrie) AddSuffix(domain string, v int) {
+	n := t.node(domain)
+	n.suffix = append(n.suffix, v)
+}
+
+// AddSubdomains adds the value matching the subdomains of the domain only.
+func (t *DomainTrie) AddSubdomains(domain string, v int) {
+	n := t.node(domain)
+	n.sub = append(n.sub, v)
+}
+
+func (t *DomainTrie) Len() int {
+	return t.size
+}
+
+// Lookup calls f with the values matching the host.
+func (t *DomainTrie) Lookup(host string, f func(v int)) {
+	n := &t.root
+	for len(host) > 0 {
+		label := host
+		pos := strings.LastIndex(host, ".")
+		if pos >= 0 {
+			label = host[pos+1:]
+			host = host[0:pos]
+		} else {
+			host = ""
+		}
+		if n = n.child(label, false); nil == n {
+			return
+		}
+		for _, v := range n.suffix {
+			f(v)
+		}
+		if len(host) > 0 {
+			for _, v := range n.sub {
+				f(v)
+			}
+		} else {
+			for _, v := range n.exact {
+				f(v)
+			}
+		}
+	}
+}
+
+type ipNode struct {
+	children [2]*ipNode
+	values   []int
+}
+
+// IPTree is a binary trie of CIDRs.
+type IPTree struct {
+	v4 ipNode
+	v6 ipNode
+}
+
+func NewIPTree() *IPTree {
+	return &IPTree{}
+}
+
+func (t *IPTree) rootOf(ip net.IP) (*ipNode, net.IP) {
+	if ip4 := ip.To4(); nil != ip4 {
+		return &t.v4, ip4
+	}
+	if ip6 := ip.To16(); nil != ip6 {
+		return &t.v6, ip6
+	}
+	return nil, nil
+}
+
+func (t *IPTree) Add(ipnet *net.IPNet, v int) {
+	n, ip := t.rootOf(ipnet.IP)
+	if nil == n {
+		return
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits != 8*len(ip) {
+		return
+	}
+	for i := 0; i < ones; i++ {
+		bit := (ip[i/8] >> uint(7-i%8)) & 1
+		if nil == n.children[bit] {
+			n.children[bit] = &ipNode{}
+		}
+		n = n.children[bit]
+	}
+	n.values = append(n.values, v)
+}
+
+// Lookup calls f with the values of the CIDRs containing the ip.
+func (t *IPTree) Lookup(ip net.IP, f func(v int)) {
+	n, ip := t.rootOf(ip)
+	for i := 0; nil != n; i++ {
+		for _, v := range n.values {
+			f(v)
+		}
+		if i == 8*len(ip) {
+			return
+		}
+		n = n.children[(ip[i/8]>>uint(7-i%8))&1]
+	}
+}
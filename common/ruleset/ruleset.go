@@ -0,0 +1,194 @@
+package ruleset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	//one domain per line, matching the domain & its subdomains
+	DomainFormat = "domain"
+	//'ip domain...' per line, matching the domains exactly
+	HostsFormat = "hosts"
+	//AdBlock Plus filters, only the domain filters are supported
+	ABPFormat = "abp"
+)
+
+type domainTable map[string]struct{}
+
+func (t domainTable) add(domain string) {
+	domain = normalizeDomain(domain)
+	if len(domain) > 0 {
+		t[domain] = struct{}{}
+	}
+}
+
+func (t domainTable) matchSuffix(domain string) bool {
+	for {
+		if _, exist := t[domain]; exist {
+			return true
+		}
+		pos := strings.Index(domain, ".")
+		if pos < 0 {
+			return false
+		}
+		domain = domain[pos+1:]
+	}
+}
+
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*.")
+	domain = strings.TrimPrefix(domain, "+.")
+	domain = strings.TrimPrefix(domain, ".")
+	return strings.TrimSuffix(domain, ".")
+}
+
+// DomainSet matches domains by suffix or exact entries, exceptions take
+// precedence.
+type DomainSet struct {
+	suffix    domainTable
+	exact     domainTable
+	exception domainTable
+}
+
+func newDomainSet() *DomainSet {
+	return &DomainSet{
+		suffix:    make(domainTable),
+		exact:     make(domainTable),
+		exception: make(domainTable),
+	}
+}
+
+func (s *DomainSet) Len() int {
+	return len(s.suffix) + len(s.exact)
+}
+
+func (s *DomainSet) Match(host string) bool {
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
+	}
+	host = normalizeDomain(host)
+	if len(host) == 0 || s.exception.matchSuffix(host) {
+		return false
+	}
+	if _, exist := s.exact[host]; exist {
+		return true
+	}
+	return s.suffix.matchSuffix(host)
+}
+
+func (s *DomainSet) parseHostsLine(line string) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || nil == net.ParseIP(fields[0]) {
+		return
+	}
+	for _, domain := range fields[1:] {
+		if strings.HasPrefix(domain, "#") {
+			break
+		}
+		if domain != "localhost" {
+			s.exact.add(domain)
+		}
+	}
+}
+
+// abpDomain extracts the domain of filters like '||example.com^',
+// '|http://example.com/' or 'example.com', returns empty for other filters.
+func abpDomain(filter string) string {
+	if pos := strings.Index(filter, "$"); pos >= 0 {
+		filter = filter[0:pos]
+	}
+	if strings.HasPrefix(filter, "||") {
+		filter = filter[2:]
+	} else if strings.HasPrefix(filter, "|") {
+		filter = filter[1:]
+		if pos := strings.Index(filter, "://"); pos >= 0 {
+			filter = filter[pos+3:]
+		}
+	}
+	if end := strings.IndexAny(filter, "^/:|"); end >= 0 {
+		filter = filter[0:end]
+	}
+	if !strings.Contains(filter, ".") || strings.ContainsAny(filter, "*?[]= ") {
+		return ""
+	}
+	return filter
+}
+
+func (s *DomainSet) parseABPLine(line string) {
+	if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") || strings.Contains(line, "##") || strings.HasPrefix(line, "/") {
+		return
+	}
+	if strings.HasPrefix(line, "@@") {
+		if domain := abpDomain(line[2:]); len(domain) > 0 {
+			s.exception.add(domain)
+		}
+		return
+	}
+	if domain := abpDomain(line); len(domain) > 0 {
+		s.suffix.add(domain)
+	}
+}
+
+// Parse reads the domain set in the format.
+func Parse(r io.Reader, format string) (*DomainSet, error) {
+	format = strings.ToLower(format)
+	if len(format) == 0 {
+		format = DomainFormat
+	}
+	if format != DomainFormat && format != HostsFormat && format != ABPFormat {
+		return nil, fmt.Errorf("Invalid rule set format:%s", format)
+	}
+	s := newDomainSet()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		switch format {
+		case HostsFormat:
+			if !strings.HasPrefix(line, "#") {
+				s.parseHostsLine(line)
+			}
+		case ABPFormat:
+			s.parseABPLine(line)
+		default:
+			if !strings.HasPrefix(line, "#") {
+				s.suffix.add(line)
+			}
+		}
+	}
+	if err := scanner.Err(); nil != err {
+		return nil, err
+	}
+	return s, nil
+}
+
+func Load(file string, format string) (*DomainSet, error) {
+	f, err := os.Open(file)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f, format)
+}
+
+var domainSets sync.Map
+
+func Set(name string, s *DomainSet) {
+	domainSets.Store(name, s)
+}
+
+func Get(name string) *DomainSet {
+	if v, exist := domainSets.Load(name); exist {
+		return v.(*DomainSet)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package ruleset
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDomainFormat(t *testing.T) {
+	s, err := Parse(strings.NewReader("# streaming\nnetflix.com\n+.nflxvideo.net\n.Hulu.com.\n"), "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]bool{
+		"netflix.com":          true,
+		"www.netflix.com:443":  true,
+		"a.b.nflxvideo.net":    true,
+		"HULU.COM":             true,
+		"notnetflix.com":       false,
+		"netflix.com.evil.org": false,
+		"":                     false,
+	} {
+		if s.Match(host) != expected {
+			t.Fatalf("Unexpected result for %s", host)
+		}
+	}
+}
+
+func TestHostsFormat(t *testing.T) {
+	s, err := Parse(strings.NewReader("127.0.0.1 localhost\n0.0.0.0 ads.example.com tracker.example.com # comment\n# 0.0.0.0 skip.com\n"), HostsFormat)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if s.Len() != 2 || !s.Match("tracker.example.com") || s.Match("sub.ads.example.com") || s.Match("skip.com") || s.Match("localhost") {
+		t.Fatalf("Unexpected hosts set")
+	}
+}
+
+func TestABPFormat(t *testing.T) {
+	content := `[AutoProxy 0.2.9]
+! comment
+||google.com
+|https://www.youtube.com/watch
+.twitter.com
+@@||mail.google.com
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+example.com##.ad
+||*.cdn.com
+`
+	s, err := Parse(strings.NewReader(content), ABPFormat)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]bool{
+		"www.google.com":  true,
+		"mail.google.com": false,
+		"www.youtube.com": true,
+		"api.twitter.com": true,
+		"example.com":     false,
+		"a.cdn.com":       false,
+		"x.blogspot.com":  false,
+	} {
+		if s.Match(host) != expected {
+			t.Fatalf("Unexpected result for %s", host)
+		}
+	}
+	if _, err := Parse(strings.NewReader(""), "yaml"); nil == err {
+		t.Fatalf("Expected error for invalid format")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	s, _ := Parse(strings.NewReader("netflix.com"), DomainFormat)
+	Set("streaming", s)
+	if nil == Get("streaming") || !Get("streaming").Match("www.netflix.com") || nil != Get("ads") {
+		t.Fatalf("Unexpected registry")
+	}
+}
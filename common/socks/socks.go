@@ -65,6 +65,8 @@ type SocksRequest struct {
 	Password string
 	// The parsed contents of Username as a key–value mapping.
 	Args Args
+	// The SOCKS command, CONNECT or UDP ASSOCIATE.
+	Command byte
 }
 
 // SocksConn encapsulates a net.Conn and information associated with a SOCKS request.
@@ -96,6 +98,17 @@ func (conn *SocksConn) Grant(addr *net.TCPAddr) error {
 	return sendSocks5ResponseGranted(conn)
 }
 
+// IsUDPAssociate returns true if the client requests a SOCKS5 UDP ASSOCIATE.
+func (conn *SocksConn) IsUDPAssociate() bool {
+	return conn.Req.Command == socksCmdUDP
+}
+
+// Send a message to the proxy client that the UDP association is granted, addr
+// is the address of the UDP relay which the client should send datagrams to.
+func (conn *SocksConn) GrantUDP(addr *net.UDPAddr) error {
+	return sendSocks5ResponseAddr(conn, socksRepSucceeded, addr.IP, addr.Port)
+}
+
 // Send a message to the proxy client that access was rejected or failed.  This
 // sends back a "General Failure" error code.  RejectReason should be used if
 // more specific error reporting is desired.
@@ -197,7 +210,17 @@ func (ln *SocksListener) Accept() (net.Conn, error) {
 // 		go handleConn(conn)
 // 	}
 
+// Authenticator verifies the username/password of a SOCKS5 client.
+type Authenticator func(username, password string) bool
+
 func NewSocksConn(c net.Conn) (*SocksConn, *bufio.Reader, error) {
+	return NewSocksConnWithAuth(c, nil)
+}
+
+// NewSocksConnWithAuth is the same as NewSocksConn, except that SOCKS5 clients
+// must authenticate by username/password if auth is not nil, SOCKS4 clients
+// are rejected in that case since SOCKS4 has no password.
+func NewSocksConnWithAuth(c net.Conn, auth Authenticator) (*SocksConn, *bufio.Reader, error) {
 	conn := new(SocksConn)
 	conn.Conn = c
 	bio := bufio.NewReader(c)
@@ -210,14 +233,19 @@ func NewSocksConn(c net.Conn) (*SocksConn, *bufio.Reader, error) {
 	} else if version == socks4Version {
 		conn.socksVersion = socks4Version
 		conn.Req, err = readSocks4aConnect(bio)
+		conn.Req.Command = socksCmdConnect
 		if err != nil {
 			//conn.Close()
 			return nil, nil, err
 		}
+		if nil != auth {
+			sendSocks4aResponseRejected(conn)
+			return nil, nil, newTemporaryNetError("AcceptSocks: SOCKS4 is not allowed while authentication required")
+		}
 	} else if version == socks5Version {
 		conn.socksVersion = socks5Version
 		rw := bufio.NewReadWriter(bio, bufio.NewWriter(conn))
-		conn.Req, err = socks5Handshake(rw)
+		conn.Req, err = socks5Handshake(rw, auth)
 		if err != nil {
 			//conn.Close()
 			return nil, nil, err
@@ -260,9 +288,10 @@ func (ln *SocksListener) AcceptSocks() (*SocksConn, error) {
 			conn.Close()
 			return nil, err
 		}
+		conn.Req.Command = socksCmdConnect
 	} else if version == socks5Version {
 		conn.socksVersion = socks5Version
-		conn.Req, err = socks5Handshake(rw)
+		conn.Req, err = socks5Handshake(rw, nil)
 		if err != nil {
 			conn.Close()
 			return nil, err
@@ -291,15 +320,15 @@ func (ln *SocksListener) Version() string {
 // socks5handshake conducts the SOCKS5 handshake up to the point where the
 // client command is read and the proxy must open the outgoing connection.
 // Returns a SocksRequest.
-func socks5Handshake(rw *bufio.ReadWriter) (req SocksRequest, err error) {
+func socks5Handshake(rw *bufio.ReadWriter, auth Authenticator) (req SocksRequest, err error) {
 	// Negotiate the authentication method.
 	var method byte
-	if method, err = socks5NegotiateAuth(rw); err != nil {
+	if method, err = socks5NegotiateAuth(rw, nil != auth); err != nil {
 		return
 	}
 
 	// Authenticate the client.
-	if err = socks5Authenticate(rw, method, &req); err != nil {
+	if err = socks5Authenticate(rw, method, &req, auth); err != nil {
 		return
 	}
 
@@ -310,7 +339,8 @@ func socks5Handshake(rw *bufio.ReadWriter) (req SocksRequest, err error) {
 
 // socks5NegotiateAuth negotiates the authentication method and returns the
 // selected method as a byte.  On negotiation failures an error is returned.
-func socks5NegotiateAuth(rw *bufio.ReadWriter) (method byte, err error) {
+// Only username/password is acceptable if passwordRequired is true.
+func socks5NegotiateAuth(rw *bufio.ReadWriter, passwordRequired bool) (method byte, err error) {
 	// Validate the version.
 	if err = socksReadByteVerify(rw.Reader, "version", socks5Version); err != nil {
 		err = newTemporaryNetError("socks5NegotiateAuth: %s", err.Error())
@@ -338,7 +368,7 @@ func socks5NegotiateAuth(rw *bufio.ReadWriter) (method byte, err error) {
 		case socksAuthNoneRequired:
 			// Pick Username/Password over None if the client happens to
 			// send both.
-			if method == socksAuthNoAcceptableMethods {
+			if method == socksAuthNoAcceptableMethods && !passwordRequired {
 				method = m
 			}
 
@@ -365,13 +395,13 @@ func socks5NegotiateAuth(rw *bufio.ReadWriter) (method byte, err error) {
 
 // socks5Authenticate authenticates the client via the chosen authentication
 // mechanism.
-func socks5Authenticate(rw *bufio.ReadWriter, method byte, req *SocksRequest) (err error) {
+func socks5Authenticate(rw *bufio.ReadWriter, method byte, req *SocksRequest, auth Authenticator) (err error) {
 	switch method {
 	case socksAuthNoneRequired:
 		// Straight into reading the connect.
 
 	case socksAuthUsernamePassword:
-		if err = socks5AuthRFC1929(rw, req); err != nil {
+		if err = socks5AuthRFC1929(rw, req, auth); err != nil {
 			return
 		}
 
@@ -392,10 +422,10 @@ func socks5Authenticate(rw *bufio.ReadWriter, method byte, req *SocksRequest) (e
 }
 
 // socks5AuthRFC1929 authenticates the client via RFC 1929 username/password
-// auth.  As a design decision any valid username/password is accepted as this
-// field is primarily used as an out-of-band argument passing mechanism for
+// auth.  Without an Authenticator any valid username/password is accepted as
+// this field is primarily used as an out-of-band argument passing mechanism for
 // pluggable transports.
-func socks5AuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
+func socks5AuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest, auth Authenticator) (err error) {
 	sendErrResp := func() {
 		// Swallow the write/flush error here, we are going to close the
 		// connection and the original failure is more useful.
@@ -450,9 +480,15 @@ func socks5AuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 		req.Password = string(passwd)
 	}
 
-	// Mash the username/password together and parse it as a pluggable
-	// transport argument string.
-	if req.Args, err = parseClientParameters(req.Username + req.Password); err != nil {
+	if nil != auth {
+		if !auth(req.Username, req.Password) {
+			sendErrResp()
+			err = newTemporaryNetError("socks5AuthRFC1929: invalid username/password for user:%s", req.Username)
+			return
+		}
+	} else if req.Args, err = parseClientParameters(req.Username + req.Password); err != nil {
+		// Mash the username/password together and parse it as a pluggable
+		// transport argument string.
 		sendErrResp()
 		err = newTemporaryNetError("socks5AuthRFC1929: failed to parse client parameters: %s", err)
 		return
@@ -468,7 +504,8 @@ func socks5AuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 }
 
 // socks5ReadCommand reads a SOCKS5 client command and parses out the relevant
-// fields into a SocksRequest.  Only CMD_CONNECT is supported.
+// fields into a SocksRequest.  Only CMD_CONNECT and CMD_UDP_ASSOCIATE are
+// supported.
 func socks5ReadCommand(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 	sendErrResp := func(reason byte) {
 		// Swallow errors that occur when writing/flushing the response,
@@ -483,9 +520,13 @@ func socks5ReadCommand(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 		err = newTemporaryNetError("socks5ReadCommand: %s", err)
 		return
 	}
-	if err = socksReadByteVerify(rw.Reader, "command", socksCmdConnect); err != nil {
+	if req.Command, err = socksReadByte(rw.Reader); err != nil {
+		err = newTemporaryNetError("socks5ReadCommand: Failed to read command: %s", err)
+		return
+	}
+	if req.Command != socksCmdConnect && req.Command != socksCmdUDP {
 		sendErrResp(SocksRepCommandNotSupported)
-		err = newTemporaryNetError("socks5ReadCommand: %s", err)
+		err = newTemporaryNetError("socks5ReadCommand: SOCKS message field command was 0x%02x", req.Command)
 		return
 	}
 	if err = socksReadByteVerify(rw.Reader, "reserved", socksReserved); err != nil {
@@ -581,6 +622,17 @@ func sendSocks5Response(w io.Writer, code byte) error {
 	return nil
 }
 
+// Send a SOCKS5 response with the given code and BND.ADDR/BND.PORT.
+func sendSocks5ResponseAddr(w io.Writer, code byte, ip net.IP, port int) error {
+	resp := []byte{socks5Version, code, socksReserved}
+	resp = appendSocks5Addr(resp, ip.String(), port)
+	if _, err := w.Write(resp); err != nil {
+		err = newTemporaryNetError("sendSocks5Response: Failed write response: %s", err)
+		return err
+	}
+	return nil
+}
+
 // Send a SOCKS5 response code 0x00.
 func sendSocks5ResponseGranted(w io.Writer) error {
 	return sendSocks5Response(w, socksRepSucceeded)
@@ -0,0 +1,65 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func socks5AuthHandshake(user, passwd string) (*SocksConn, []byte, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	auth := func(u, p string) bool {
+		return u == "alice" && p == "secret"
+	}
+	replies := make(chan []byte, 1)
+	go func() {
+		var reply []byte
+		defer func() {
+			replies <- reply
+		}()
+		client.Write([]byte{socks5Version, 2, socksAuthNoneRequired, socksAuthUsernamePassword})
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(client, b); nil != err {
+			return
+		}
+		reply = append(reply, b...)
+		if b[1] != socksAuthUsernamePassword {
+			return
+		}
+		req := []byte{socksAuthRFC1929Ver, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(passwd)))
+		req = append(req, passwd...)
+		client.Write(req)
+		if _, err := io.ReadFull(client, b); nil != err {
+			return
+		}
+		reply = append(reply, b...)
+		if b[1] != socksAuthRFC1929Success {
+			return
+		}
+		client.Write([]byte{socks5Version, socksCmdConnect, socksReserved, socksAtypeV4, 1, 2, 3, 4, 0, 80})
+	}()
+	conn, _, err := NewSocksConnWithAuth(server, auth)
+	server.Close()
+	return conn, <-replies, err
+}
+
+func TestSocks5Authentication(t *testing.T) {
+	conn, reply, err := socks5AuthHandshake("alice", "secret")
+	if nil != err {
+		t.Fatalf("Unexpected handshake error:%v", err)
+	}
+	if conn.Req.Username != "alice" || conn.Req.Target != "1.2.3.4:80" {
+		t.Fatalf("Unexpected request:%v", conn.Req)
+	}
+	if reply[1] != socksAuthUsernamePassword || reply[3] != socksAuthRFC1929Success {
+		t.Fatalf("Unexpected replies:%v", reply)
+	}
+	_, reply, err = socks5AuthHandshake("alice", "wrong")
+	if nil == err || len(reply) != 4 || reply[3] != socksAuthRFC1929Fail {
+		t.Fatalf("Expected auth failure, but got err:%v & replies:%v", err, reply)
+	}
+}
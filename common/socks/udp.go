@@ -0,0 +1,101 @@
+package socks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// UDPDatagram is a datagram relayed by SOCKS5 UDP ASSOCIATE.
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+type UDPDatagram struct {
+	Frag byte
+	// The destination as a "host:port" string.
+	Target string
+	Data   []byte
+}
+
+// ParseUDPDatagram parses a datagram received from the SOCKS5 client, the Data
+// of the result refers to b.
+func ParseUDPDatagram(b []byte) (*UDPDatagram, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("socks5 udp datagram too short:%d", len(b))
+	}
+	d := &UDPDatagram{Frag: b[2]}
+	var host string
+	pos := 4
+	switch b[3] {
+	case socksAtypeV4:
+		if len(b) < pos+net.IPv4len+2 {
+			return nil, fmt.Errorf("socks5 udp datagram too short:%d", len(b))
+		}
+		host = net.IP(b[pos : pos+net.IPv4len]).String()
+		pos += net.IPv4len
+	case socksAtypeV6:
+		if len(b) < pos+net.IPv6len+2 {
+			return nil, fmt.Errorf("socks5 udp datagram too short:%d", len(b))
+		}
+		host = net.IP(b[pos : pos+net.IPv6len]).String()
+		pos += net.IPv6len
+	case socksAtypeDomainName:
+		if len(b) < pos+1 {
+			return nil, fmt.Errorf("socks5 udp datagram too short:%d", len(b))
+		}
+		alen := int(b[pos])
+		pos++
+		if 0 == alen || len(b) < pos+alen+2 {
+			return nil, fmt.Errorf("socks5 udp datagram with invalid domain length:%d", alen)
+		}
+		host = string(b[pos : pos+alen])
+		pos += alen
+	default:
+		return nil, fmt.Errorf("socks5 udp datagram with unsupported address type 0x%02x", b[3])
+	}
+	port := binary.BigEndian.Uint16(b[pos:])
+	pos += 2
+	d.Target = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	d.Data = b[pos:]
+	return d, nil
+}
+
+// Bytes encodes the datagram to send to the SOCKS5 client.
+func (d *UDPDatagram) Bytes() ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(d.Target)
+	if nil != err {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if nil != err {
+		return nil, err
+	}
+	b := make([]byte, 0, 4+1+len(host)+2+len(d.Data))
+	b = append(b, 0, 0, d.Frag)
+	b = appendSocks5Addr(b, host, port)
+	return append(b, d.Data...), nil
+}
+
+// appendSocks5Addr appends ATYP/ADDR/PORT of the host & port to b.
+func appendSocks5Addr(b []byte, host string, port int) []byte {
+	if ip := net.ParseIP(host); nil != ip {
+		if ipv4 := ip.To4(); nil != ipv4 {
+			b = append(b, socksAtypeV4)
+			b = append(b, ipv4...)
+		} else {
+			b = append(b, socksAtypeV6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			host = host[:255]
+		}
+		b = append(b, socksAtypeDomainName, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
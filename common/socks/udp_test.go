@@ -0,0 +1,26 @@
+package socks
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUDPDatagram(t *testing.T) {
+	for _, target := range []string{"1.2.3.4:53", "[2001:db8::1]:443", "example.com:8080"} {
+		d := &UDPDatagram{Target: target, Data: []byte("hello")}
+		b, err := d.Bytes()
+		if nil != err {
+			t.Fatalf("Failed to encode datagram:%v", err)
+		}
+		parsed, err := ParseUDPDatagram(b)
+		if nil != err {
+			t.Fatalf("Failed to parse datagram:%v", err)
+		}
+		if parsed.Target != target || !bytes.Equal(parsed.Data, d.Data) || parsed.Frag != 0 {
+			t.Fatalf("Mismatch datagram:%v, expected %v", parsed, d)
+		}
+	}
+	if _, err := ParseUDPDatagram([]byte{0, 0, 0, socksAtypeV4, 1, 2}); nil == err {
+		t.Fatalf("Expected error for short datagram")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	//_ "net/http/pprof"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/yinqiwen/gotoolkit/iotools"
@@ -17,6 +18,7 @@ import (
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/metrics"
 	"github.com/yinqiwen/gsnova/common/netx"
 )
 
@@ -65,6 +67,30 @@ func httpDumpCallback(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GET /connections lists live connections, DELETE /connections?id=1 kills one
+func connectionsCallback(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		js, _ := json.MarshalIndent(listConnections(), "", "    ")
+		w.Write(js)
+	case "DELETE":
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if nil != err || 0 == id {
+			http.Error(w, "Invalid connection id", http.StatusBadRequest)
+			return
+		}
+		if !killConnection(id) {
+			http.Error(w, "Connection not found", http.StatusNotFound)
+			return
+		}
+		logger.Notice("Kill connection:%d by admin request from %s", id, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func startAdminServer() {
 	if len(GConf.Admin.Listen) == 0 {
 		return
@@ -110,6 +136,10 @@ func startAdminServer() {
 	mux.HandleFunc("/gc", gcCallback)
 	mux.HandleFunc("/memdump", memdumpCallback)
 	mux.HandleFunc("/httpdump", httpDumpCallback)
+	mux.HandleFunc("/metrics", metrics.Handler)
+	mux.HandleFunc("/connections", connectionsCallback)
+	mux.HandleFunc("/loglevel", logger.LevelHandler)
+	mux.HandleFunc("/route", routeCallback)
 	err := http.ListenAndServe(GConf.Admin.Listen, mux)
 	if nil != err {
 		logger.Error("Failed to start config store server:%v", err)
@@ -1,9 +1,13 @@
 package local
 
 import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
 	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/yinqiwen/gsnova/common/channel"
@@ -11,6 +15,7 @@ import (
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/hosts"
 	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/ruleset"
 )
 
 var GConf LocalConfig
@@ -20,6 +25,10 @@ const (
 	InHostsRule      = "InHosts"
 	IsCNIPRule       = "IsCNIP"
 	IsPrivateIPRule  = "IsPrivateIP"
+	//'IsCountry:JP' matches IPs in the IP set of the country
+	IsCountryRule = "IsCountry"
+	//'InSet:streaming' matches hosts in the named rule set
+	InSetRule = "InSet"
 )
 
 func matchHostnames(pattern, host string) bool {
@@ -54,7 +63,199 @@ type PACConfig struct {
 	URL      []string
 	Rule     []string
 	Protocol []string
-	Remote   string
+	User     []string
+	//CIDRs of the destination, domains are resolved to match
+	IP []string
+	//destination ports or port ranges like '8000-9000'
+	Port []string
+	//CIDRs of the connecting client
+	Source []string
+	Remote string
+
+	ipNets     []*net.IPNet
+	sourceNets []*net.IPNet
+	ports      []portRange
+}
+
+// PACRequest is the connection matched by PAC rules.
+type PACRequest struct {
+	Protocol string
+	//domain or IP of the destination
+	Host   string
+	Port   int
+	Source net.IP
+	User   string
+	//the initial HTTP request, or the CONNECT request to the host
+	Req *http.Request
+
+	//the destination IP, the domain is resolved once per request
+	ip       net.IP
+	resolved bool
+}
+
+// destIP returns the IP of the destination, resolves the domain host at the
+// first call.
+func (r *PACRequest) destIP() net.IP {
+	if r.resolved {
+		return r.ip
+	}
+	r.resolved = true
+	if len(r.Host) == 0 {
+		return nil
+	}
+	if r.ip = net.ParseIP(r.Host); nil == r.ip {
+		if resolved, err := dns.DnsGetDoaminIP(r.Host); nil == err {
+			r.ip = net.ParseIP(resolved)
+		}
+	}
+	return r.ip
+}
+
+func newHostPACRequest(protocol string, host string, port int, source net.IP, user string) *PACRequest {
+	creq, _ := http.NewRequest("Connect", "https://"+host, nil)
+	return &PACRequest{Protocol: protocol, Host: host, Port: port, Source: source, User: user, Req: creq}
+}
+
+// sourceIP returns the ip of the 'host:port' address.
+func sourceIP(addr net.Addr) net.IP {
+	if nil == addr {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if nil != err {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+type portRange struct {
+	min int
+	max int
+}
+
+func parsePortRange(s string) (portRange, error) {
+	var r portRange
+	var err error
+	s = strings.TrimSpace(s)
+	if pos := strings.Index(s, "-"); pos > 0 {
+		if r.min, err = strconv.Atoi(s[0:pos]); nil == err {
+			r.max, err = strconv.Atoi(s[pos+1:])
+		}
+	} else {
+		r.min, err = strconv.Atoi(s)
+		r.max = r.min
+	}
+	if nil != err || r.min <= 0 || r.max > 65535 || r.min > r.max {
+		return r, fmt.Errorf("Invalid port range:%s", s)
+	}
+	return r, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if nil == ip {
+				return nil, fmt.Errorf("Invalid IP:%s", s)
+			}
+			bits := 8 * net.IPv6len
+			if nil != ip.To4() {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if nil != err {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pac *PACConfig) init() error {
+	var err error
+	if pac.ipNets, err = parseCIDRs(pac.IP); nil != err {
+		return err
+	}
+	if pac.sourceNets, err = parseCIDRs(pac.Source); nil != err {
+		return err
+	}
+	pac.ports = nil
+	for _, s := range pac.Port {
+		r, err := parsePortRange(s)
+		if nil != err {
+			return err
+		}
+		pac.ports = append(pac.ports, r)
+	}
+	return nil
+}
+
+func (pac *PACConfig) matchPort(port int) bool {
+	if len(pac.ports) == 0 {
+		return true
+	}
+	for _, r := range pac.ports {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func (pac *PACConfig) matchSource(source net.IP) bool {
+	if len(pac.sourceNets) == 0 {
+		return true
+	}
+	return nil != source && containsIP(pac.sourceNets, source)
+}
+
+func (pac *PACConfig) matchIP(r *PACRequest) bool {
+	if len(pac.ipNets) == 0 {
+		return true
+	}
+	ip := r.destIP()
+	return nil != ip && containsIP(pac.ipNets, ip)
+}
+
+// String describes the non-empty conditions of the PAC rule.
+func (pac *PACConfig) String() string {
+	var conds []string
+	for _, cond := range []struct {
+		name   string
+		values []string
+	}{
+		{"Protocol", pac.Protocol},
+		{"User", pac.User},
+		{"Source", pac.Source},
+		{"Rule", pac.Rule},
+		{"IP", pac.IP},
+		{"Port", pac.Port},
+		{"Host", pac.Host},
+		{"Method", pac.Method},
+		{"URL", pac.URL},
+	} {
+		if len(cond.values) > 0 {
+			conds = append(conds, cond.name+":"+strings.Join(cond.values, ","))
+		}
+	}
+	if len(conds) == 0 {
+		conds = append(conds, "*")
+	}
+	return strings.Join(conds, " ") + " => " + pac.Remote
 }
 
 func (pac *PACConfig) ruleInHosts(req *http.Request) bool {
@@ -73,7 +274,75 @@ func (pac *PACConfig) matchProtocol(protocol string) bool {
 	return false
 }
 
-func (pac *PACConfig) matchRules(ip string, req *http.Request) bool {
+// ruleParam returns the parameter of rules like 'IsCountry:JP'.
+func ruleParam(rule string, name string) (string, bool) {
+	prefix := name + ":"
+	if len(rule) > len(prefix) && strings.EqualFold(rule[0:len(prefix)], prefix) {
+		return rule[len(prefix):], true
+	}
+	return "", false
+}
+
+func ruleInSet(host string, name string) bool {
+	set := ruleset.Get(name)
+	if nil == set || len(host) == 0 {
+		logger.Debug("NIL rule set:%s or Domain", name)
+		return false
+	}
+	return set.Match(host)
+}
+
+// ruleInCountry returns whether the destination is in the country & the
+// resolved ip.
+func ruleInCountry(r *PACRequest, country string) (bool, string) {
+	if len(r.Host) == 0 || !dns.HasCountryIPSet(country) {
+		logger.Debug("NIL IP set of country:%s or IP/Domain", country)
+		return false, ""
+	}
+	ip := r.destIP()
+	if nil == ip {
+		return false, ""
+	}
+	ok := dns.IsInCountry(ip, country)
+	logger.Debug("ip:%s is in country %s:%v", ip, country, ok)
+	return ok, ip.String()
+}
+
+const gfwListUnavailable = "GFWList unavailable"
+
+// evalRule evaluates the rule term without the '!' prefix, the detail is the
+// matched GFWList rule or the resolved IP.
+func (pac *PACConfig) evalRule(rule string, r *PACRequest) (bool, string) {
+	host, req := r.Host, r.Req
+	if strings.EqualFold(rule, InHostsRule) {
+		if nil == req {
+			return false, ""
+		}
+		return pac.ruleInHosts(req), ""
+	} else if strings.EqualFold(rule, BlockedByGFWRule) {
+		gfwList := getGFWList()
+		if nil == gfwList || nil == req {
+			logger.Debug("NIL GFWList object or request")
+			return true, gfwListUnavailable
+		}
+		return gfwList.MatchedRule(req)
+	} else if strings.EqualFold(rule, IsCNIPRule) {
+		return ruleInCountry(r, "CN")
+	} else if country, isCountry := ruleParam(rule, IsCountryRule); isCountry {
+		return ruleInCountry(r, strings.ToUpper(country))
+	} else if name, isSet := ruleParam(rule, InSetRule); isSet {
+		return ruleInSet(host, name), ""
+	} else if strings.EqualFold(rule, IsPrivateIPRule) {
+		if len(host) == 0 {
+			return false, ""
+		}
+		return helper.IsPrivateIP(host), ""
+	}
+	logger.Error("###Invalid rule:%s", rule)
+	return true, ""
+}
+
+func (pac *PACConfig) matchRules(r *PACRequest) bool {
 	if len(pac.Rule) == 0 {
 		return true
 	}
@@ -86,45 +355,17 @@ func (pac *PACConfig) matchRules(ip string, req *http.Request) bool {
 			not = true
 			rule = rule[1:]
 		}
-		if strings.EqualFold(rule, InHostsRule) {
-			if nil == req {
-				ok = false
-			} else {
-				ok = pac.ruleInHosts(req)
-			}
-		} else if strings.EqualFold(rule, BlockedByGFWRule) {
-			gfwList := getGFWList()
-			if nil != gfwList && nil != req {
-				ok = gfwList.IsBlockedByGFW(req)
-				if !ok {
-					logger.Debug("#### %s is NOT BlockedByGFW", req.Host)
-				}
-			} else {
-				ok = true
-				logger.Debug("NIL GFWList object or request")
-			}
-		} else if strings.EqualFold(rule, IsCNIPRule) {
-			if len(ip) == 0 || nil == dns.CNIPSet {
-				logger.Debug("NIL CNIP content  or IP/Domain")
-				ok = false
+		var detail string
+		ok, detail = pac.evalRule(rule, r)
+		if strings.EqualFold(rule, BlockedByGFWRule) {
+			if detail == gfwListUnavailable {
+				gfwListDecisions.Inc("unavailable")
+			} else if !ok {
+				logger.Debug("#### %s is NOT BlockedByGFW", r.Req.Host)
+				gfwListDecisions.Inc("not-blocked")
 			} else {
-				var err error
-				if net.ParseIP(ip) == nil {
-					ip, err = dns.DnsGetDoaminIP(ip)
-				}
-				if nil == err {
-					ok = dns.CNIPSet.IsInCountry(net.ParseIP(ip), "CN")
-				}
-				logger.Debug("ip:%s is CNIP:%v", ip, ok)
+				gfwListDecisions.Inc("blocked")
 			}
-		} else if strings.EqualFold(rule, IsPrivateIPRule) {
-			if len(ip) == 0 {
-				ok = false
-			} else {
-				ok = helper.IsPrivateIP(ip)
-			}
-		} else {
-			logger.Error("###Invalid rule:%s", rule)
 		}
 		if not {
 			ok = ok != true
@@ -154,26 +395,47 @@ func MatchPatterns(str string, rules []string) bool {
 	return false
 }
 
-func (pac *PACConfig) Match(protocol string, ip string, req *http.Request) bool {
-	ret := pac.matchProtocol(protocol)
-	if !ret {
+func (pac *PACConfig) Match(r *PACRequest) bool {
+	return pac.match(r, true)
+}
+
+// match skips the Host patterns if checkHost is false, they are matched by the
+// compiled router already.
+func (pac *PACConfig) match(r *PACRequest, checkHost bool) bool {
+	return pac.matchConditions(r, checkHost) && pac.matchRules(r)
+}
+
+// matchConditions matches the conditions except the Rule terms.
+func (pac *PACConfig) matchConditions(r *PACRequest, checkHost bool) bool {
+	if !pac.matchProtocol(r.Protocol) {
+		return false
+	}
+	if len(pac.User) > 0 && !MatchPatterns(r.User, pac.User) {
 		return false
 	}
-	ret = pac.matchRules(ip, req)
-	if !ret {
+	if !pac.matchPort(r.Port) || !pac.matchSource(r.Source) {
 		return false
 	}
+	if !pac.matchIP(r) {
+		return false
+	}
+	req := r.Req
 	if nil == req {
 		if len(pac.Host) > 0 || len(pac.Method) > 0 || len(pac.URL) > 0 {
 			return false
 		}
 		return true
 	}
-	host := req.Host
-	if len(pac.Host) > 0 && strings.Contains(host, ":") {
-		host, _, _ = net.SplitHostPort(host)
+	if checkHost {
+		host := req.Host
+		if len(pac.Host) > 0 && strings.Contains(host, ":") {
+			host, _, _ = net.SplitHostPort(host)
+		}
+		if !MatchPatterns(host, pac.Host) {
+			return false
+		}
 	}
-	return MatchPatterns(host, pac.Host) && MatchPatterns(req.Method, pac.Method) && MatchPatterns(req.URL.String(), pac.URL)
+	return MatchPatterns(req.Method, pac.Method) && MatchPatterns(req.URL.String(), pac.URL)
 }
 
 type HTTPDumpConfig struct {
@@ -199,30 +461,89 @@ type ProxyConfig struct {
 	MITM        bool //Man-in-the-middle
 	Transparent bool
 	HTTPDump    HTTPDumpConfig
-	PAC         []PACConfig
+	//user & password to access the proxy, empty means no authentication
+	Users map[string]string
+	PAC   []PACConfig
+
+	router *pacRouter
 }
 
-func (cfg *ProxyConfig) getProxyChannelByHost(proto string, host string) string {
-	creq, _ := http.NewRequest("Connect", "https://"+host, nil)
-	return cfg.findProxyChannelByRequest(proto, host, creq)
+// init compiles the PAC rules of the proxy.
+func (cfg *ProxyConfig) init() error {
+	if cfg.authRequired() && (len(cfg.Forward) > 0 || cfg.Transparent) {
+		return fmt.Errorf("Proxy:%s with Users can NOT be Forward or Transparent since the connections are not authenticated", cfg.Local)
+	}
+	for j := range cfg.PAC {
+		if err := cfg.PAC[j].init(); nil != err {
+			return fmt.Errorf("Invalid PAC:%s of proxy:%s for reason:%v", cfg.PAC[j].String(), cfg.Local, err)
+		}
+	}
+	cfg.router = newPACRouter(cfg.PAC)
+	return nil
+}
+
+func (cfg *ProxyConfig) authRequired() bool {
+	return len(cfg.Users) > 0
+}
+
+func (cfg *ProxyConfig) verifyUser(user, passwd string) bool {
+	expected, exist := cfg.Users[user]
+	return exist && subtle.ConstantTimeCompare([]byte(expected), []byte(passwd)) == 1
+}
+
+// verifyHTTPProxyAuth verifies the 'Proxy-Authorization' header of the request
+// and returns the authenticated user.
+func (cfg *ProxyConfig) verifyHTTPProxyAuth(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len("Basic "):]))
+	if nil != err {
+		return "", false
+	}
+	idx := strings.Index(string(decoded), ":")
+	if idx < 0 {
+		return "", false
+	}
+	user, passwd := string(decoded[:idx]), string(decoded[idx+1:])
+	return user, cfg.verifyUser(user, passwd)
 }
 
-func (cfg *ProxyConfig) findProxyChannelByRequest(proto string, ip string, req *http.Request) string {
+func (cfg *ProxyConfig) getProxyChannel(r *PACRequest) string {
+	_, channelName := cfg.selectPAC(r)
+	return channelName
+}
+
+// selectPAC returns the index of the matched PAC rule & its channel, the index
+// is -1 if no rule matched.
+func (cfg *ProxyConfig) selectPAC(r *PACRequest) (int, string) {
 	var channelName string
+	pacIdx := -1
 	// if len(ip) > 0 && helper.IsPrivateIP(ip) {
 	// 	//channel = "direct"
 	// 	return channel.DirectChannelName
 	// }
-	for _, pac := range cfg.PAC {
-		if pac.Match(proto, ip, req) {
-			channelName = pac.Remote
-			break
+	if nil != cfg.router {
+		pacIdx = cfg.router.selectPAC(r)
+	} else {
+		for i := range cfg.PAC {
+			if cfg.PAC[i].Match(r) {
+				pacIdx = i
+				break
+			}
 		}
 	}
+	if pacIdx >= 0 {
+		channelName = cfg.PAC[pacIdx].Remote
+	}
 	if len(channelName) == 0 {
 		logger.Error("No proxy channel found.")
+		pacDecisions.Inc(cfg.Local, "none")
+	} else {
+		pacDecisions.Inc(cfg.Local, channelName)
 	}
-	return channelName
+	return pacIdx, channelName
 }
 
 type AdminConfig struct {
@@ -253,6 +574,17 @@ func (sni *SNIConfig) redirect(domain string) (string, bool) {
 	return "", false
 }
 
+type RuleSetConfig struct {
+	Name string
+	//'domain', 'hosts' or 'abp'
+	Format string
+	//file of the rule set, also the cache of the content fetched from URL
+	File                 string
+	URL                  string
+	Channel              string
+	RefreshPeriodMinutes int
+}
+
 type GFWListConfig struct {
 	URL                   string
 	UserRule              []string
@@ -275,9 +607,23 @@ type LocalConfig struct {
 	TransparentMark int
 	Proxy           []ProxyConfig
 	Channel         []channel.ProxyChannelConfig
+	//one JSON line per closed connection, rotated separately from Log
+	AccessLog channel.AccessLogConfig
+	//min level with per-package overrides like 'info,channel=debug,dns=warn'
+	LogLevel string
+	//write one JSON object per line into Log
+	LogJSON   bool
+	LogRotate logger.RotateConfig
+	//named domain sets of 'InSet:name' PAC rules
+	RuleSet []RuleSetConfig
 }
 
 func (cfg *LocalConfig) init() error {
+	for i := range GConf.Proxy {
+		if err := GConf.Proxy[i].init(); nil != err {
+			return err
+		}
+	}
 	haveDirect := false
 	for i := range GConf.Channel {
 		if GConf.Channel[i].Name == channel.DirectChannelName && GConf.Channel[i].Enable {
@@ -292,6 +638,9 @@ func (cfg *LocalConfig) init() error {
 			GConf.Channel[i].HTTP.UserAgent = GConf.UserAgent
 		}
 		GConf.Channel[i].Adjust()
+		if err := GConf.Channel[i].Validate(); nil != err {
+			return err
+		}
 	}
 
 	if !haveDirect {
@@ -0,0 +1,127 @@
+package local
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		min, max int
+		ok       bool
+	}{
+		{"80", 80, 80, true},
+		{" 443 ", 443, 443, true},
+		{"8000-9000", 8000, 9000, true},
+		{"1-65535", 1, 65535, true},
+		{"0", 0, 0, false},
+		{"9000-8000", 0, 0, false},
+		{"1-65536", 0, 0, false},
+		{"-80", 0, 0, false},
+		{"80-", 0, 0, false},
+		{"http", 0, 0, false},
+	} {
+		r, err := parsePortRange(c.s)
+		if (nil == err) != c.ok {
+			t.Fatalf("Unexpected result of %q, err:%v", c.s, err)
+		}
+		if c.ok && (r.min != c.min || r.max != c.max) {
+			t.Fatalf("Unexpected range %+v of %q", r, c.s)
+		}
+	}
+}
+
+func TestMatchIP(t *testing.T) {
+	pac := &PACConfig{IP: []string{"10.0.0.0/8", "1.1.1.1", "2400:da00::/32", "::1"}}
+	if err := pac.init(); nil != err {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host  string
+		match bool
+	}{
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"1.1.1.1", true},
+		{"1.1.1.2", false},
+		{"::ffff:10.0.0.1", true},
+		{"2400:da00::1", true},
+		{"2400:da01::1", false},
+		{"::1", true},
+		{"::2", false},
+		{"", false},
+	} {
+		if pac.matchIP(&PACRequest{Host: c.host}) != c.match {
+			t.Fatalf("Unexpected IP match of %q", c.host)
+		}
+	}
+	//the domain is resolved once per request
+	r := &PACRequest{Host: "example.invalid", ip: net.ParseIP("10.0.0.1"), resolved: true}
+	if !pac.matchIP(r) || r.destIP().String() != "10.0.0.1" {
+		t.Fatalf("Expected the resolved IP of the request matched")
+	}
+}
+
+func TestMatchSource(t *testing.T) {
+	pac := &PACConfig{Source: []string{"192.168.1.0/24", "fd00::/8"}}
+	if err := pac.init(); nil != err {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		source string
+		match  bool
+	}{
+		{"192.168.1.10", true},
+		{"192.168.2.10", false},
+		{"fd00::1", true},
+		{"fe80::1", false},
+		{"", false},
+	} {
+		if pac.matchSource(net.ParseIP(c.source)) != c.match {
+			t.Fatalf("Unexpected source match of %q", c.source)
+		}
+	}
+	if empty := (&PACConfig{}); !empty.matchSource(nil) {
+		t.Fatalf("Empty Source should match any client")
+	}
+}
+
+func TestInvalidPACRejected(t *testing.T) {
+	saved := GConf
+	defer func() {
+		GConf = saved
+	}()
+	for _, pac := range []PACConfig{
+		{Port: []string{"0"}},
+		{Port: []string{"443-80"}},
+		{IP: []string{"10.0.0.0/33"}},
+		{IP: []string{"abc"}},
+		{Source: []string{"1.1.1"}},
+	} {
+		GConf = LocalConfig{Proxy: []ProxyConfig{{Local: ":48100", PAC: []PACConfig{pac}}}}
+		if err := GConf.init(); nil == err {
+			t.Fatalf("Invalid PAC:%s should be rejected", pac.String())
+		}
+	}
+	GConf = LocalConfig{Proxy: []ProxyConfig{{Local: ":48100", PAC: []PACConfig{{Port: []string{"80", "8000-9000"}, IP: []string{"10.0.0.0/8"}, Source: []string{"::1"}}}}}}
+	if err := GConf.init(); nil != err {
+		t.Fatalf("Valid PAC rejected for reason:%v", err)
+	}
+}
+
+func TestProxyUsersRequireAuthenticatedMode(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+	for _, proxy := range []ProxyConfig{
+		{Local: ":48100", Users: users, Forward: "127.0.0.1:8080"},
+		{Local: ":48100", Users: users, Transparent: true},
+	} {
+		if err := proxy.init(); nil == err {
+			t.Fatalf("Users of proxy:%+v should be rejected", proxy)
+		}
+	}
+	proxy := ProxyConfig{Local: ":48100", Users: users}
+	if err := proxy.init(); nil != err || nil == proxy.router {
+		t.Fatalf("Valid proxy rejected for reason:%v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package local
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+// ConnectionInfo describes a live proxy connection of the local server.
+type ConnectionInfo struct {
+	ID         uint64
+	StreamID   uint32
+	ClientAddr string
+	User       string
+	Host       string
+	Port       string
+	//whether the host is sniffed from the TLS SNI
+	SNI       bool
+	Protocol  string
+	PAC       int
+	PACRule   string
+	Channel   string
+	Server    string
+	BytesUp   int64
+	BytesDown int64
+	StartTime time.Time
+}
+
+func listConnections() []ConnectionInfo {
+	conns := make([]ConnectionInfo, 0)
+	activeStreams.Range(func(key, value interface{}) bool {
+		ctx := key.(*proxyStreamContext)
+		info := ConnectionInfo{
+			ID:         ctx.id,
+			ClientAddr: ctx.clientAddr,
+			User:       ctx.user,
+			Host:       ctx.host,
+			Port:       ctx.port,
+			SNI:        ctx.sniffed,
+			Protocol:   ctx.protocol,
+			PAC:        ctx.pacIdx,
+			PACRule:    ctx.pacRule,
+			Channel:    ctx.channel,
+			Server:     ctx.server,
+			BytesUp:    atomic.LoadInt64(&ctx.bytesUp),
+			BytesDown:  atomic.LoadInt64(&ctx.bytesDown),
+			StartTime:  ctx.start,
+		}
+		if nil != ctx.stream {
+			info.StreamID = ctx.stream.StreamID()
+		}
+		conns = append(conns, info)
+		return true
+	})
+	activeUDPFlows.Range(func(key, value interface{}) bool {
+		conns = append(conns, key.(*udpAccess).info())
+		return true
+	})
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID < conns[j].ID
+	})
+	return conns
+}
+
+// killConnection closes the live connection by id, returns false if not found.
+func killConnection(id uint64) bool {
+	killed := false
+	activeStreams.Range(func(key, value interface{}) bool {
+		ctx := key.(*proxyStreamContext)
+		if ctx.id != id {
+			return true
+		}
+		ctx.closeReason.Set("killed")
+		ctx.close()
+		activeStreams.Delete(key)
+		killed = true
+		return false
+	})
+	if killed {
+		return true
+	}
+	activeUDPFlows.Range(func(key, value interface{}) bool {
+		a := key.(*udpAccess)
+		if a.id != id {
+			return true
+		}
+		a.closeReason.Set("killed")
+		a.kill()
+		a.finish("killed")
+		killed = true
+		return false
+	})
+	return killed
+}
+
+func (ctx *proxyStreamContext) accessLogEntry() *channel.AccessLogEntry {
+	return &channel.AccessLogEntry{
+		Start:       ctx.start,
+		Side:        "client",
+		User:        ctx.user,
+		ClientIP:    channel.ClientIP(ctx.clientAddr),
+		Protocol:    ctx.protocol,
+		Destination: net.JoinHostPort(ctx.host, ctx.port),
+		PACRule:     ctx.pacRule,
+		Channel:     ctx.channel,
+		Server:      ctx.server,
+		BytesUp:     atomic.LoadInt64(&ctx.bytesUp),
+		BytesDown:   atomic.LoadInt64(&ctx.bytesDown),
+		CloseReason: ctx.closeReason.String(),
+	}
+}
+
+// finish removes the connection from the live table & writes the access log
+// once, the reason is used if no reason set before.
+func (ctx *proxyStreamContext) finish(reason string) {
+	ctx.finishOnce.Do(func() {
+		ctx.closeReason.Set(reason)
+		activeStreams.Delete(ctx)
+		channel.WriteAccessLog(ctx.accessLogEntry())
+	})
+}
+
+var activeUDPFlows sync.Map //*udpAccess -> true
+
+// udpAccess records a proxied udp flow for the access log & the live
+// connections, the flow is closed by kill.
+type udpAccess struct {
+	id          uint64
+	stream      mux.MuxStream
+	kill        func()
+	entry       channel.AccessLogEntry
+	bytesUp     int64
+	bytesDown   int64
+	closeReason channel.CloseReason
+	finishOnce  sync.Once
+}
+
+func newUDPAccess(user, clientIP, target string, stream mux.MuxStream, conf *channel.ProxyChannelConfig, kill func()) *udpAccess {
+	a := &udpAccess{
+		id:     atomic.AddUint64(&connIDSeed, 1),
+		stream: stream,
+		kill:   kill,
+		entry: channel.AccessLogEntry{
+			Start:       time.Now(),
+			Side:        "client",
+			User:        user,
+			ClientIP:    clientIP,
+			Protocol:    "udp",
+			Destination: target,
+			Channel:     conf.Name,
+			Server:      channel.StreamServer(stream, conf),
+		},
+	}
+	activeUDPFlows.Store(a, true)
+	return a
+}
+
+func (a *udpAccess) info() ConnectionInfo {
+	host, port, _ := net.SplitHostPort(a.entry.Destination)
+	info := ConnectionInfo{
+		ID:         a.id,
+		ClientAddr: a.entry.ClientIP,
+		User:       a.entry.User,
+		Host:       host,
+		Port:       port,
+		Protocol:   a.entry.Protocol,
+		PAC:        -1,
+		Channel:    a.entry.Channel,
+		Server:     a.entry.Server,
+		BytesUp:    atomic.LoadInt64(&a.bytesUp),
+		BytesDown:  atomic.LoadInt64(&a.bytesDown),
+		StartTime:  a.entry.Start,
+	}
+	if nil != a.stream {
+		info.StreamID = a.stream.StreamID()
+	}
+	return info
+}
+
+func (a *udpAccess) up(n int) {
+	atomic.AddInt64(&a.bytesUp, int64(n))
+}
+
+func (a *udpAccess) down(n int) {
+	atomic.AddInt64(&a.bytesDown, int64(n))
+}
+
+func (a *udpAccess) finish(reason string) {
+	a.finishOnce.Do(func() {
+		a.closeReason.Set(reason)
+		activeUDPFlows.Delete(a)
+		entry := a.entry
+		entry.BytesUp = atomic.LoadInt64(&a.bytesUp)
+		entry.BytesDown = atomic.LoadInt64(&a.bytesDown)
+		entry.CloseReason = a.closeReason.String()
+		channel.WriteAccessLog(&entry)
+	})
+}
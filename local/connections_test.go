@@ -0,0 +1,63 @@
+package local
+
+import (
+	"testing"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+type killStream struct {
+	mux.MuxStream
+	id     uint32
+	closed bool
+}
+
+func (s *killStream) StreamID() uint32 {
+	return s.id
+}
+
+func (s *killStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestUDPConnections(t *testing.T) {
+	conf := &channel.ProxyChannelConfig{Name: "test"}
+	relay := &socksUDPRelay{}
+	socksSession := newSocksUDPSession(relay, "8.8.8.8:53")
+	socksStream := &killStream{id: 1}
+	socksSession.stream = socksStream
+	socksSession.access = newUDPAccess("alice", "127.0.0.1", "8.8.8.8:53", socksStream, conf, socksSession.close)
+	relay.sessions.Store(socksSession.target, socksSession)
+
+	gwSession := getUDPSession(1000, nil, true)
+	gwStream := &killStream{id: 2}
+	gwSession.stream = gwStream
+	gwSession.access = newUDPAccess("bob", "127.0.0.2", "1.1.1.1:443", gwStream, conf, gwSession.close)
+
+	conns := listConnections()
+	if len(conns) != 2 {
+		t.Fatalf("Unexpected connections:%v", conns)
+	}
+	socksInfo, gwInfo := conns[0], conns[1]
+	if socksInfo.User != "alice" || socksInfo.Host != "8.8.8.8" || socksInfo.Port != "53" || socksInfo.Protocol != "udp" || socksInfo.StreamID != 1 || socksInfo.Channel != "test" {
+		t.Fatalf("Unexpected socks udp connection:%+v", socksInfo)
+	}
+	if gwInfo.User != "bob" || gwInfo.Host != "1.1.1.1" || gwInfo.StreamID != 2 {
+		t.Fatalf("Unexpected udpgw connection:%+v", gwInfo)
+	}
+
+	if !killConnection(socksInfo.ID) || !socksStream.closed || !socksSession.closed {
+		t.Fatalf("Expected socks udp session killed")
+	}
+	if _, exist := relay.sessions.Load(socksSession.target); exist {
+		t.Fatalf("Expected killed socks udp session removed")
+	}
+	if !killConnection(gwInfo.ID) || !gwStream.closed || nil != getUDPSession(1000, nil, false) {
+		t.Fatalf("Expected udpgw session killed & removed")
+	}
+	if len(listConnections()) != 0 || killConnection(gwInfo.ID) {
+		t.Fatalf("Expected no connection left")
+	}
+}
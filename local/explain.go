@@ -0,0 +1,227 @@
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/dns"
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+// RouteQuery is the connection to explain the route of.
+type RouteQuery struct {
+	//listen address of the proxy, the first proxy if empty
+	Proxy string
+	//'host' or 'host:port'
+	Host string
+	//the initial HTTP request URL, the host is parsed from it if empty
+	URL string
+	//the SNI sniffed from a SOCKS or transparent connection, which is routed
+	//instead of the IP host
+	SNI string
+	//protocol of the connection, 'tcp' for the sniffed SNI, 'http' for a plain
+	//HTTP URL & 'https' for the CONNECT request if empty
+	Protocol string
+	Source   string
+	User     string
+}
+
+// RuleEvaluation is the evaluation of a 'Rule' term of a PAC entry.
+type RuleEvaluation struct {
+	Rule   string
+	Result bool
+	//the matched GFWList rule, or the resolved IP of the host
+	Detail string
+}
+
+type PACEvaluation struct {
+	Index int
+	PAC   string
+	//whether the conditions except the Rule terms matched
+	Conditions bool
+	Rules      []RuleEvaluation
+	Matched    bool
+}
+
+// RouteExplanation describes how the PAC entries of a proxy route a connection.
+type RouteExplanation struct {
+	Proxy    string
+	Protocol string
+	//the routed host, the sniffed SNI if any
+	Host string
+	Port int
+	URL  string
+	//the 'SNI.Redirect' rewrite of the sniffed SNI
+	SNIRedirect string
+	//the evaluated PAC entries in order
+	Evaluations []PACEvaluation
+	//index of the matched PAC entry, -1 if none matched
+	PAC     int
+	Channel string
+	//the 'RemoteSNIProxy' host of the channel to connect instead
+	RemoteSNI string
+}
+
+func defaultPort(scheme string) int {
+	if strings.EqualFold(scheme, "http") {
+		return 80
+	}
+	return 443
+}
+
+// ExplainRoute evaluates every PAC entry of the proxy in order without caching
+// or counting the decision.
+func ExplainRoute(q RouteQuery) (*RouteExplanation, error) {
+	var proxy *ProxyConfig
+	for i := range GConf.Proxy {
+		if len(q.Proxy) == 0 || GConf.Proxy[i].Local == q.Proxy {
+			proxy = &GConf.Proxy[i]
+			break
+		}
+	}
+	if nil == proxy {
+		return nil, fmt.Errorf("No proxy found for:%s", q.Proxy)
+	}
+	scheme := ""
+	host := q.Host
+	if len(q.URL) > 0 {
+		u, err := url.Parse(q.URL)
+		if nil != err || len(u.Host) == 0 {
+			return nil, fmt.Errorf("Invalid URL:%s", q.URL)
+		}
+		scheme = u.Scheme
+		if len(host) == 0 {
+			host = u.Host
+		}
+	}
+	port := strconv.Itoa(defaultPort(scheme))
+	if h, p, err := net.SplitHostPort(host); nil == err {
+		host = h
+		port = p
+	}
+	portNum, err := strconv.Atoi(port)
+	if nil != err {
+		return nil, fmt.Errorf("Invalid port:%s", port)
+	}
+	if len(q.SNI) > 0 {
+		host = q.SNI
+	}
+	if len(host) == 0 {
+		return nil, fmt.Errorf("Empty host")
+	}
+	//the same as the protocol of the proxy connection sniffed by serveProxyConn
+	protocol := q.Protocol
+	if len(protocol) == 0 {
+		if len(q.SNI) > 0 {
+			protocol = "tcp"
+		} else if strings.EqualFold(scheme, "http") {
+			protocol = "http"
+		} else {
+			protocol = "https"
+		}
+	}
+	exp := &RouteExplanation{
+		Proxy:    proxy.Local,
+		Protocol: protocol,
+		Host:     host,
+		Port:     portNum,
+		URL:      q.URL,
+		PAC:      -1,
+	}
+	if len(q.SNI) > 0 {
+		if host = sniffedHost(q.SNI); host != q.SNI {
+			exp.SNIRedirect = host
+		}
+	}
+	r := newProxyPACRequest(protocol, host, port, net.ParseIP(q.Source), q.User)
+	for i := range proxy.PAC {
+		pac := &proxy.PAC[i]
+		ev := PACEvaluation{
+			Index:      i,
+			PAC:        pac.String(),
+			Conditions: pac.matchConditions(r, true),
+		}
+		ev.Matched = ev.Conditions
+		for _, rule := range pac.Rule {
+			ok, detail := pac.evalRule(strings.TrimPrefix(rule, "!"), r)
+			if strings.HasPrefix(rule, "!") {
+				ok = !ok
+			}
+			ev.Matched = ev.Matched && ok
+			ev.Rules = append(ev.Rules, RuleEvaluation{Rule: rule, Result: ok, Detail: detail})
+		}
+		exp.Evaluations = append(exp.Evaluations, ev)
+		if ev.Matched {
+			exp.PAC = i
+			exp.Channel = pac.Remote
+			break
+		}
+	}
+	if len(exp.Channel) > 0 && port == "443" && nil == net.ParseIP(host) {
+		for i := range GConf.Channel {
+			if GConf.Channel[i].Name == exp.Channel {
+				exp.RemoteSNI = GConf.Channel[i].GetRemoteSNI(host)
+				break
+			}
+		}
+	}
+	return exp, nil
+}
+
+// GET /route?host=www.google.com:443&proto=https&url=...&sni=... explains the route
+func routeCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	exp, err := ExplainRoute(RouteQuery{
+		Proxy:    r.FormValue("proxy"),
+		Host:     r.FormValue("host"),
+		URL:      r.FormValue("url"),
+		SNI:      r.FormValue("sni"),
+		Protocol: r.FormValue("proto"),
+		Source:   r.FormValue("source"),
+		User:     r.FormValue("user"),
+	})
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	js, _ := json.MarshalIndent(exp, "", "    ")
+	w.Write(js)
+}
+
+// ExplainRouteByConf loads the config & the rule sources like Start without
+// starting the proxy, then explains the route of the query.
+func ExplainRouteByConf(options ProxyOptions, q RouteQuery) (*RouteExplanation, error) {
+	proxyHome = options.Home
+	if err := loadClientConf(options.Config); nil != err {
+		return nil, err
+	}
+	var output []string
+	for _, name := range GConf.Log {
+		if !strings.EqualFold(name, "color") && !strings.EqualFold(name, "stdout") && !strings.EqualFold(name, "console") {
+			output = append(output, name)
+		}
+	}
+	logger.InitLogger(output)
+	GConf.LocalDNS.CNIPSet = options.CNIP
+	loadHostsConf(options.Hosts)
+	dnsConf := GConf.LocalDNS
+	dnsConf.Listen = ""
+	dnsConf.FakeIP = dns.FakeIPConfig{}
+	dns.Init(&dnsConf)
+	loadRuleSets()
+	if len(GConf.GFWList.URL) > 0 {
+		hc, _ := channel.NewHTTPClient(&channel.ProxyChannelConfig{Proxy: GConf.GFWList.Proxy}, "http")
+		loadGFWList(hc)
+	}
+	return ExplainRoute(q)
+}
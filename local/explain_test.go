@@ -0,0 +1,57 @@
+package local
+
+import (
+	"testing"
+)
+
+func TestExplainRouteAsProxy(t *testing.T) {
+	saved := GConf
+	defer func() {
+		GConf = saved
+	}()
+	GConf = LocalConfig{
+		Proxy: []ProxyConfig{{Local: ":48100", PAC: []PACConfig{
+			{URL: []string{"*/search*"}, Remote: "url"},
+			{Protocol: []string{"http"}, Host: []string{"plain.example"}, Remote: "http"},
+			{Protocol: []string{"https"}, URL: []string{"https://secure.example"}, Remote: "connect"},
+			{Protocol: []string{"tcp"}, Host: []string{"redirected.example"}, Remote: "sni"},
+			{Host: []string{"sni.example"}, Remote: "unredirected"},
+			{Remote: "Default"},
+		}}},
+		SNI: SNIConfig{Redirect: map[string]string{"sni.example": "redirected.example"}},
+	}
+	if err := GConf.init(); nil != err {
+		t.Fatal(err)
+	}
+	proxy := &GConf.Proxy[0]
+	for _, c := range []struct {
+		q RouteQuery
+		//the request built by serveProxyConn for the same connection
+		r   *PACRequest
+		pac int
+	}{
+		{RouteQuery{Host: "secure.example:443"}, newProxyPACRequest("https", "secure.example", "443", nil, ""), 2},
+		{RouteQuery{URL: "http://plain.example/search?q=1"}, newProxyPACRequest("http", "plain.example", "80", nil, ""), 1},
+		{RouteQuery{Host: "sni.example:443"}, newProxyPACRequest("https", "sni.example", "443", nil, ""), 4},
+		{RouteQuery{Host: "1.2.3.4:443", SNI: "sni.example"}, newProxyPACRequest("tcp", sniffedHost("sni.example"), "443", nil, ""), 3},
+	} {
+		exp, err := ExplainRoute(c.q)
+		if nil != err {
+			t.Fatal(err)
+		}
+		pac, channel := proxy.selectPAC(c.r)
+		if pac != c.pac || exp.PAC != pac || exp.Channel != channel {
+			t.Fatalf("Unexpected explanation:%d:%s of %+v, the proxy selected:%d:%s", exp.PAC, exp.Channel, c.q, pac, channel)
+		}
+		if exp.Protocol != c.r.Protocol || exp.Port != c.r.Port {
+			t.Fatalf("Unexpected protocol:%s or port:%d of %+v", exp.Protocol, exp.Port, c.q)
+		}
+	}
+	exp, _ := ExplainRoute(RouteQuery{Host: "1.2.3.4:443", SNI: "sni.example"})
+	if exp.Host != "sni.example" || exp.SNIRedirect != "redirected.example" {
+		t.Fatalf("Unexpected SNI redirect:%+v", exp)
+	}
+	if exp, _ = ExplainRoute(RouteQuery{Host: "sni.example:443"}); len(exp.SNIRedirect) > 0 {
+		t.Fatalf("Unexpected SNI redirect of the host:%+v", exp)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -62,12 +63,134 @@ func isTimeoutErr(err error) bool {
 type proxyStreamContext struct {
 	stream mux.MuxStream
 	c      io.ReadWriteCloser
+	user   string
+
+	id         uint64
+	clientAddr string
+	host       string
+	port       string
+	sniffed    bool
+	protocol   string
+	pacIdx     int
+	pacRule    string
+	channel    string
+	server     string
+	start      time.Time
+	bytesUp    int64
+	bytesDown  int64
+
+	closeReason channel.CloseReason
+	finishOnce  sync.Once
+}
+
+func (ctx *proxyStreamContext) close() {
+	if nil != ctx.c {
+		ctx.c.Close()
+	}
+	if nil != ctx.stream {
+		ctx.stream.Close()
+	}
 }
 
 var ssidSeed = uint32(0)
+var connIDSeed uint64
+
+// openProxyStream opens a stream by the named channel and connects it by the
+// given func, members of a channel group are tried in order until one connects.
+func openProxyStream(channelName string, connect func(stream mux.MuxStream, conf *channel.ProxyChannelConfig) error) (mux.MuxStream, *channel.ProxyChannelConfig, error) {
+	var lastErr error
+	for _, name := range channel.GetChannelCandidates(channelName) {
+		stream, conf, err := channel.GetMuxStreamByChannel(name)
+		if nil != err || nil == stream {
+			logger.Error("Failed to open stream for reason:%v by proxy:%s", err, name)
+			clientConnectErrors.Inc(name, "open-stream")
+			lastErr = err
+			continue
+		}
+		err = connect(stream, conf)
+		if nil == err {
+			return stream, conf, nil
+		}
+		logger.Error("Connect failed by proxy:%s for reason:%v", name, err)
+		clientConnectErrors.Inc(name, channel.ConnectErrorReason(err))
+		channel.ReportConnectFailure(stream, err)
+		stream.Close()
+		lastErr = err
+	}
+	if nil == lastErr {
+		lastErr = fmt.Errorf("No stream opened by proxy:%s", channelName)
+	}
+	return nil, nil, lastErr
+}
+
+// httpRequestTarget returns the host & port the proxy request is sent to.
+func httpRequestTarget(req *http.Request) (string, string) {
+	if strings.Contains(req.Host, ":") {
+		host, port, _ := net.SplitHostPort(req.Host)
+		return host, port
+	}
+	if strings.EqualFold(req.Method, "CONNECT") {
+		return req.Host, "443"
+	}
+	return req.Host, "80"
+}
+
+// authHTTPProxy verifies the proxy credentials of the request, and replies 407
+// to the client if it failed.
+func authHTTPProxy(proxy *ProxyConfig, req *http.Request, w io.Writer) (string, bool) {
+	user, ok := proxy.verifyHTTPProxyAuth(req)
+	if !ok {
+		w.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"gsnova\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+	}
+	return user, ok
+}
+
+// connectFailureReply maps the connect error to SOCKS5 reply code & HTTP status.
+func connectFailureReply(err error) (byte, int) {
+	switch mux.ConnectErrorClass(err) {
+	case mux.ConnectErrNotAllowed:
+		return socks.SocksRepConnectionNotAllowed, http.StatusForbidden
+	case mux.ConnectErrTimeout:
+		return socks.SocksRepHostUnreachable, http.StatusGatewayTimeout
+	case mux.ConnectErrRefused:
+		return socks.SocksRepConnectionRefused, http.StatusBadGateway
+	case mux.ConnectErrHostUnreachable, mux.ConnectErrDNS:
+		return socks.SocksRepHostUnreachable, http.StatusBadGateway
+	case mux.ConnectErrNetUnreachable:
+		return socks.SocksRepNetworkUnreachable, http.StatusBadGateway
+	}
+	return socks.SocksRepGeneralFailure, http.StatusBadGateway
+}
+
+func replyConnectFailure(socksConn *socks.SocksConn, isHTTP bool, localConn net.Conn, err error) {
+	rep, status := connectFailureReply(err)
+	if nil != socksConn {
+		socksConn.RejectReason(rep)
+	} else if isHTTP {
+		body := err.Error() + "\n"
+		fmt.Fprintf(localConn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", status, http.StatusText(status), len(body), body)
+	}
+}
+
+// sniffedHost returns the host to connect for the sniffed SNI, which is
+// rewritten by the 'SNI.Redirect' rules.
+func sniffedHost(sni string) string {
+	if redirect, ok := GConf.SNI.redirect(sni); ok {
+		return redirect
+	}
+	return sni
+}
+
+// newProxyPACRequest builds the request of a proxy connection routed by the PAC
+// rules, which is matched as a CONNECT to the host.
+func newProxyPACRequest(protocol string, host string, port string, source net.IP, user string) *PACRequest {
+	p, _ := strconv.Atoi(port)
+	return newHostPACRequest(protocol, host, p, source, user)
+}
 
 func serveProxyConn(conn net.Conn, remoteHost, remotePort string, proxy *ProxyConfig) {
 	var proxyChannelName string
+	var pacIdx int
 	protocol := "tcp"
 	localConn := conn
 	atomic.AddInt64(&runningProxyStreamCount, 1)
@@ -84,7 +207,16 @@ func serveProxyConn(conn net.Conn, remoteHost, remotePort string, proxy *ProxyCo
 	isHttp11Proto := false
 	mitmEnabled := false
 	isTransparentProxy := len(remoteHost) > 0
+	if domain, ok := dns.FakeIPDomain(remoteHost); ok {
+		logger.Debug("Map fake IP:%s to domain:%s", remoteHost, domain)
+		remoteHost = domain
+	}
 	var initialHTTPReq *http.Request
+	//reply to the client after the stream connected
+	var pendingSocksConn *socks.SocksConn
+	pendingHTTPConnect := false
+	//the authenticated user of the proxy connection
+	var proxyUser string
 
 	var bufconn *helper.BufConn
 
@@ -102,24 +234,47 @@ func serveProxyConn(conn net.Conn, remoteHost, remotePort string, proxy *ProxyCo
 	}
 	//logger.Info("###Enter with %v %v", isTransparentProxy, remoteHost)
 	if !isTransparentProxy {
-		socksConn, sbufconn, err := socks.NewSocksConn(conn)
+		var socksAuth socks.Authenticator
+		if proxy.authRequired() {
+			socksAuth = proxy.verifyUser
+		}
+		socksConn, sbufconn, err := socks.NewSocksConnWithAuth(conn, socksAuth)
 		if nil == err {
 			isSocksProxy = true
-			logger.Debug("Local proxy recv %s proxy conn to %s", socksConn.Version(), socksConn.Req.Target)
-			socksConn.Grant(&net.TCPAddr{
-				IP: net.ParseIP("0.0.0.0"), Port: 0})
+			if proxy.authRequired() {
+				proxyUser = socksConn.Req.Username
+			}
+			logger.Debug("Local proxy recv %s proxy conn to %s by user:%s", socksConn.Version(), socksConn.Req.Target, proxyUser)
 			localConn = socksConn
+			if socksConn.IsUDPAssociate() {
+				handleSocksUDPAssociate(socksConn, proxy, proxyUser)
+				return
+			}
 			if socksConn.Req.Target == GConf.UDPGW.Addr {
+				socksConn.Grant(&net.TCPAddr{
+					IP: net.ParseIP("0.0.0.0"), Port: 0})
 				logger.Debug("Handle udpgw conn for %v", socksConn.Req.Target)
-				handleUDPGatewayConn(localConn, proxy)
+				handleUDPGatewayConn(localConn, proxy, proxyUser)
 				return
 			}
 
 			remoteHost, remotePort, err = net.SplitHostPort(socksConn.Req.Target)
 			if nil != err {
 				logger.Error("Invalid socks target addresss:%s with reason %v", socksConn.Req.Target, err)
+				socksConn.RejectReason(socks.SocksRepAddressNotSupported)
 				return
 			}
+			if domain, ok := dns.FakeIPDomain(remoteHost); ok {
+				logger.Debug("Map fake IP:%s to domain:%s", remoteHost, domain)
+				remoteHost = domain
+			}
+			if net.ParseIP(remoteHost) != nil && !helper.IsPrivateIP(remoteHost) {
+				//grant now since the domain would be sniffed from the client data
+				socksConn.Grant(&net.TCPAddr{
+					IP: net.ParseIP("0.0.0.0"), Port: 0})
+			} else {
+				pendingSocksConn = socksConn
+			}
 		} else { //not socks proxy
 			if nil == sbufconn {
 				localConn.Close()
@@ -151,17 +306,15 @@ func serveProxyConn(conn net.Conn, remoteHost, remotePort string, proxy *ProxyCo
 			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
 		}
 
-		if nil != dns.CNIPSet {
+		if dns.HasCountryIPSet("CN") {
 			remoteIP := net.ParseIP(remoteHost)
-			logger.Debug("Recv proxy request to IP:%v CNIP:%v", remoteIP, dns.CNIPSet.IsInCountry(remoteIP, "CN"))
+			logger.Debug("Recv proxy request to IP:%v CNIP:%v", remoteIP, dns.IsInCountry(remoteIP, "CN"))
 		}
 		sni, err := helper.PeekTLSServerName(bufconn)
 		if nil != err {
 			//logger.Debug("##Failed to sniff SNI with error:%v", err)
 		} else {
-			if redirect, ok := GConf.SNI.redirect(sni); ok {
-				sni = redirect
-			}
+			sni = sniffedHost(sni)
 			logger.Debug("Sniffed SNI:%s:%s for IP:%s:%s", sni, remotePort, remoteHost, remotePort)
 			remoteHost = sni
 			trySniffDomain = false
@@ -227,28 +380,22 @@ func serveProxyConn(conn net.Conn, remoteHost, remotePort string, proxy *ProxyCo
 				logger.Error("Read first request failed from proxy connection for reason:%v", err)
 				return
 			}
-			//log.Printf("Host:%s %v", initialHTTPReq.Host, initialHTTPReq.URL)
-			if strings.Contains(initialHTTPReq.Host, ":") {
-				remoteHost, remotePort, _ = net.SplitHostPort(initialHTTPReq.Host)
-			} else {
-				remoteHost = initialHTTPReq.Host
-				remotePort = "80"
-				if strings.EqualFold(initialHTTPReq.Method, "CONNECT") {
-					remotePort = "443"
+			if !isSocksProxy && !isTransparentProxy && proxy.authRequired() {
+				user, ok := authHTTPProxy(proxy, initialHTTPReq, localConn)
+				if !ok {
+					logger.Error("[ERROR]Proxy authentication failed for user:'%s' from %v", user, conn.RemoteAddr())
+					return
 				}
+				proxyUser = user
 			}
+			//log.Printf("Host:%s %v", initialHTTPReq.Host, initialHTTPReq.URL)
+			remoteHost, remotePort = httpRequestTarget(initialHTTPReq)
 			if strings.EqualFold(initialHTTPReq.Method, "CONNECT") {
 				protocol = "https"
 				if !isSocksProxy {
-					localConn.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
+					pendingHTTPConnect = true
 					isHttpsProxy = true
 					initialHTTPReq = nil
-					if proxy.MITM {
-						err := buildMITMConn()
-						if nil != err {
-							return
-						}
-					}
 				}
 			} else {
 				protocol = "http"
@@ -265,18 +412,41 @@ START:
 		logger.Error("Can NOT resolve remote host or port %s:%s %v", remoteHost, remotePort, initialHTTPReq)
 		return
 	}
-	proxyChannelName = proxy.getProxyChannelByHost(protocol, remoteHost)
+	pacIdx, proxyChannelName = proxy.selectPAC(newProxyPACRequest(protocol, remoteHost, remotePort, sourceIP(conn.RemoteAddr()), proxyUser))
+	newStreamContext := func() *proxyStreamContext {
+		ctx := &proxyStreamContext{
+			c:          localConn,
+			user:       proxyUser,
+			id:         atomic.AddUint64(&connIDSeed, 1),
+			clientAddr: conn.RemoteAddr().String(),
+			host:       remoteHost,
+			port:       remotePort,
+			sniffed:    len(sniffedSNI) > 0,
+			protocol:   "http",
+			pacIdx:     pacIdx,
+			channel:    proxyChannelName,
+			start:      time.Now(),
+		}
+		switch {
+		case isTransparentProxy:
+			ctx.protocol = "transparent"
+		case isSocksProxy:
+			ctx.protocol = "socks"
+		case isHttpsProxy:
+			ctx.protocol = "https"
+		}
+		if pacIdx >= 0 && pacIdx < len(proxy.PAC) {
+			ctx.pacRule = proxy.PAC[pacIdx].String()
+		}
+		return ctx
+	}
 
 	if len(proxyChannelName) == 0 {
 		logger.Error("[ERROR]No proxy found for %s:%s", protocol, remoteHost)
+		replyConnectFailure(pendingSocksConn, pendingHTTPConnect || nil != initialHTTPReq, localConn, &mux.ConnectError{Class: mux.ConnectErrNotAllowed, Reason: "no proxy found"})
+		newStreamContext().finish("no-proxy")
 		return
 	}
-	stream, conf, err := channel.GetMuxStreamByChannel(proxyChannelName)
-	if nil != err || nil == stream {
-		logger.Error("Failed to open stream for reason:%v by proxy:%s", err, proxyChannelName)
-		return
-	}
-	defer stream.Close()
 
 	var maxIdleTime time.Duration
 	if GConf.Mux.StreamIdleTimeout < 0 {
@@ -288,30 +458,58 @@ START:
 		}
 	}
 
-	ssid := stream.StreamID()
-	if 0 == ssid {
-		ssid = atomic.AddUint32(&ssidSeed, uint32(1))
-	}
-	opt := mux.StreamOptions{
-		DialTimeout: conf.RemoteDialMSTimeout,
-		Hops:        conf.Hops,
-		ReadTimeout: int(maxIdleTime.Seconds()) * 1000,
-	}
-	if remotePort == "443" && nil == net.ParseIP(remoteHost) {
-		remoteSNI := conf.GetRemoteSNI(remoteHost)
-		if len(remoteSNI) > 0 {
-			sniHost := hosts.GetHost(remoteSNI)
-			logger.Notice("Proxy stream[%d] select remote SNI host %s for proxy to %s:%s", ssid, sniHost, remoteHost, remotePort)
-			remoteHost = sniHost
+	var ssid uint32
+	stream, conf, err := openProxyStream(proxyChannelName, func(stream mux.MuxStream, conf *channel.ProxyChannelConfig) error {
+		ssid = stream.StreamID()
+		if 0 == ssid {
+			ssid = atomic.AddUint32(&ssidSeed, uint32(1))
 		}
-	}
-
-	logger.Notice("Proxy stream[%d] select %s for proxy to %s:%s", ssid, proxyChannelName, remoteHost, remotePort)
-	err = stream.Connect("tcp", net.JoinHostPort(remoteHost, remotePort), opt)
+		opt := mux.StreamOptions{
+			DialTimeout: conf.RemoteDialMSTimeout,
+			Hops:        conf.Hops,
+			ReadTimeout: int(maxIdleTime.Seconds()) * 1000,
+		}
+		connectHost := remoteHost
+		if remotePort == "443" && nil == net.ParseIP(remoteHost) {
+			remoteSNI := conf.GetRemoteSNI(remoteHost)
+			if len(remoteSNI) > 0 {
+				connectHost = hosts.GetHost(remoteSNI)
+				logger.Notice("Proxy stream[%d] select remote SNI host %s for proxy to %s:%s", ssid, connectHost, remoteHost, remotePort)
+			}
+		}
+		if len(proxyUser) > 0 {
+			logger.Notice("Proxy stream[%d] select %s for proxy to %s:%s by user:%s", ssid, conf.Name, connectHost, remotePort, proxyUser)
+		} else {
+			logger.Notice("Proxy stream[%d] select %s for proxy to %s:%s", ssid, conf.Name, connectHost, remotePort)
+		}
+		err := stream.Connect("tcp", net.JoinHostPort(connectHost, remotePort), opt)
+		if nil == err {
+			remoteHost = connectHost
+		}
+		return err
+	})
 	if nil != err {
-		logger.Error("Connect failed from proxy connection for reason:%v", err)
+		logger.Error("Failed to open stream for reason:%v by proxy:%s", err, proxyChannelName)
+		replyConnectFailure(pendingSocksConn, pendingHTTPConnect || nil != initialHTTPReq, localConn, err)
+		newStreamContext().finish("connect-failed:" + channel.ConnectErrorReason(err))
 		return
 	}
+	defer stream.Close()
+	if nil != pendingSocksConn {
+		pendingSocksConn.Grant(&net.TCPAddr{
+			IP: net.ParseIP("0.0.0.0"), Port: 0})
+		pendingSocksConn = nil
+	}
+	if pendingHTTPConnect {
+		pendingHTTPConnect = false
+		localConn.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
+		if proxy.MITM {
+			err := buildMITMConn()
+			if nil != err {
+				return
+			}
+		}
+	}
 
 	//clear read timeout
 	var zero time.Time
@@ -330,6 +528,14 @@ START:
 	} else {
 		streamReader, streamWriter = mux.GetCompressStreamReaderWriter(stream, conf.Compressor)
 	}
+	streamCtx := newStreamContext()
+	streamCtx.stream = stream
+	streamCtx.c = localConn
+	streamCtx.host = remoteHost
+	streamCtx.channel = conf.Name
+	streamCtx.server = channel.StreamServer(stream, conf)
+	streamReader = &meteredReader{Reader: streamReader, counter: clientBytes.With(conf.Name, streamCtx.server, "down"), bytes: &streamCtx.bytesDown}
+	streamWriter = &meteredWriter{Writer: streamWriter, counter: clientBytes.With(conf.Name, streamCtx.server, "up"), bytes: &streamCtx.bytesUp, closer: stream}
 
 	if proxy.HTTPDump.MatchDomain(remoteHost) {
 		_, isTLSConn := localConn.(*tls.Conn)
@@ -346,10 +552,8 @@ START:
 		defer dumpReadWriter.Close()
 	}
 
-	streamCtx := &proxyStreamContext{}
-	streamCtx.stream = stream
-	streamCtx.c = localConn
 	activeStreams.Store(streamCtx, true)
+	defer streamCtx.finish("closed")
 
 	start := time.Now()
 	closeCh := make(chan int, 1)
@@ -357,6 +561,7 @@ START:
 		//buf := make([]byte, 128*1024)
 		buf := downBytesPool.Get().([]byte)
 		_, cerr := io.CopyBuffer(localConn, streamReader, buf)
+		streamCtx.closeReason.Set(channel.CopyCloseReason("remote", cerr))
 		logger.Notice("Proxy stream[%d] cost %v to copy from  %s:%v %v", ssid, time.Now().Sub(start), remoteHost, remotePort, cerr)
 		localConn.Close()
 		bufconn.Close()
@@ -377,6 +582,7 @@ START:
 				continue
 			}
 			//logger.Error("###%s %v after %v", remoteHost, cerr, time.Now().Sub(stream.LatestIOTime()))
+			streamCtx.closeReason.Set(channel.CopyCloseReason("client", cerr))
 			break
 		}
 		upBytesPool.Put(buf)
@@ -397,6 +603,7 @@ START:
 				err = proxyReq.Write(streamWriter)
 				if nil != err {
 					logger.Error("Failed to write http request for reason:%v", err)
+					streamCtx.closeReason.Set("error")
 					return
 				}
 			}
@@ -416,18 +623,33 @@ START:
 				if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
 					logger.Notice("Failed to read proxy http request to %s:%s for reason:%v", remoteHost, remotePort, err)
 				}
+				streamCtx.closeReason.Set(channel.CopyCloseReason("client", err))
 				return
 			}
-			if nil != prevReq && prevReq.Host != proxyReq.Host {
-				logger.Debug("Switch to next stream since target host change from %s to %s", prevReq.Host, proxyReq.Host)
+			userSwitched := false
+			if !isSocksProxy && !isTransparentProxy && proxy.authRequired() {
+				//every request on the connection carries its own credentials
+				user, ok := authHTTPProxy(proxy, proxyReq, localConn)
+				if !ok {
+					logger.Error("[ERROR]Proxy authentication failed for user:'%s' from %v", user, conn.RemoteAddr())
+					streamCtx.closeReason.Set("auth-failed")
+					return
+				}
+				userSwitched = user != proxyUser
+				proxyUser = user
+			}
+			if nil != prevReq && (prevReq.Host != proxyReq.Host || userSwitched) {
+				logger.Debug("Switch to next stream since target host change from %s to %s by user:%s", prevReq.Host, proxyReq.Host, proxyUser)
 				stream.Close()
+				streamCtx.finish("host-switch")
+				//route the request by its own host & user
+				initialHTTPReq = proxyReq
+				remoteHost, remotePort = httpRequestTarget(proxyReq)
 				goto START
 			}
 		}
 	}
 	<-closeCh
-
-	activeStreams.Delete(streamCtx)
 }
 
 func startLocalProxyServer(proxyIdx int) (*net.TCPListener, error) {
@@ -506,6 +728,7 @@ func stopLocalServers() {
 	closeAllUDPSession()
 	activeStreams.Range(func(key, value interface{}) bool {
 		ctx := key.(*proxyStreamContext)
+		ctx.closeReason.Set("shutdown")
 		if nil != ctx.c {
 			ctx.c.Close()
 		}
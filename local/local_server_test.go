@@ -0,0 +1,68 @@
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestAuthHTTPProxy(t *testing.T) {
+	proxy := &ProxyConfig{Users: map[string]string{"alice": "secret"}}
+	for _, c := range []struct {
+		user, passwd string
+		header       string
+		ok           bool
+	}{
+		{header: "", ok: false},
+		{user: "alice", passwd: "wrong", ok: false},
+		{user: "bob", passwd: "secret", ok: false},
+		{header: "Basic !!!", ok: false},
+		{header: "Bearer token", ok: false},
+		{user: "alice", passwd: "secret", ok: true},
+	} {
+		req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		if len(c.user) > 0 {
+			req.SetBasicAuth(c.user, c.passwd)
+			req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+			req.Header.Del("Authorization")
+		} else if len(c.header) > 0 {
+			req.Header.Set("Proxy-Authorization", c.header)
+		}
+		var buf bytes.Buffer
+		user, ok := authHTTPProxy(proxy, req, &buf)
+		if ok != c.ok {
+			t.Fatalf("Unexpected auth result for %+v", c)
+		}
+		if ok {
+			if user != c.user || buf.Len() > 0 {
+				t.Fatalf("Unexpected user:%s or reply:%s", user, buf.String())
+			}
+			continue
+		}
+		res, err := http.ReadResponse(bufio.NewReader(&buf), req)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusProxyAuthRequired || res.Header.Get("Proxy-Authenticate") != `Basic realm="gsnova"` {
+			t.Fatalf("Unexpected reply:%v for %+v", res, c)
+		}
+	}
+}
+
+func TestHTTPRequestTarget(t *testing.T) {
+	for _, c := range []struct {
+		method, url string
+		host, port  string
+	}{
+		{"GET", "http://www.example.com/", "www.example.com", "80"},
+		{"GET", "http://www.example.com:8080/", "www.example.com", "8080"},
+		{"CONNECT", "https://www.example.com", "www.example.com", "443"},
+		{"CONNECT", "https://[::1]:8443", "::1", "8443"},
+	} {
+		req, _ := http.NewRequest(c.method, c.url, nil)
+		if host, port := httpRequestTarget(req); host != c.host || port != c.port {
+			t.Fatalf("Unexpected target %s:%s of %s %s", host, port, c.method, c.url)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package local
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/yinqiwen/gsnova/common/metrics"
+)
+
+var clientBytes = metrics.NewCounterVec("gsnova_client_bytes_total", "Bytes proxied by channels, 'up' is sent to servers.", "channel", "server", "direction")
+var clientConnectErrors = metrics.NewCounterVec("gsnova_client_connect_errors_total", "Failed connects of proxy streams by reason.", "channel", "reason")
+var pacDecisions = metrics.NewCounterVec("gsnova_client_pac_decisions_total", "Proxy channels selected by PAC rules.", "proxy", "channel")
+var gfwListDecisions = metrics.NewCounterVec("gsnova_client_gfwlist_decisions_total", "Results of the 'BlockedByGFW' PAC rule.", "result")
+
+type meteredReader struct {
+	io.Reader
+	counter *metrics.Counter
+	bytes   *int64
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.counter.Add(int64(n))
+		atomic.AddInt64(r.bytes, int64(n))
+	}
+	return n, err
+}
+
+// meteredWriter keeps the Close of the underlying writer.
+type meteredWriter struct {
+	io.Writer
+	counter *metrics.Counter
+	bytes   *int64
+	closer  io.Closer
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		w.counter.Add(int64(n))
+		atomic.AddInt64(w.bytes, int64(n))
+	}
+	return n, err
+}
+
+func (w *meteredWriter) Close() error {
+	if c, ok := w.Writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return w.closer.Close()
+}
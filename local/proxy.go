@@ -1,25 +1,32 @@
 package local
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/yinqiwen/gotoolkit/gfwlist"
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/dns"
+	"github.com/yinqiwen/gsnova/common/gfwlist"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/hosts"
 	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+	"github.com/yinqiwen/gsnova/common/ruleset"
 )
 
 var proxyHome string
 
 var localGFWList atomic.Value
 var fetchGFWListRunning bool
+var fetchRemoteFilesRunning bool
 
 func init() {
 	proxyHome = "."
@@ -46,6 +53,7 @@ func loadHostsConf(conf string) error {
 	if nil != err {
 		logger.Error("Failed to init local hosts with reason:%v.", err)
 	}
+	purgePACCache()
 	return err
 }
 
@@ -105,6 +113,7 @@ func loadGFWList(hc *http.Client) error {
 	}
 	logger.Info("GFWList sync success.")
 	localGFWList.Store(gfw)
+	purgePACCache()
 	return nil
 }
 
@@ -132,9 +141,177 @@ func initGFWList() {
 	}
 }
 
+type channelStreamConn struct {
+	mux.MuxStreamConn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *channelStreamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *channelStreamConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// newChannelHTTPClient returns a http client connecting servers by streams of
+// the channel.
+func newChannelHTTPClient(channelName string) *http.Client {
+	tr := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			stream, conf, err := openProxyStream(channelName, func(stream mux.MuxStream, conf *channel.ProxyChannelConfig) error {
+				opt := mux.StreamOptions{
+					DialTimeout: conf.RemoteDialMSTimeout,
+				}
+				return stream.Connect("tcp", addr, opt)
+			})
+			if nil != err {
+				return nil, err
+			}
+			c := &channelStreamConn{MuxStreamConn: mux.MuxStreamConn{MuxStream: stream}}
+			c.r, c.w = mux.GetCompressStreamReaderWriter(stream, conf.Compressor)
+			return c, nil
+		},
+		DisableKeepAlives: true,
+	}
+	return &http.Client{Transport: tr, Timeout: 60 * time.Second}
+}
+
+// remoteFile is fetched from the URL by the channel periodically and cached
+// into the file.
+type remoteFile struct {
+	desc                 string
+	url                  string
+	channel              string
+	file                 string
+	refreshPeriodMinutes int
+	parse                func(content []byte) error
+}
+
+func remoteFiles() []remoteFile {
+	var files []remoteFile
+	for _, conf := range GConf.LocalDNS.CountryIP {
+		country := conf.Country
+		files = append(files, remoteFile{
+			desc:                 "IP ranges of country:" + country,
+			url:                  conf.URL,
+			channel:              conf.Channel,
+			file:                 conf.File,
+			refreshPeriodMinutes: conf.RefreshPeriodMinutes,
+			parse: func(content []byte) error {
+				set, err := dns.ParseIPRangeSet(bytes.NewReader(content))
+				if nil == err {
+					dns.SetCountryIPSet(country, set)
+				}
+				return err
+			},
+		})
+	}
+	for _, conf := range GConf.RuleSet {
+		name, format := conf.Name, conf.Format
+		files = append(files, remoteFile{
+			desc:                 "rule set:" + name,
+			url:                  conf.URL,
+			channel:              conf.Channel,
+			file:                 conf.File,
+			refreshPeriodMinutes: conf.RefreshPeriodMinutes,
+			parse: func(content []byte) error {
+				set, err := ruleset.Parse(bytes.NewReader(content), format)
+				if nil == err {
+					ruleset.Set(name, set)
+				}
+				return err
+			},
+		})
+	}
+	return files
+}
+
+func fetchRemoteFile(f *remoteFile) error {
+	channelName := f.channel
+	if len(channelName) == 0 {
+		channelName = channel.DirectChannelName
+	}
+	resp, err := newChannelHTTPClient(channelName).Get(f.url)
+	if nil != err {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unexpected response status:%d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if nil != err {
+		return err
+	}
+	if err = f.parse(body); nil != err {
+		return err
+	}
+	purgePACCache()
+	logger.Info("Sync %s from %s by channel:%s", f.desc, f.url, channelName)
+	if len(f.file) > 0 {
+		if err = ioutil.WriteFile(f.file, body, 0644); nil != err {
+			logger.Error("Failed to save %s into %s for reason:%v", f.desc, f.file, err)
+		}
+	}
+	return nil
+}
+
+// initRemoteFiles refreshes the remote files periodically. The GFWList is not
+// one of them but refreshed by initGFWList, since it's fetched by the Proxy of
+// the GFWList config instead of a channel, never cached into a file & merged
+// with the user rules after each fetch.
+func initRemoteFiles() {
+	if fetchRemoteFilesRunning {
+		return
+	}
+	fetchRemoteFilesRunning = true
+	//keyed by desc since the files may share the same url
+	nextRefreshTime := make(map[string]time.Time)
+	for {
+		for _, f := range remoteFiles() {
+			if len(f.url) == 0 || time.Now().Before(nextRefreshTime[f.desc]) {
+				continue
+			}
+			refreshPeriod := time.Duration(f.refreshPeriodMinutes) * time.Minute
+			if refreshPeriod <= 0 {
+				refreshPeriod = 1440 * time.Minute
+			}
+			if err := fetchRemoteFile(&f); nil != err {
+				logger.Error("Failed to fetch %s from %s for reason:%v", f.desc, f.url, err)
+				refreshPeriod = 30 * time.Second
+			}
+			nextRefreshTime[f.desc] = time.Now().Add(refreshPeriod)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// loadRuleSets loads the cached files of the rule sets.
+func loadRuleSets() {
+	for _, conf := range GConf.RuleSet {
+		if len(conf.File) == 0 {
+			continue
+		}
+		set, err := ruleset.Load(conf.File, conf.Format)
+		if nil != err {
+			logger.Error("Failed to load rule set:%s from %s for reason:%v", conf.Name, conf.File, err)
+			continue
+		}
+		ruleset.Set(conf.Name, set)
+		logger.Info("Load %d domains of rule set:%s from %s", set.Len(), conf.Name, conf.File)
+	}
+}
+
 func StartProxy() error {
 	GConf.init()
-	logger.InitLogger(GConf.Log)
+	if err := logger.Init(logger.Config{Output: GConf.Log, Level: GConf.LogLevel, JSON: GConf.LogJSON, Rotate: GConf.LogRotate}); nil != err {
+		logger.Error("[ERROR]Failed to init logger for reason:%v", err)
+	}
+	if err := channel.InitAccessLog(GConf.AccessLog); nil != err {
+		logger.Error("[ERROR]Failed to init access log:%s for reason:%v", GConf.AccessLog.Path, err)
+	}
 	channel.SetDefaultMuxConfig(GConf.Mux)
 
 	channel.UPNPExposePort = GConf.UPNPExposePort
@@ -143,6 +320,8 @@ func StartProxy() error {
 	}
 	dns.Init(&GConf.LocalDNS)
 	go initGFWList()
+	loadRuleSets()
+	go initRemoteFiles()
 
 	logger.Notice("Allowed proxy channel with schema:%v", channel.AllowedSchema())
 	singalCh := make(chan bool, len(GConf.Channel))
@@ -151,6 +330,11 @@ func StartProxy() error {
 		if !conf.Enable {
 			continue
 		}
+		if conf.IsGroup() {
+			groupConf := conf
+			channel.InitChannelGroup(&groupConf)
+			continue
+		}
 		channel := channel.NewProxyChannel(&conf)
 		channel.Conf = conf
 		channelCount++
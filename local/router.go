@@ -0,0 +1,151 @@
+package local
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/route"
+)
+
+const (
+	pacCacheSize = 10000
+	pacCacheTTL  = time.Minute
+)
+
+// pacRouter is the PAC rules of a proxy compiled at load time, the Host
+// patterns are indexed by a domain trie & the IP CIDRs by a radix tree, so that
+// only the candidate rules are matched in order. The decisions are cached
+// unless the domain of the request is resolved by the rules, since the IP of
+// the domain may change.
+type pacRouter struct {
+	pac      []PACConfig
+	hosts    *route.PatternIndex
+	ips      *route.IPTree
+	withHost []bool
+	withIP   []bool
+	cache    *route.LRU
+
+	//the request fields matched by the rules besides the host, only these are
+	//in the cache key so that the clients share the decisions of a host
+	byProtocol bool
+	byPort     bool
+	bySource   bool
+	byUser     bool
+	byURL      bool
+}
+
+func newPACRouter(pac []PACConfig) *pacRouter {
+	r := &pacRouter{
+		pac:      pac,
+		hosts:    route.NewPatternIndex(),
+		ips:      route.NewIPTree(),
+		withHost: make([]bool, len(pac)),
+		withIP:   make([]bool, len(pac)),
+		cache:    route.NewLRU(pacCacheSize, pacCacheTTL),
+	}
+	for i := range pac {
+		for _, pattern := range pac[i].Host {
+			r.hosts.Add(pattern, i)
+			r.withHost[i] = true
+		}
+		for _, ipnet := range pac[i].ipNets {
+			r.ips.Add(ipnet, i)
+			r.withIP[i] = true
+		}
+		r.byProtocol = r.byProtocol || len(pac[i].Protocol) > 0
+		r.byPort = r.byPort || len(pac[i].Port) > 0
+		r.bySource = r.bySource || len(pac[i].Source) > 0
+		r.byUser = r.byUser || len(pac[i].User) > 0
+		r.byURL = r.byURL || len(pac[i].Method) > 0 || len(pac[i].URL) > 0
+		for _, rule := range pac[i].Rule {
+			//the GFWList rules match the url
+			if strings.EqualFold(strings.TrimPrefix(rule, "!"), BlockedByGFWRule) {
+				r.byURL = true
+			}
+		}
+	}
+	return r
+}
+
+func (router *pacRouter) cacheKey(r *PACRequest) string {
+	key := r.Host
+	if router.byProtocol {
+		key = key + "|" + r.Protocol
+	}
+	if router.byPort {
+		key = key + "|" + strconv.Itoa(r.Port)
+	}
+	if router.bySource {
+		key = key + "|" + r.Source.String()
+	}
+	if router.byUser {
+		key = key + "|" + r.User
+	}
+	if nil != r.Req {
+		key = key + "|" + r.Req.Host
+		if router.byURL {
+			key = key + "|" + r.Req.Method + " " + r.Req.URL.String()
+		}
+	}
+	return key
+}
+
+// candidates returns the rules whose Host & IP conditions may match the request.
+func (router *pacRouter) candidates(r *PACRequest) []bool {
+	candidates := make([]bool, len(router.pac))
+	for i := range candidates {
+		candidates[i] = !router.withHost[i]
+	}
+	if nil != r.Req {
+		host := r.Req.Host
+		if h, _, err := net.SplitHostPort(host); nil == err {
+			host = h
+		}
+		router.hosts.Lookup(strings.ToLower(host), func(i int) {
+			candidates[i] = true
+		})
+	}
+	if ip := net.ParseIP(r.Host); nil != ip {
+		ipMatched := make([]bool, len(router.pac))
+		router.ips.Lookup(ip, func(i int) {
+			ipMatched[i] = true
+		})
+		for i := range candidates {
+			if router.withIP[i] && !ipMatched[i] {
+				candidates[i] = false
+			}
+		}
+	}
+	return candidates
+}
+
+// selectPAC returns the index of the first matched rule, or -1.
+func (router *pacRouter) selectPAC(r *PACRequest) int {
+	key := router.cacheKey(r)
+	if v, exist := router.cache.Get(key); exist {
+		return v.(int)
+	}
+	pacIdx := -1
+	for i, candidate := range router.candidates(r) {
+		if candidate && router.pac[i].match(r, false) {
+			pacIdx = i
+			break
+		}
+	}
+	//IP & 'IsCNIP' like rules depend on the resolved IP of the domain
+	if !r.resolved || nil != net.ParseIP(r.Host) {
+		router.cache.Put(key, pacIdx)
+	}
+	return pacIdx
+}
+
+// purgePACCache drops the cached decisions once the rule sources changed.
+func purgePACCache() {
+	for i := range GConf.Proxy {
+		if nil != GConf.Proxy[i].router {
+			GConf.Proxy[i].router.cache.Purge()
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package local
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPACRouterCache(t *testing.T) {
+	pac := []PACConfig{
+		{IP: []string{"127.0.0.0/8", "::1"}, Remote: "Direct"},
+		{Remote: "Default"},
+	}
+	for i := range pac {
+		if err := pac[i].init(); nil != err {
+			t.Fatal(err)
+		}
+	}
+	router := newPACRouter(pac)
+	if idx := router.selectPAC(newHostPACRequest("https", "127.0.0.1", 443, nil, "")); idx != 0 {
+		t.Fatalf("Unexpected selected rule:%d", idx)
+	}
+	if router.cache.Len() != 1 {
+		t.Fatalf("Expected the decision of the IP host cached")
+	}
+	//the decision of a domain depends on the IP it's resolved to
+	if idx := router.selectPAC(newHostPACRequest("https", "localhost", 443, nil, "")); idx != 0 {
+		t.Fatalf("Unexpected selected rule:%d", idx)
+	}
+	if router.cache.Len() != 1 {
+		t.Fatalf("Expected the decision of the resolved domain not cached")
+	}
+	router = newPACRouter([]PACConfig{{Host: []string{"localhost"}, Remote: "Direct"}})
+	if idx := router.selectPAC(newHostPACRequest("https", "localhost", 443, nil, "")); idx != 0 || router.cache.Len() != 1 {
+		t.Fatalf("Expected the decision of the unresolved domain cached")
+	}
+}
+
+func TestPACRouterCacheKey(t *testing.T) {
+	//returns the number of cached decisions for the requests of the clients
+	cached := func(pac ...PACConfig) int {
+		for i := range pac {
+			pac[i].init()
+		}
+		router := newPACRouter(pac)
+		for _, source := range []string{"192.168.1.10", "192.168.1.11"} {
+			for _, user := range []string{"alice", "bob"} {
+				r := newHostPACRequest("https", "1.1.1.1", 443, net.ParseIP(source), user)
+				r.Req.URL.Path = "/" + user
+				router.selectPAC(r)
+			}
+		}
+		return router.cache.Len()
+	}
+	//the clients share the decisions of a host if no rule matches them
+	if n := cached(PACConfig{Host: []string{"*.example.com"}, Remote: "Direct"}, PACConfig{Remote: "Default"}); n != 1 {
+		t.Fatalf("Expected one cached decision, but got %d", n)
+	}
+	if n := cached(PACConfig{Source: []string{"192.168.1.10"}, Remote: "Direct"}, PACConfig{Remote: "Default"}); n != 2 {
+		t.Fatalf("Expected the decisions cached by source, but got %d", n)
+	}
+	if n := cached(PACConfig{User: []string{"alice"}, Remote: "Direct"}); n != 2 {
+		t.Fatalf("Expected the decisions cached by user, but got %d", n)
+	}
+	if n := cached(PACConfig{Rule: []string{"!BlockedByGFW"}, Remote: "Direct"}); n != 2 {
+		t.Fatalf("Expected the decisions cached by url, but got %d", n)
+	}
+}
@@ -0,0 +1,277 @@
+package local
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/dns"
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+	"github.com/yinqiwen/gsnova/common/socks"
+)
+
+// max datagrams queued per session, the later ones are dropped
+const socksUDPQueueSize = 64
+
+type socksUDPSession struct {
+	relay        *socksUDPRelay
+	target       string
+	stream       mux.MuxStream
+	streamWriter io.Writer
+	mutex        sync.Mutex
+	closed       bool
+	access       *udpAccess
+	queue        chan []byte
+	done         chan struct{}
+}
+
+func newSocksUDPSession(r *socksUDPRelay, target string) *socksUDPSession {
+	return &socksUDPSession{
+		relay:  r,
+		target: target,
+		queue:  make(chan []byte, socksUDPQueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// offer queues the datagram without blocking, it's dropped if the queue is full.
+func (s *socksUDPSession) offer(content []byte) {
+	select {
+	case s.queue <- content:
+	default:
+		logger.Debug("Drop socks udp datagram to %s since the queue is full", s.target)
+	}
+}
+
+// loop forwards the queued datagrams in order until the session closed, the
+// session is closed if no stream opened so that the next datagram starts a new
+// one.
+func (s *socksUDPSession) loop() {
+	for {
+		select {
+		case content := <-s.queue:
+			if !s.handle(content) {
+				s.close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *socksUDPSession) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	if nil != s.stream {
+		s.stream.Close()
+		s.stream = nil
+		s.streamWriter = nil
+	}
+	if nil != s.access {
+		s.access.finish("client-closed")
+	}
+	s.relay.sessions.Delete(s.target)
+}
+
+// handle forwards the datagram, returns false if the stream failed to open.
+func (s *socksUDPSession) handle(content []byte) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return true
+	}
+	if nil != s.streamWriter {
+		s.streamWriter.Write(content)
+		s.access.up(len(content))
+		return true
+	}
+	host, portStr, _ := net.SplitHostPort(s.target)
+	port, _ := strconv.Atoi(portStr)
+	isDNS := port == 53
+	protocol := "udp"
+	if isDNS {
+		protocol = "dns"
+		if res, ok := dns.FakeIPAnswer(content); ok {
+			if err := s.relay.write(s.target, res); nil != err {
+				logger.Error("[ERROR]Failed to write dns response with reason:%v", err)
+			}
+			return true
+		}
+	}
+	remoteAddr := s.target
+	if domain, ok := dns.FakeIPDomain(host); ok {
+		host = domain
+		remoteAddr = net.JoinHostPort(domain, portStr)
+	}
+	var proxyChannelName string
+	if nil != net.ParseIP(host) {
+		proxyChannelName = s.relay.proxy.getProxyChannel(&PACRequest{Protocol: protocol, Host: host, Port: port, Source: s.relay.clientIP, User: s.relay.user})
+	} else {
+		proxyChannelName = s.relay.proxy.getProxyChannel(newHostPACRequest(protocol, host, port, s.relay.clientIP, s.relay.user))
+	}
+	if len(proxyChannelName) == 0 {
+		logger.Error("[ERROR]No proxy found for udp to %s", s.target)
+		return false
+	}
+	if isDNS {
+		if proxyChannelName == channel.DirectChannelName {
+			res, err := dns.QueryRaw(content)
+			if nil == err {
+				err = s.relay.write(s.target, res)
+			}
+			if nil != err {
+				logger.Error("[ERROR]Failed to query dns with reason:%v", err)
+			}
+			return true
+		}
+		if len(GConf.LocalDNS.TrustedDNS) > 0 {
+			remoteAddr = GConf.LocalDNS.TrustedDNS[0]
+		}
+	}
+	stream, conf, readTimeoutMS, err := openUDPProxyStream(proxyChannelName, remoteAddr, isDNS)
+	if nil != err {
+		logger.Error("[ERROR]Failed to create mux stream:%v for proxy:%s by address:%s", err, proxyChannelName, s.target)
+		return false
+	}
+	var streamReader io.Reader
+	streamReader, s.streamWriter = mux.GetCompressStreamReaderWriter(stream, conf.Compressor)
+	s.stream = stream
+	s.access = newUDPAccess(s.relay.user, s.relay.clientIP.String(), remoteAddr, stream, conf, s.close)
+	access := s.access
+	go func() {
+		b := make([]byte, 8192)
+		for {
+			stream.SetReadDeadline(time.Now().Add(time.Duration(readTimeoutMS) * time.Millisecond))
+			n, err := streamReader.Read(b)
+			if isDNS {
+				countProxyDNSResponse(b[0:n], err)
+				isDNS = false
+			}
+			if n > 0 {
+				access.down(n)
+				err = s.relay.write(s.target, b[0:n])
+			}
+			if nil != err {
+				access.closeReason.Set(channel.CopyCloseReason("remote", err))
+				break
+			}
+		}
+		s.close()
+	}()
+	s.streamWriter.Write(content)
+	access.up(len(content))
+	return true
+}
+
+// socksUDPRelay relays the datagrams of a SOCKS5 UDP association, it lives as
+// long as the TCP connection of the association.
+type socksUDPRelay struct {
+	proxy      *ProxyConfig
+	conn       *net.UDPConn
+	clientIP   net.IP
+	clientAddr *net.UDPAddr
+	user       string
+	addrMutex  sync.Mutex
+	sessions   sync.Map
+}
+
+func (r *socksUDPRelay) write(target string, content []byte) error {
+	r.addrMutex.Lock()
+	clientAddr := r.clientAddr
+	r.addrMutex.Unlock()
+	if nil == clientAddr {
+		return nil
+	}
+	d := &socks.UDPDatagram{Target: target, Data: content}
+	b, err := d.Bytes()
+	if nil != err {
+		return err
+	}
+	_, err = r.conn.WriteToUDP(b, clientAddr)
+	return err
+}
+
+func (r *socksUDPRelay) serve() {
+	b := make([]byte, 65536)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(b)
+		if nil != err {
+			return
+		}
+		if !addr.IP.Equal(r.clientIP) {
+			logger.Debug("Drop socks udp datagram from %v since it's not from client %v", addr, r.clientIP)
+			continue
+		}
+		d, err := socks.ParseUDPDatagram(b[0:n])
+		if nil != err {
+			logger.Error("Invalid socks udp datagram from %v:%v", addr, err)
+			continue
+		}
+		if 0 != d.Frag {
+			//fragmentation is not supported
+			continue
+		}
+		r.addrMutex.Lock()
+		r.clientAddr = addr
+		r.addrMutex.Unlock()
+		content := make([]byte, len(d.Data))
+		copy(content, d.Data)
+		//the session is allocated only for the first datagram to the target
+		v, exist := r.sessions.Load(d.Target)
+		if !exist {
+			session := newSocksUDPSession(r, d.Target)
+			if v, exist = r.sessions.LoadOrStore(d.Target, session); !exist {
+				go session.loop()
+			}
+		}
+		v.(*socksUDPSession).offer(content)
+	}
+}
+
+func (r *socksUDPRelay) close() {
+	r.conn.Close()
+	r.sessions.Range(func(key, value interface{}) bool {
+		value.(*socksUDPSession).close()
+		return true
+	})
+}
+
+func handleSocksUDPAssociate(socksConn *socks.SocksConn, proxy *ProxyConfig, user string) {
+	localAddr, _ := socksConn.LocalAddr().(*net.TCPAddr)
+	remoteAddr, _ := socksConn.RemoteAddr().(*net.TCPAddr)
+	if nil == localAddr || nil == remoteAddr {
+		socksConn.RejectReason(socks.SocksRepGeneralFailure)
+		return
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if nil != err {
+		logger.Error("[ERROR]Failed to listen udp for socks udp associate:%v", err)
+		socksConn.RejectReason(socks.SocksRepGeneralFailure)
+		return
+	}
+	relay := &socksUDPRelay{
+		proxy:    proxy,
+		conn:     conn,
+		clientIP: remoteAddr.IP,
+		user:     user,
+	}
+	defer relay.close()
+	if err = socksConn.GrantUDP(conn.LocalAddr().(*net.UDPAddr)); nil != err {
+		return
+	}
+	logger.Debug("Socks udp associate for %v relay at %v by user:%s", remoteAddr, conn.LocalAddr(), user)
+	go relay.serve()
+	//the association terminates when the TCP connection closed
+	io.Copy(ioutil.Discard, socksConn)
+}
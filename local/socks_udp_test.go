@@ -0,0 +1,24 @@
+package local
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocksUDPSessionClosedOnOpenFailure(t *testing.T) {
+	proxy := &ProxyConfig{PAC: []PACConfig{{Remote: "nonexist"}}}
+	relay := &socksUDPRelay{proxy: proxy, clientIP: net.ParseIP("127.0.0.1")}
+	session := newSocksUDPSession(relay, "1.2.3.4:5000")
+	relay.sessions.Store(session.target, session)
+	go session.loop()
+	session.offer([]byte("hello"))
+	select {
+	case <-session.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the session closed after the stream failed to open")
+	}
+	if _, exist := relay.sessions.Load(session.target); exist {
+		t.Fatalf("Expected the failed session removed")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/dns"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
 	"github.com/yinqiwen/gsnova/common/netx"
@@ -98,29 +99,36 @@ func (t *tudpSession) handle(p []byte) {
 		if t.remotePort == "53" {
 			protocol = "dns"
 			isDNS = true
+			if res, ok := dns.FakeIPAnswer(p); ok {
+				writeBackUDPData(res, t.local, t.remote)
+				t.close(nil)
+				return
+			}
+		}
+		remoteHost := t.remoteIP.String()
+		if domain, ok := dns.FakeIPDomain(remoteHost); ok {
+			remoteHost = domain
 		}
-		proxyChannelName := t.conf.getProxyChannelByHost(protocol, t.remoteIP.String())
+		port, _ := strconv.Atoi(t.remotePort)
+		proxyChannelName := t.conf.getProxyChannel(newHostPACRequest(protocol, remoteHost, port, t.localIP, ""))
 		if len(proxyChannelName) == 0 {
-			logger.Error("[ERROR]No proxy found for %s:%s", protocol, t.remoteIP.String())
+			logger.Error("[ERROR]No proxy found for %s:%s", protocol, remoteHost)
 			t.close(nil)
 			return
 		}
-		logger.Debug("Select %s to proxy udp packet to %s:%s", proxyChannelName, t.remoteIP.String(), t.remotePort)
-		stream, conf, err := channel.GetMuxStreamByChannel(proxyChannelName)
+		logger.Debug("Select %s to proxy udp packet to %s:%s", proxyChannelName, remoteHost, t.remotePort)
 		var readTimeout int
-		if nil == err {
+		stream, _, err := openProxyStream(proxyChannelName, func(stream mux.MuxStream, conf *channel.ProxyChannelConfig) error {
 			readTimeout = conf.RemoteDNSReadMSTimeout
 			if isDNS {
 				readTimeout = conf.RemoteDNSReadMSTimeout
 			}
-		}
-		if nil != stream {
 			opt := mux.StreamOptions{
 				DialTimeout: conf.RemoteDialMSTimeout,
 				ReadTimeout: readTimeout,
 			}
-			err = stream.Connect("udp", net.JoinHostPort(t.remoteIP.String(), t.remotePort), opt)
-		}
+			return stream.Connect("udp", net.JoinHostPort(remoteHost, t.remotePort), opt)
+		})
 		if nil != err || nil == stream {
 			logger.Error("Failed to open stream for reason:%v by proxy:%s", err, proxyChannelName)
 			t.close(err)
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -118,6 +119,8 @@ type udpSession struct {
 	streamWriter     io.Writer
 	streamReader     io.Reader
 	proxyChannelName string
+	user             string
+	access           *udpAccess
 }
 
 func (u *udpSession) closeStream() {
@@ -127,6 +130,10 @@ func (u *udpSession) closeStream() {
 		u.streamWriter = nil
 		u.streamReader = nil
 	}
+	if nil != u.access {
+		u.access.finish("closed")
+		u.access = nil
+	}
 }
 func (u *udpSession) close() {
 	u.closeStream()
@@ -148,14 +155,21 @@ func (u *udpSession) Write(content []byte) error {
 func (u *udpSession) handlePacket(proxy *ProxyConfig, packet *udpgwPacket) error {
 	if nil != u.streamWriter {
 		u.streamWriter.Write(packet.content)
+		u.access.up(len(packet.content))
 		return nil
 	}
 
 	remoteAddr := packet.address()
+	source := sourceIP(u.localConn.RemoteAddr())
 	if packet.addr.port == 53 {
-		selectProxy := proxy.findProxyChannelByRequest("dns", packet.addr.ip.String(), nil)
+		if res, ok := dns.FakeIPAnswer(packet.content); ok {
+			err := u.Write(res)
+			u.close()
+			return err
+		}
+		selectProxy := proxy.getProxyChannel(&PACRequest{Protocol: "dns", Host: packet.addr.ip.String(), Port: int(packet.addr.port), Source: source, User: u.user})
 		if selectProxy == channel.DirectChannelName {
-			res, err := dns.LocalDNS.QueryRaw(packet.content)
+			res, err := dns.QueryRaw(packet.content)
 			if nil == err {
 				err = u.Write(res)
 			}
@@ -170,8 +184,14 @@ func (u *udpSession) handlePacket(proxy *ProxyConfig, packet *udpgwPacket) error
 			remoteAddr = GConf.LocalDNS.TrustedDNS[0]
 		}
 	}
+	if domain, ok := dns.FakeIPDomain(packet.addr.ip.String()); ok {
+		remoteAddr = net.JoinHostPort(domain, strconv.Itoa(int(packet.addr.port)))
+		if len(u.proxyChannelName) == 0 {
+			u.proxyChannelName = proxy.getProxyChannel(newHostPACRequest("udp", domain, int(packet.addr.port), source, u.user))
+		}
+	}
 	if len(u.proxyChannelName) == 0 {
-		u.proxyChannelName = proxy.findProxyChannelByRequest("udp", packet.addr.ip.String(), nil)
+		u.proxyChannelName = proxy.getProxyChannel(&PACRequest{Protocol: "udp", Host: packet.addr.ip.String(), Port: int(packet.addr.port), Source: source, User: u.user})
 	}
 	if len(u.proxyChannelName) == 0 {
 		logger.Error("[ERROR]No proxy found for udp to %s", packet.addr.ip.String())
@@ -183,18 +203,8 @@ func (u *udpSession) handlePacket(proxy *ProxyConfig, packet *udpgwPacket) error
 			u.closeStream()
 		}
 	}
-	stream, conf, err := channel.GetMuxStreamByChannel(u.proxyChannelName)
-	readTimeoutMS := conf.RemoteUDPReadMSTimeout
-	if packet.addr.port == 53 {
-		readTimeoutMS = conf.RemoteDNSReadMSTimeout
-	}
-	if nil != stream {
-		opt := mux.StreamOptions{
-			DialTimeout: conf.RemoteDialMSTimeout,
-			ReadTimeout: readTimeoutMS,
-		}
-		err = stream.Connect("udp", remoteAddr, opt)
-	}
+	isDNS := packet.addr.port == 53
+	stream, conf, readTimeoutMS, err := openUDPProxyStream(u.proxyChannelName, remoteAddr, isDNS)
 	if nil != err {
 		logger.Error("[ERROR]Failed to create mux stream:%v for proxy:%s by address:%v", err, u.proxyChannelName, packet.addr)
 		return err
@@ -202,24 +212,64 @@ func (u *udpSession) handlePacket(proxy *ProxyConfig, packet *udpgwPacket) error
 
 	u.stream = stream
 	u.streamReader, u.streamWriter = mux.GetCompressStreamReaderWriter(stream, conf.Compressor)
+	u.access = newUDPAccess(u.user, channel.ClientIP(u.localConn.RemoteAddr().String()), remoteAddr, stream, conf, u.close)
+	access := u.access
 	go func() {
 		b := make([]byte, 8192)
 		for {
 			stream.SetReadDeadline(time.Now().Add(time.Duration(readTimeoutMS) * time.Millisecond))
 			n, err := u.streamReader.Read(b)
+			if isDNS {
+				countProxyDNSResponse(b[0:n], err)
+				isDNS = false
+			}
 			if n > 0 {
+				access.down(n)
 				err = u.Write(b[0:n])
 			}
 			if nil != err {
+				access.closeReason.Set(channel.CopyCloseReason("remote", err))
 				break
 			}
 		}
 
 	}()
 	u.streamWriter.Write(packet.content)
+	access.up(len(packet.content))
 	return nil
 }
 
+// countProxyDNSResponse counts the DNS query proxied by the stream once the
+// first response is read.
+func countProxyDNSResponse(res []byte, err error) {
+	if len(res) > 0 {
+		err = nil
+	}
+	dns.CountResponse("proxy", res, err)
+}
+
+// openUDPProxyStream opens a stream connected to the udp remote address by
+// the named channel, returns the read timeout of the stream in milliseconds.
+func openUDPProxyStream(channelName string, remoteAddr string, isDNS bool) (mux.MuxStream, *channel.ProxyChannelConfig, int, error) {
+	var readTimeoutMS int
+	stream, conf, err := openProxyStream(channelName, func(stream mux.MuxStream, conf *channel.ProxyChannelConfig) error {
+		readTimeoutMS = conf.RemoteUDPReadMSTimeout
+		if isDNS {
+			readTimeoutMS = conf.RemoteDNSReadMSTimeout
+		}
+		opt := mux.StreamOptions{
+			DialTimeout: conf.RemoteDialMSTimeout,
+			ReadTimeout: readTimeoutMS,
+		}
+		return stream.Connect("udp", remoteAddr, opt)
+	})
+	if isDNS && nil != err {
+		//the query is counted once the response is read if the stream is opened
+		dns.CountQuery("proxy", err)
+	}
+	return stream, conf, readTimeoutMS, err
+}
+
 var udpSessionTable sync.Map
 var udpSessionIdSet = btree.New(4)
 var cidTable = make(map[uint32]uint16)
@@ -314,7 +364,7 @@ func getCid(sid uint32) (uint16, bool) {
 	return cid, exist
 }
 
-func handleUDPGatewayConn(localConn net.Conn, proxy *ProxyConfig) {
+func handleUDPGatewayConn(localConn net.Conn, proxy *ProxyConfig, user string) {
 	bufconn := bufio.NewReader(localConn)
 	defer func() {
 		localConn.Close()
@@ -334,6 +384,7 @@ func handleUDPGatewayConn(localConn net.Conn, proxy *ProxyConfig) {
 
 		usession := getUDPSession(packet.conid, localConn, true)
 		usession.addr = packet.addr
+		usession.user = user
 		updateUdpSession(usession, false)
 		go usession.handlePacket(proxy, &packet)
 	}
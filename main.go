@@ -8,10 +8,12 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/yinqiwen/gotoolkit/ots"
@@ -62,6 +64,7 @@ func main() {
 	conf := flag.String("conf", "", "Config file of gsnova.")
 	key := flag.String("key", "809240d3a021449f6e67aa73221d42df942a308a", "Cipher key for transmission between local&remote.")
 	log := flag.String("log", "color,gsnova.log", "Log file setting")
+	logLevel := flag.String("log_level", "", "Min log level with per-package overrides, e.g. 'info,channel=debug,dns=warn'")
 	window := flag.String("window", "", "Max mux stream window size, default 512K")
 	windowRefresh := flag.String("window_refresh", "", "Mux stream window refresh size, default 32K")
 	pingInterval := flag.Int("ping_interval", 30, "Channel ping interval seconds.")
@@ -77,6 +80,9 @@ func main() {
 	cnip := flag.String("cnip", "./cnipset.txt", "China IP list.")
 	mitm := flag.Bool("mitm", false, "Launch gsnova as a MITM Proxy")
 	httpDumpDest := flag.String("httpdump.dst", "", "HTTP Dump destination file or http url")
+	route := flag.String("route", "", "Explain the route of the host or URL by the client config without starting the proxy, eg:www.google.com:443")
+	routeProto := flag.String("route.proto", "", "Protocol of the connection to explain, default is tcp for the SNI, http for a http URL, https otherwise")
+	routeSNI := flag.String("route.sni", "", "SNI sniffed from the SOCKS or transparent connection to the route IP")
 	var httpDumpFilters channel.HopServers
 	flag.Var(&httpDumpFilters, "httpdump.filter", "HTTP Dump Domain Filter, eg:*.google.com")
 	var hops, forwards channel.HopServers
@@ -97,6 +103,8 @@ func main() {
 	//server options
 	tlsKey := flag.String("tls.key", "", "TLS Key file")
 	tlsCert := flag.String("tls.cert", "", "TLS Cert file")
+	var hopAllows channel.HopServers
+	flag.Var(&hopAllows, "hop.allow", "Next hop url pattern allowed for clients, eg:wss://*.herokuapp.com")
 
 	flag.Parse()
 
@@ -105,6 +113,25 @@ func main() {
 		return
 	}
 
+	if len(*route) > 0 {
+		confile := *conf
+		if len(confile) == 0 {
+			confile = "./client.json"
+		}
+		q := local.RouteQuery{Host: *route, SNI: *routeSNI, Protocol: *routeProto}
+		if strings.Contains(*route, "://") {
+			q = local.RouteQuery{URL: *route, SNI: *routeSNI, Protocol: *routeProto}
+		}
+		exp, err := local.ExplainRouteByConf(local.ProxyOptions{Config: confile, Hosts: *hosts, CNIP: *cnip, Home: home}, q)
+		if nil != err {
+			fmt.Printf("Failed to explain route:%v\n", err)
+			os.Exit(1)
+		}
+		js, _ := json.MarshalIndent(exp, "", "    ")
+		fmt.Println(string(js))
+		return
+	}
+
 	printASCIILogo()
 
 	confile := *conf
@@ -172,6 +199,7 @@ func main() {
 			local.GConf.Cipher.Method = "auto"
 			local.GConf.Cipher.User = *user
 			local.GConf.Log = strings.Split(*log, ",")
+			local.GConf.LogLevel = *logLevel
 			for _, lis := range listens {
 				proxyConf := local.ProxyConfig{}
 				proxyConf.MITM = *mitm
@@ -284,12 +312,16 @@ func main() {
 			if len(*log) > 0 {
 				remote.ServerConf.Log = strings.Split(*log, ",")
 			}
+			if len(*logLevel) > 0 {
+				remote.ServerConf.LogLevel = *logLevel
+			}
 			if len(*window) > 0 {
 				remote.ServerConf.Mux.MaxStreamWindow = *window
 			}
 			if len(*windowRefresh) > 0 {
 				remote.ServerConf.Mux.StreamMinRefresh = *windowRefresh
 			}
+			remote.ServerConf.Hop.Allow = []string(hopAllows)
 		}
 
 		cipherKey := os.Getenv("GSNOVA_CIPHER_KEY")
@@ -298,11 +330,34 @@ func main() {
 			logger.Notice("Server cipher key overide by env:GSNOVA_CIPHER_KEY")
 		}
 		channel.DefaultServerRateLimit = remote.ServerConf.RateLimit
+		channel.InitServerTraffic(remote.ServerConf.Traffic)
+		if err := channel.InitServerUsers(remote.ServerConf.UsersFile); nil != err {
+			logger.Error("Failed to load users file:%s for reason:%v", remote.ServerConf.UsersFile, err)
+			return
+		}
+		if err := channel.InitServerSigningKey(remote.ServerConf.SigningKey); nil != err {
+			logger.Error("Failed to load signing key:%s for reason:%v", remote.ServerConf.SigningKey, err)
+			return
+		}
 		channel.SetDefaultMuxConfig(remote.ServerConf.Mux)
+		channel.SetDefaultProxyLimitConfig(remote.ServerConf.ProxyLimit)
+		channel.SetDefaultHopLimitConfig(remote.ServerConf.Hop)
 		remote.ServerConf.Cipher.AllowUsers(remote.ServerConf.Cipher.User)
 		channel.DefaultServerCipher = remote.ServerConf.Cipher
 
-		logger.InitLogger(remote.ServerConf.Log)
+		if err := logger.Init(logger.Config{
+			Output: remote.ServerConf.Log,
+			Level:  remote.ServerConf.LogLevel,
+			JSON:   remote.ServerConf.LogJSON,
+			Rotate: remote.ServerConf.LogRotate,
+		}); nil != err {
+			logger.Error("Failed to init logger for reason:%v", err)
+			return
+		}
+		if err := channel.InitAccessLog(remote.ServerConf.AccessLog); nil != err {
+			logger.Error("Failed to init access log:%s for reason:%v", remote.ServerConf.AccessLog.Path, err)
+			return
+		}
 
 		logger.Info("Load server conf success.")
 		confdata, _ := json.MarshalIndent(&remote.ServerConf, "", "    ")
@@ -313,6 +368,11 @@ func main() {
 	if len(*pid) > 0 {
 		ioutil.WriteFile(*pid, []byte(fmt.Sprintf("%d", os.Getpid())), os.ModePerm)
 	}
-	ch := make(chan int)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	<-ch
+	if *isServer {
+		//keep the traffic since the last periodic save
+		channel.SaveServerTraffic()
+	}
 }
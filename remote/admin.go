@@ -0,0 +1,66 @@
+package remote
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/metrics"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	js, _ := json.MarshalIndent(v, "", "    ")
+	w.Write(js)
+}
+
+// GET /sessions[?user=xyz]
+func sessionsCallback(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, channel.ListRemoteSessions(r.FormValue("user")))
+}
+
+// POST /sessions/kick?id=1 or POST /sessions/kick?user=xyz
+func kickCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var id int64
+	if idStr := r.FormValue("id"); len(idStr) > 0 {
+		var err error
+		id, err = strconv.ParseInt(idStr, 10, 64)
+		if nil != err || id <= 0 {
+			http.Error(w, "Invalid session id", http.StatusBadRequest)
+			return
+		}
+	}
+	user := r.FormValue("user")
+	if 0 == id && len(user) == 0 {
+		http.Error(w, "Session id or user required", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]int{"Kicked": channel.KickRemoteSessions(id, user)})
+}
+
+// GET /traffic
+func trafficCallback(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, channel.GetUserTrafficStats())
+}
+
+func startAdminServer(listenAddr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stat", statCallback)
+	mux.HandleFunc("/stackdump", stackdumpCallback)
+	mux.HandleFunc("/sessions", sessionsCallback)
+	mux.HandleFunc("/sessions/kick", kickCallback)
+	mux.HandleFunc("/traffic", trafficCallback)
+	mux.HandleFunc("/metrics", metrics.Handler)
+	mux.HandleFunc("/loglevel", logger.LevelHandler)
+	logger.Info("Listen on admin HTTP address:%s", listenAddr)
+	err := http.ListenAndServe(listenAddr, mux)
+	if nil != err {
+		logger.Error("Listen admin HTTP server error:%v", err)
+	}
+}
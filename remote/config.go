@@ -2,6 +2,7 @@ package remote
 
 import (
 	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/logger"
 )
 
 type ServerListenConfig struct {
@@ -12,12 +13,28 @@ type ServerListenConfig struct {
 }
 
 type ServerConfig struct {
-	Cipher     channel.CipherConfig
+	//private admin http server address, keep it unreachable from public network
+	AdminListen string
+	Cipher      channel.CipherConfig
+	//users file with per-user key & limits, reloaded once changed
+	UsersFile string
+	//file of the long-term key to sign auth responses, generated if not exist
+	SigningKey string
 	RateLimit  channel.RateLimitConfig
+	Traffic    channel.TrafficConfig
 	ProxyLimit channel.ProxyLimitConfig
-	Mux        channel.MuxConfig
-	Log        []string
-	Server     []ServerListenConfig
+	//next hops allowed to be requested by clients
+	Hop    channel.HopLimitConfig
+	Mux    channel.MuxConfig
+	Log    []string
+	Server []ServerListenConfig
+	//one JSON line per closed stream, rotated separately from Log
+	AccessLog channel.AccessLogConfig
+	//min level with per-package overrides like 'info,channel=debug,dns=warn'
+	LogLevel string
+	//write one JSON object per line into Log
+	LogJSON   bool
+	LogRotate logger.RotateConfig
 }
 
 var ServerConf ServerConfig
@@ -2,8 +2,10 @@ package remote
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"net/url"
 
+	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
 
@@ -19,12 +21,29 @@ func generateTLSConfig(cert, key string) (*tls.Config, error) {
 		tlscfg.Certificates = make([]tls.Certificate, 1)
 		var err error
 		tlscfg.Certificates[0], err = tls.LoadX509KeyPair(cert, key)
+		if nil == err {
+			logSPKIPin(cert, tlscfg)
+		}
 		return tlscfg, err
 	}
 	return helper.GenerateTLSConfig(), nil
 }
 
+//clients could pin the public key of the configured cert by 'SPKIPins'
+func logSPKIPin(cert string, tlscfg *tls.Config) {
+	if len(tlscfg.Certificates[0].Certificate) == 0 {
+		return
+	}
+	c, err := x509.ParseCertificate(tlscfg.Certificates[0].Certificate[0])
+	if nil == err {
+		logger.Notice("TLS public key pin of %s:%s", cert, channel.SPKIPin(c))
+	}
+}
+
 func StartRemoteProxy() {
+	if len(ServerConf.AdminListen) > 0 {
+		go startAdminServer(ServerConf.AdminListen)
+	}
 	for _, lis := range ServerConf.Server {
 		u, err := url.Parse(lis.Listen)
 		if nil != err {